@@ -0,0 +1,139 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// DeviceSpec definisce lo stato voluto di un dispositivo registrato.
+// Identità e chiave sono copiate dalla registrazione approvata e non cambiano più;
+// i campi del ciclo di vita sono quelli che un amministratore modifica per gestire il dispositivo.
+type DeviceSpec struct {
+	// PublicKey è la chiave pubblica approvata, nel formato inviato dal dispositivo.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=16384
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="publicKey is immutable"
+	PublicKey string `json:"publicKey"`
+
+	// RegistrationRef è il nome della DeviceRegistration da cui il dispositivo è stato approvato,
+	// nello stesso namespace.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=253
+	// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="registrationRef is immutable"
+	RegistrationRef string `json:"registrationRef"`
+
+	// Metadata descrive il dispositivo. Viene copiato dalla registrazione di origine e può essere
+	// aggiornato, ad esempio dopo un aggiornamento del firmware: l'operatore allinea le label del Device.
+	// +optional
+	Metadata *DeviceMetadata `json:"metadata,omitempty"`
+
+	// Deactivate, se impostato a true, deattiva il dispositivo: il certificato viene sospeso nella CRL
+	// finché il flag non viene rimosso.
+	// +optional
+	Deactivate bool `json:"deactivate,omitempty"`
+
+	// SuspendUntil sospende il dispositivo fino all'istante indicato: il dispositivo torna attivo da solo
+	// quando l'istante è passato o quando il campo viene rimosso.
+	// +optional
+	SuspendUntil *metav1.Time `json:"suspendUntil,omitempty"`
+
+	// Quarantine, se impostato a true, isola un dispositivo sospettato di essere compromesso:
+	// il certificato viene revocato in modo definitivo. Rimuovendo il flag il dispositivo riceve
+	// un nuovo certificato.
+	// +optional
+	Quarantine bool `json:"quarantine,omitempty"`
+
+	// Retire, se impostato a true, dismette il dispositivo in modo definitivo.
+	// +optional
+	Retire bool `json:"retire,omitempty"`
+}
+
+// DeviceStatus definisce lo stato osservato di Device. Viene copiato dalla registrazione di origine,
+// che resta la fonte dello stato del certificato letta dal Gateway.
+type DeviceStatus struct {
+	// Phase è la fase corrente del ciclo di vita del dispositivo, con gli stessi valori
+	// di DeviceRegistration: Approved, Deactivated, Suspended, Expired, Quarantined, Retired.
+	// +optional
+	Phase string `json:"phase,omitempty"`
+
+	// Message fornisce dettagli leggibili sullo stato corrente.
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// KeyAlgorithm è l'algoritmo della chiave pubblica (RSA, ECDSA, Ed25519).
+	// +optional
+	KeyAlgorithm string `json:"keyAlgorithm,omitempty"`
+
+	// KeyFingerprint è lo SHA-256 esadecimale della chiave pubblica in forma DER PKIX.
+	// +optional
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+
+	// RegistrationTimestamp è il momento dell'approvazione della registrazione di origine.
+	// +optional
+	RegistrationTimestamp string `json:"registrationTimestamp,omitempty"` // Formato RFC3339
+
+	// CertificateSerialNumber è il numero di serie (esadecimale) del certificato corrente.
+	// +optional
+	CertificateSerialNumber string `json:"certificateSerialNumber,omitempty"`
+
+	// CertificateNotAfter è la scadenza del certificato corrente.
+	// +optional
+	CertificateNotAfter *metav1.Time `json:"certificateNotAfter,omitempty"`
+
+	// CertificateRevokedAt è il momento in cui il certificato corrente è stato inserito nella CRL.
+	// +optional
+	CertificateRevokedAt *metav1.Time `json:"certificateRevokedAt,omitempty"`
+
+	// ObservedGeneration è la generazione della spec elaborata per ultima dall'operatore.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions riporta le condizioni Ready, Deactivated, TransitionAllowed ed ExpiringSoon
+	// della registrazione di origine.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase",description="The current lifecycle phase of the device"
+// +kubebuilder:printcolumn:name="Model",type="string",JSONPath=".spec.metadata.model",description="The hardware model of the device"
+// +kubebuilder:printcolumn:name="Firmware",type="string",JSONPath=".spec.metadata.firmwareVersion",description="The firmware version of the device"
+// +kubebuilder:printcolumn:name="Registration",type="string",JSONPath=".spec.registrationRef",description="The registration the device was approved from"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// Device è un dispositivo registrato. Viene creato dall'operatore all'approvazione di una
+// DeviceRegistration, con il nome pari al DeviceUUID, e vive finché il dispositivo non viene cancellato.
+type Device struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   DeviceSpec   `json:"spec,omitempty"`
+	Status DeviceStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// DeviceList contiene una lista di Device.
+type DeviceList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Device `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Device{}, &DeviceList{})
+}
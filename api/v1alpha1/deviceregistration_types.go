@@ -22,22 +22,108 @@ import (
 
 // DeviceRegistrationSpec definisce lo stato voluto di una richiesta di registrazione.
 // Questa risorsa è tipicamente creata da un gateway quando un dispositivo cerca di connettersi.
+// Una volta creato il Device, la spec non può più essere modificata: i campi del ciclo di vita
+// si impostano sul Device.
 type DeviceRegistrationSpec struct {
-	// PublicKey del dispositivo che richiede la registrazione, in formato PEM o simile.
+	// PublicKey del dispositivo che richiede la registrazione.
+	// Formati accettati: PEM PKIX o PKCS#1, OpenSSH authorized_keys, Ed25519 grezza (base64 o hex).
 	// Questo campo è obbligatorio per una richiesta di registrazione.
 	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MaxLength=16384
 	PublicKey string `json:"publicKey"`
 
 	// Deactivate, se impostato a true, avvia il workflow di deattivazione per un dispositivo già approvato.
-	// L'amministratore può impostare questo flag per disabilitare temporaneamente un dispositivo.
+	// Viene considerato solo finché la registrazione non ha un Device: da allora si usa spec.deactivate del Device.
+	// Lo stesso vale per SuspendUntil, Quarantine e Retire.
 	// +optional
 	Deactivate bool `json:"deactivate,omitempty"`
+
+	// SuspendUntil sospende un dispositivo approvato fino all'istante indicato: il certificato viene
+	// sospeso nella CRL e il dispositivo torna Approved da solo quando l'istante è passato
+	// o quando il campo viene rimosso.
+	// +optional
+	SuspendUntil *metav1.Time `json:"suspendUntil,omitempty"`
+
+	// Quarantine, se impostato a true, isola un dispositivo sospettato di essere compromesso:
+	// il certificato viene revocato in modo definitivo. Rimuovendo il flag il dispositivo torna
+	// Approved con un nuovo certificato.
+	// +optional
+	Quarantine bool `json:"quarantine,omitempty"`
+
+	// Retire, se impostato a true, dismette il dispositivo in modo definitivo: il certificato viene
+	// revocato e la registrazione resta nella fase Retired anche se il flag viene rimosso.
+	// +optional
+	Retire bool `json:"retire,omitempty"`
+
+	// Metadata descrive il dispositivo come dichiarato al momento dell'enrollment.
+	// I valori validi come label Kubernetes vengono copiati nelle label della registrazione e del Device.
+	// +optional
+	Metadata *DeviceMetadata `json:"metadata,omitempty"`
+
+	// Approval è la decisione dell'amministratore su una richiesta in attesa di approvazione manuale
+	// (modalità di pairing "manual" o chiave di un dispositivo cancellato). Viene considerata solo
+	// mentre la registrazione ha la condizione AwaitingApproval.
+	// +optional
+	Approval *DeviceApproval `json:"approval,omitempty"`
+}
+
+// DeviceMetadata contiene le informazioni descrittive di un dispositivo: modello, numero di serie,
+// versione del firmware, indirizzo MAC e label libere. Sono dichiarate dal dispositivo e non verificate.
+type DeviceMetadata struct {
+	// Model è il modello hardware del dispositivo, ad esempio "th-sensor-v2".
+	// +kubebuilder:validation:MaxLength=128
+	// +optional
+	Model string `json:"model,omitempty"`
+
+	// SerialNumber è il numero di serie assegnato dal produttore.
+	// +kubebuilder:validation:MaxLength=64
+	// +optional
+	SerialNumber string `json:"serialNumber,omitempty"`
+
+	// FirmwareVersion è la versione del firmware in esecuzione al momento dell'enrollment.
+	// +kubebuilder:validation:MaxLength=64
+	// +optional
+	FirmwareVersion string `json:"firmwareVersion,omitempty"`
+
+	// MACAddress è l'indirizzo MAC (EUI-48) dell'interfaccia di rete principale,
+	// in forma canonica: esadecimale minuscolo separato da due punti.
+	// +kubebuilder:validation:Pattern=`^([0-9a-f]{2}:){5}[0-9a-f]{2}$`
+	// +optional
+	MACAddress string `json:"macAddress,omitempty"`
+
+	// Labels sono coppie chiave/valore libere. Le chiavi hanno la forma di un nome di label
+	// Kubernetes senza prefisso (al massimo 63 caratteri alfanumerici, '-', '_' o '.').
+	// +kubebuilder:validation:MaxProperties=16
+	// +kubebuilder:validation:XValidation:rule="self.all(k, k.size() <= 63 && k.matches('^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$') && self[k].size() <= 256)",message="label keys must be valid label names of at most 63 characters and values at most 256 characters long"
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// DeviceApproval registra la decisione di un amministratore su una richiesta di registrazione.
+type DeviceApproval struct {
+	// Decision è l'esito scelto dall'amministratore.
+	// +kubebuilder:validation:Enum=Approved;Rejected
+	Decision string `json:"decision"`
+
+	// ApprovedBy identifica l'amministratore che ha preso la decisione. La ValidatingAdmissionPolicy
+	// distribuita con il gateway richiede che coincida con l'utente Kubernetes che imposta la decisione.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=253
+	ApprovedBy string `json:"approvedBy"`
+
+	// Reason è una motivazione facoltativa, riportata nel messaggio di stato.
+	// +kubebuilder:validation:MaxLength=1024
+	// +optional
+	Reason string `json:"reason,omitempty"`
 }
 
 // DeviceRegistrationStatus definisce lo stato osservato di DeviceRegistration.
 type DeviceRegistrationStatus struct {
 	// Phase indica la fase corrente del ciclo di vita della registrazione.
-	// Valori possibili: Pending, Approved, Rejected, Deactivated.
+	// Valori possibili: Pending, Approved, Rejected, Deactivated, Suspended, Expired, Quarantined, Retired.
+	// Una richiesta resta Pending, con la condizione AwaitingApproval, finché un amministratore non la approva.
+	// Le transizioni ammesse sono descritte nel pacchetto internal/lifecycle; una transizione chiesta
+	// nella spec ma non ammessa nella fase corrente è segnalata dalla condizione TransitionAllowed.
 	// +optional
 	Phase string `json:"phase,omitempty"`
 
@@ -45,17 +131,87 @@ type DeviceRegistrationStatus struct {
 	// +optional
 	Message string `json:"message,omitempty"`
 
+	// Reason è un codice leggibile dalle macchine che spiega la fase corrente,
+	// ad esempio InvalidPublicKey, WeakPublicKey o PairingDisabled in caso di rifiuto,
+	// o AwaitingApproval mentre la richiesta attende la decisione di un amministratore.
+	// +optional
+	Reason string `json:"reason,omitempty"`
+
+	// KeyAlgorithm è l'algoritmo rilevato dall'operatore nella chiave pubblica (RSA, ECDSA, Ed25519).
+	// +optional
+	KeyAlgorithm string `json:"keyAlgorithm,omitempty"`
+
+	// KeySize è la dimensione in bit della chiave pubblica (modulo RSA o curva ECDSA).
+	// +optional
+	KeySize int `json:"keySize,omitempty"`
+
+	// KeyFingerprint è lo SHA-256 esadecimale della chiave pubblica in forma DER PKIX.
+	// Viene indicizzato dall'operatore per riconoscere le registrazioni duplicate.
+	// +optional
+	KeyFingerprint string `json:"keyFingerprint,omitempty"`
+
+	// DuplicateOf è il nome della registrazione originale quando questa richiesta
+	// riusa una chiave già registrata e ne eredita il DeviceUUID.
+	// +optional
+	DuplicateOf string `json:"duplicateOf,omitempty"`
+
 	// RegistrationTimestamp è il timestamp di quando la registrazione è stata approvata.
 	// +optional
 	RegistrationTimestamp string `json:"registrationTimestamp,omitempty"` // Formato RFC3339
 
+	// ApprovedBy è l'amministratore che ha approvato o rifiutato manualmente la richiesta.
+	// +optional
+	ApprovedBy string `json:"approvedBy,omitempty"`
+
+	// ApprovalTimestamp è il momento in cui l'operatore ha applicato la decisione dell'amministratore.
+	// +optional
+	ApprovalTimestamp string `json:"approvalTimestamp,omitempty"` // Formato RFC3339
+
 	// DeviceUUID è l'identificatore univoco assegnato al dispositivo dall'operatore
 	// dopo che la registrazione è stata approvata. Questo è l'ID ufficiale del dispositivo nel sistema.
 	// +optional
 	DeviceUUID string `json:"deviceUUID,omitempty"`
 
-	// Conditions fornisce una lista di condizioni che descrivono lo stato corrente della risorsa.
-	// Utile per una diagnostica dettagliata.
+	// Device è il nome del Device creato all'approvazione, pari al DeviceUUID. Da quando è valorizzato
+	// la registrazione è un record storico: la sua spec non può più cambiare.
+	// +optional
+	Device string `json:"device,omitempty"`
+
+	// Certificate contiene, in formato PEM, il certificato client emesso dalla CA dell'operatore
+	// per il dispositivo approvato, seguito dal certificato della CA.
+	// +optional
+	Certificate string `json:"certificate,omitempty"`
+
+	// CertificateSerialNumber è il numero di serie (esadecimale) del certificato emesso.
+	// +optional
+	CertificateSerialNumber string `json:"certificateSerialNumber,omitempty"`
+
+	// CertificateNotAfter è la scadenza del certificato corrente. Prima di questa data il dispositivo
+	// deve rinnovarlo tramite il gateway, altrimenti la registrazione passa nella fase Expired.
+	// +optional
+	CertificateNotAfter *metav1.Time `json:"certificateNotAfter,omitempty"`
+
+	// LastRenewalRequest è l'ultimo valore dell'annotazione devices.example.com/renewal-request
+	// elaborato dall'operatore. Il gateway lo confronta con la propria richiesta per sapere
+	// quando il nuovo certificato è disponibile.
+	// +optional
+	LastRenewalRequest string `json:"lastRenewalRequest,omitempty"`
+
+	// CertificateRevokedAt è il momento in cui il certificato è stato inserito nella CRL
+	// perché il dispositivo è stato deattivato, sospeso, messo in quarantena o dismesso.
+	// Viene azzerato quando il dispositivo torna Approved.
+	// +optional
+	CertificateRevokedAt *metav1.Time `json:"certificateRevokedAt,omitempty"`
+
+	// ObservedGeneration è la generazione della spec elaborata per ultima dall'operatore.
+	// Se è minore di metadata.generation, l'ultima modifica alla spec non è ancora stata elaborata.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Conditions fornisce una lista di condizioni che descrivono lo stato corrente della risorsa:
+	// Ready, Approved, PairingAllowed, KeyValid, Deactivated, TransitionAllowed,
+	// oltre ad AwaitingApproval ed ExpiringSoon.
+	// Utile per una diagnostica dettagliata e per kubectl wait --for=condition=Ready.
 	// +optional
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
@@ -64,7 +220,10 @@ type DeviceRegistrationStatus struct {
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Status",type="string",JSONPath=".status.phase",description="The current status of the registration"
 // +kubebuilder:printcolumn:name="UUID",type="string",JSONPath=".status.deviceUUID",description="The UUID assigned to the device"
+// +kubebuilder:printcolumn:name="Model",type="string",JSONPath=".spec.metadata.model",description="The hardware model declared by the device"
+// +kubebuilder:printcolumn:name="Firmware",type="string",JSONPath=".spec.metadata.firmwareVersion",description="The firmware version declared by the device"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:validation:XValidation:rule="!has(oldSelf.status) || !has(oldSelf.status.device) || (has(self.spec) && self.spec == oldSelf.spec)",message="spec is immutable once the registration is linked to a Device"
 // DeviceRegistration è la risorsa Custom per una richiesta di registrazione di un dispositivo.
 type DeviceRegistration struct {
 	metav1.TypeMeta   `json:",inline"`
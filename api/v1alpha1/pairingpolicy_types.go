@@ -0,0 +1,161 @@
+/*
+Copyright 2025.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// KeyAlgorithm è un algoritmo di chiave pubblica riconosciuto dall'operatore.
+// +kubebuilder:validation:Enum=RSA;ECDSA;Ed25519
+type KeyAlgorithm string
+
+// PairingPolicySpec definisce quando e a quali condizioni i dispositivi di un namespace possono registrarsi.
+// Sostituisce il ConfigMap device-pairing-config, che resta valido solo se nel namespace non c'è alcuna PairingPolicy.
+type PairingPolicySpec struct {
+	// Enabled abilita il pairing. Se false ogni nuova richiesta viene rifiutata.
+	Enabled bool `json:"enabled"`
+
+	// Mode stabilisce se le richieste ammesse vengono approvate automaticamente (auto)
+	// o restano in attesa della decisione di un amministratore (manual).
+	// +kubebuilder:validation:Enum=auto;manual
+	// +kubebuilder:default=auto
+	// +optional
+	Mode string `json:"mode,omitempty"`
+
+	// Windows limita il pairing a uno o più intervalli di tempo.
+	// Se vuoto, il pairing resta aperto finché Enabled è true.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Windows []PairingWindow `json:"windows,omitempty"`
+
+	// AllowedKeyAlgorithms restringe gli algoritmi di chiave accettati.
+	// Se vuoto sono ammessi tutti gli algoritmi supportati dall'operatore.
+	// +listType=set
+	// +optional
+	AllowedKeyAlgorithms []KeyAlgorithm `json:"allowedKeyAlgorithms,omitempty"`
+
+	// AllowedKeyFingerprints, se non vuoto, ammette solo le chiavi elencate,
+	// indicate con lo SHA-256 esadecimale della chiave in forma DER PKIX (come in status.keyFingerprint).
+	// +listType=set
+	// +kubebuilder:validation:items:Pattern=`^[0-9a-f]{64}$`
+	// +optional
+	AllowedKeyFingerprints []string `json:"allowedKeyFingerprints,omitempty"`
+
+	// MaxEnrollments è il numero massimo di dispositivi che la policy può ammettere in totale.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxEnrollments *int32 `json:"maxEnrollments,omitempty"`
+}
+
+// PairingWindow è un intervallo di tempo in cui il pairing è aperto.
+// La fine si indica con End oppure con Duration, non con entrambi.
+// +kubebuilder:validation:XValidation:rule="has(self.end) != has(self.duration)",message="exactly one of end and duration must be set"
+type PairingWindow struct {
+	// Name identifica la finestra nello status.
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
+
+	// Start è l'apertura della finestra.
+	Start metav1.Time `json:"start"`
+
+	// End è la chiusura della finestra.
+	// +optional
+	End *metav1.Time `json:"end,omitempty"`
+
+	// Duration è la durata della finestra a partire da Start (es. 30m, 2h).
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// MaxEnrollments è il numero massimo di dispositivi ammessi in questa finestra.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxEnrollments *int32 `json:"maxEnrollments,omitempty"`
+}
+
+// PairingPolicyStatus definisce lo stato osservato di PairingPolicy.
+type PairingPolicyStatus struct {
+	// ObservedGeneration è la generazione dello spec considerata dall'operatore.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// AdmittedCount è il numero di dispositivi approvati grazie a questa policy.
+	// +optional
+	AdmittedCount int32 `json:"admittedCount,omitempty"`
+
+	// CountedRegistrations contiene gli UID delle registrazioni conteggiate più di recente, così una
+	// riconciliazione ripetuta non conteggia due volte la stessa approvazione.
+	// +kubebuilder:validation:MaxItems=100
+	// +listType=set
+	// +optional
+	CountedRegistrations []string `json:"countedRegistrations,omitempty"`
+
+	// LastAdmissionTime è il momento dell'ultima approvazione.
+	// +optional
+	LastAdmissionTime *metav1.Time `json:"lastAdmissionTime,omitempty"`
+
+	// ActiveWindow è il nome della finestra attualmente aperta, se presente.
+	// +optional
+	ActiveWindow string `json:"activeWindow,omitempty"`
+
+	// Windows riporta quanti dispositivi sono stati ammessi in ciascuna finestra.
+	// +listType=map
+	// +listMapKey=name
+	// +optional
+	Windows []PairingWindowStatus `json:"windows,omitempty"`
+
+	// Conditions descrive lo stato della policy. La condizione Active è True quando la policy ammette nuove richieste.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+}
+
+// PairingWindowStatus è il conteggio delle approvazioni in una finestra.
+type PairingWindowStatus struct {
+	Name string `json:"name"`
+	// +optional
+	Enrollments int32 `json:"enrollments,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Enabled",type="boolean",JSONPath=".spec.enabled"
+// +kubebuilder:printcolumn:name="Mode",type="string",JSONPath=".spec.mode"
+// +kubebuilder:printcolumn:name="Active",type="string",JSONPath=".status.conditions[?(@.type==\"Active\")].status"
+// +kubebuilder:printcolumn:name="Admitted",type="integer",JSONPath=".status.admittedCount"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// PairingPolicy regola il pairing dei dispositivi in un namespace.
+type PairingPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   PairingPolicySpec   `json:"spec,omitempty"`
+	Status PairingPolicyStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// PairingPolicyList contiene una lista di PairingPolicy.
+type PairingPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PairingPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PairingPolicy{}, &PairingPolicyList{})
+}
@@ -20,6 +20,7 @@ import (
 	"crypto/tls"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -58,6 +59,15 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var duplicateKeyPolicy string
+	var caSecretName string
+	var caSecretNamespace string
+	var deviceCertValidity time.Duration
+	var certRenewBefore time.Duration
+	var crlConfigMapName string
+	var crlValidity time.Duration
+	var reevaluatePairingRejections bool
+	var pendingRegistrationTTL time.Duration
 	var tlsOpts []func(*tls.Config)
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
@@ -70,6 +80,29 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&duplicateKeyPolicy, "duplicate-key-policy", string(controllers.DuplicateKeyPolicyReuse),
+		"What to do when a registration uses a public key that already belongs to a registered device: "+
+			"Reuse returns the existing DeviceUUID, Reject rejects the duplicate request.")
+	flag.StringVar(&caSecretName, "ca-secret-name", controllers.DefaultCASecretName,
+		"Name of the kubernetes.io/tls Secret holding the CA that signs device certificates. "+
+			"The CA is generated and stored in this Secret if it does not exist.")
+	flag.StringVar(&caSecretNamespace, "ca-secret-namespace", os.Getenv("POD_NAMESPACE"),
+		"Namespace of the CA Secret. Defaults to the POD_NAMESPACE environment variable.")
+	flag.DurationVar(&deviceCertValidity, "device-certificate-validity", controllers.DefaultDeviceCertificateValidity,
+		"Validity of the client certificates issued to approved devices.")
+	flag.DurationVar(&certRenewBefore, "certificate-renew-before", controllers.DefaultCertificateRenewBefore,
+		"How long before expiry a device certificate is flagged with the ExpiringSoon condition.")
+	flag.StringVar(&crlConfigMapName, "crl-configmap-name", controllers.DefaultCRLConfigMapName,
+		"Name of the ConfigMap, in the CA namespace, where the CRL of deactivated and deleted devices is published.")
+	flag.DurationVar(&crlValidity, "crl-validity", controllers.DefaultCRLValidity,
+		"Validity of each published CRL. The CRL is republished halfway through, even if nothing changed.")
+	flag.BoolVar(&reevaluatePairingRejections, "reevaluate-pairing-rejections", false,
+		"If set, registrations rejected because pairing was closed are re-evaluated when the pairing configuration "+
+			"(PairingPolicy or device-pairing-config ConfigMap) of their namespace changes.")
+	flag.DurationVar(&pendingRegistrationTTL, "pending-registration-ttl", controllers.DefaultPendingRegistrationTTL,
+		"How long a registration can stay pending before it is deleted. It should match the enrollment ticket "+
+			"validity of the gateway. Registrations awaiting administrator approval are never deleted. "+
+			"Zero keeps pending registrations forever.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -78,6 +111,16 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	keyPolicy, err := controllers.ParseDuplicateKeyPolicy(duplicateKeyPolicy)
+	if err != nil {
+		setupLog.Error(err, "invalid flag value", "flag", "duplicate-key-policy")
+		os.Exit(1)
+	}
+	if caSecretNamespace == "" {
+		caSecretNamespace = "device-operator-system"
+		setupLog.Info("POD_NAMESPACE not set, using the default CA namespace", "namespace", caSecretNamespace)
+	}
+
 	// Disabilita HTTP/2 se necessario
 	disableHTTP2 := func(c *tls.Config) {
 		setupLog.Info("disabling http/2")
@@ -113,13 +156,60 @@ func main() {
 		os.Exit(1)
 	}
 
+	deviceCA := &controllers.CertificateAuthority{
+		Client:     mgr.GetClient(),
+		Reader:     mgr.GetAPIReader(),
+		SecretName: caSecretName,
+		Namespace:  caSecretNamespace,
+		Validity:   deviceCertValidity,
+	}
+	if err := mgr.Add(deviceCA); err != nil {
+		setupLog.Error(err, "unable to set up the device certificate authority")
+		os.Exit(1)
+	}
+
+	revocationPublisher := &controllers.RevocationPublisher{
+		Client:        mgr.GetClient(),
+		Reader:        mgr.GetAPIReader(),
+		CA:            deviceCA,
+		ConfigMapName: crlConfigMapName,
+		Namespace:     caSecretNamespace,
+		Validity:      crlValidity,
+	}
+	if err := mgr.Add(revocationPublisher); err != nil {
+		setupLog.Error(err, "unable to set up the CRL publisher")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.DeviceRegistrationReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                      mgr.GetClient(),
+		Log:                         ctrl.Log.WithName("controllers").WithName("DeviceRegistration"),
+		Scheme:                      mgr.GetScheme(),
+		Recorder:                    mgr.GetEventRecorderFor("deviceregistration-controller"),
+		DuplicateKeyPolicy:          keyPolicy,
+		CA:                          deviceCA,
+		CertificateRenewBefore:      certRenewBefore,
+		Revocation:                  revocationPublisher,
+		ReevaluatePairingRejections: reevaluatePairingRejections,
+		PendingRegistrationTTL:      pendingRegistrationTTL,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "DeviceRegistration")
 		os.Exit(1)
 	}
+	if err = (&controllers.PairingWindowReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("PairingWindow"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PairingWindow")
+		os.Exit(1)
+	}
+	if err = (&controllers.PairingPolicyReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("PairingPolicy"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PairingPolicy")
+		os.Exit(1)
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+	"github.com/antonio/device-operator/internal/lifecycle"
+)
+
+const (
+	// ConditionAwaitingApproval è True mentre una richiesta attende la decisione di un amministratore.
+	ConditionAwaitingApproval = "AwaitingApproval"
+
+	// ReasonAwaitingApproval è riportato in status.reason mentre la richiesta è in attesa di approvazione.
+	ReasonAwaitingApproval = "AwaitingApproval"
+	// ReasonRejectedByAdministrator indica che un amministratore ha rifiutato la richiesta.
+	ReasonRejectedByAdministrator = "RejectedByAdministrator"
+
+	// Valori di spec.approval.decision.
+	ApprovalDecisionApproved = "Approved"
+	ApprovalDecisionRejected = "Rejected"
+)
+
+// awaitApproval lascia la registrazione in Pending con la condizione AwaitingApproval,
+// in attesa che un amministratore imposti spec.approval. reason e message spiegano nella condizione
+// perché serve una decisione manuale.
+func (r *DeviceRegistrationReconciler) awaitApproval(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, reason, message string, logger logr.Logger) (ctrl.Result, error) {
+	changed := meta.SetStatusCondition(&dr.Status.Conditions, metav1.Condition{
+		Type:               ConditionAwaitingApproval,
+		Status:             metav1.ConditionTrue,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: dr.Generation,
+	})
+	if !changed && dr.Status.Phase == PhasePending {
+		return ctrl.Result{}, nil
+	}
+
+	logger.Info("Approvazione manuale richiesta. La registrazione resta in attesa di un amministratore.", "reason", reason)
+	if _, err := r.transition(ctx, dr, lifecycle.AwaitApproval, ReasonAwaitingApproval, "Registration is waiting for administrator approval."); err != nil {
+		logger.Error(err, "Fallimento nell'aggiornare lo stato a Pending")
+		return ctrl.Result{}, err
+	}
+	r.recordEvent(dr, corev1.EventTypeNormal, EventReasonAwaitingApproval, "Registration is waiting for administrator approval: %s", message)
+	return ctrl.Result{}, nil
+}
+
+// approvalRequested indica se spec.approval è stata impostata dopo che la richiesta è stata messa in attesa
+// di approvazione. La condizione AwaitingApproval riporta la generazione valutata per ultima senza una
+// decisione valida: una decisione presente già in quella generazione, ad esempio alla creazione, non vale.
+func approvalRequested(dr *devicesv1alpha1.DeviceRegistration) bool {
+	condition := meta.FindStatusCondition(dr.Status.Conditions, ConditionAwaitingApproval)
+	return dr.Spec.Approval != nil && condition != nil && condition.Status == metav1.ConditionTrue &&
+		condition.ObservedGeneration < dr.Generation
+}
+
+// applyApprovalDecision applica la decisione presa dall'amministratore in spec.approval
+// e registra chi l'ha presa e quando.
+func (r *DeviceRegistrationReconciler) applyApprovalDecision(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
+	approval := dr.Spec.Approval
+	logger = logger.WithValues("decision", approval.Decision, "approvedBy", approval.ApprovedBy)
+
+	dr.Status.ApprovedBy = approval.ApprovedBy
+	dr.Status.ApprovalTimestamp = time.Now().Format(time.RFC3339)
+	condition := metav1.Condition{
+		Type:               ConditionAwaitingApproval,
+		Status:             metav1.ConditionFalse,
+		Reason:             approval.Decision,
+		Message:            fmt.Sprintf("Decision taken by %s.", approval.ApprovedBy),
+		ObservedGeneration: dr.Generation,
+	}
+	meta.SetStatusCondition(&dr.Status.Conditions, condition)
+
+	switch approval.Decision {
+	case ApprovalDecisionApproved:
+		logger.Info("Registrazione approvata manualmente da un amministratore.")
+		// La decisione dell'amministratore non è soggetta al limite della finestra, ma viene conteggiata.
+		pairing, err := r.resolvePairingPolicy(ctx, dr.Namespace)
+		if err != nil {
+			logger.Error(err, "Impossibile leggere la configurazione di pairing")
+			r.recordEvent(dr, corev1.EventTypeWarning, EventReasonPairingPolicyReadError, "Unable to read the pairing configuration: %v", err)
+			return ctrl.Result{}, err
+		}
+		if _, err := r.countPairingEnrollment(ctx, dr.Namespace, dr.UID, pairing, false); err != nil {
+			logger.Error(err, "Impossibile conteggiare la registrazione nella finestra di pairing")
+			return ctrl.Result{}, err
+		}
+		return r.approveRegistration(ctx, dr,
+			withApprovalReason(fmt.Sprintf("Device registration approved by %s.", approval.ApprovedBy), approval.Reason), logger)
+	case ApprovalDecisionRejected:
+		logger.Info("Registrazione rifiutata manualmente da un amministratore.")
+		return r.rejectRegistration(ctx, dr, ReasonRejectedByAdministrator,
+			withApprovalReason(fmt.Sprintf("Device registration rejected by %s.", approval.ApprovedBy), approval.Reason), logger)
+	default:
+		// Lo schema della CRD accetta solo Approved e Rejected: non dovremmo mai arrivare qui.
+		logger.Info("Decisione di approvazione non riconosciuta, ignorata.")
+		return ctrl.Result{}, nil
+	}
+}
+
+// withApprovalReason aggiunge al messaggio di stato la motivazione indicata dall'amministratore, se presente.
+func withApprovalReason(message, reason string) string {
+	if reason == "" {
+		return message
+	}
+	return fmt.Sprintf("%s Reason: %s", message, reason)
+}
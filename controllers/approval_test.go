@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// setApproval simula la decisione di un amministratore: l'API server incrementa la generazione a ogni modifica della spec.
+func setApproval(t *testing.T, ctx context.Context, r *DeviceRegistrationReconciler, dr *devicesv1alpha1.DeviceRegistration, decision string) {
+	t.Helper()
+	dr.Spec.Approval = &devicesv1alpha1.DeviceApproval{Decision: decision, ApprovedBy: "alice"}
+	dr.Generation++
+	if err := r.Update(ctx, dr); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApprovalIsIgnoredUnlessAwaitingApproval(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Chi crea la registrazione con una decisione già presa non scavalca la configurazione del pairing.
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices", Generation: 1},
+		Spec: devicesv1alpha1.DeviceRegistrationSpec{
+			PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+			Approval:  &devicesv1alpha1.DeviceApproval{Decision: ApprovalDecisionApproved, ApprovedBy: "admin"},
+		},
+	}
+	pairing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true", PairingModeKey: PairingModeManual},
+	}
+	closed := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "closed"},
+		Data:       map[string]string{PairingEnabledKey: "false"},
+	}
+	rejected := dr.DeepCopy()
+	rejected.Namespace = "closed"
+	c := lifecycleTestClient(scheme, dr, rejected, pairing, closed)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+	// A pairing chiuso la richiesta viene rifiutata.
+	closedKey := types.NamespacedName{Name: "device", Namespace: "closed"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: closedKey}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, closedKey, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseRejected || got.Status.Reason != ReasonPairingDisabled || got.Status.ApprovedBy != "" {
+		t.Fatalf("phase = %q, reason = %q, approvedBy = %q, want Rejected with reason %s",
+			got.Status.Phase, got.Status.Reason, got.Status.ApprovedBy, ReasonPairingDisabled)
+	}
+
+	// In modalità manuale la richiesta resta in attesa anche dopo essere stata messa in attesa.
+	key := types.NamespacedName{Name: "device", Namespace: "devices"}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhasePending || !meta.IsStatusConditionTrue(got.Status.Conditions, ConditionAwaitingApproval) {
+		t.Fatalf("phase = %q, conditions = %+v, want Pending and AwaitingApproval", got.Status.Phase, got.Status.Conditions)
+	}
+
+	// Una decisione presa dopo la messa in attesa viene applicata.
+	setApproval(t, ctx, r, &got, ApprovalDecisionApproved)
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseApproved || got.Status.ApprovedBy != "alice" || got.Status.DeviceUUID == "" {
+		t.Fatalf("phase = %q, approvedBy = %q, want Approved by alice with a DeviceUUID", got.Status.Phase, got.Status.ApprovedBy)
+	}
+	awaiting := meta.FindStatusCondition(got.Status.Conditions, ConditionAwaitingApproval)
+	if awaiting == nil || awaiting.Status != metav1.ConditionFalse || awaiting.Reason != ApprovalDecisionApproved {
+		t.Fatalf("AwaitingApproval = %+v, want False with reason %s", awaiting, ApprovalDecisionApproved)
+	}
+}
+
+func TestManualDecisionOnPreviouslyDeletedKey(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(publicKey)
+	keyInfo, err := parsePublicKey(encodedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "devices"},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:          PhaseApproved,
+			DeviceUUID:     "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+			KeyFingerprint: keyInfo.Fingerprint,
+		},
+	}
+
+	tests := []struct {
+		name     string
+		decision string
+		phase    string
+		reason   string
+	}{
+		{name: "approved", decision: ApprovalDecisionApproved, phase: PhaseApproved},
+		{name: "rejected", decision: ApprovalDecisionRejected, phase: PhaseRejected, reason: ReasonRejectedByAdministrator},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pairing := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+				Data:       map[string]string{PairingEnabledKey: "true"},
+			}
+			dr := &devicesv1alpha1.DeviceRegistration{
+				ObjectMeta: metav1.ObjectMeta{Name: tt.name, Namespace: "devices", Generation: 1},
+				Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: encodedKey},
+			}
+			c := lifecycleTestClient(scheme, pairing, dr)
+			r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+			if err := r.writeTombstone(ctx, deleted); err != nil {
+				t.Fatal(err)
+			}
+
+			// A pairing aperto la chiave di un dispositivo cancellato attende comunque un amministratore.
+			key := types.NamespacedName{Name: tt.name, Namespace: "devices"}
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+			var got devicesv1alpha1.DeviceRegistration
+			if err := c.Get(ctx, key, &got); err != nil {
+				t.Fatal(err)
+			}
+			awaiting := meta.FindStatusCondition(got.Status.Conditions, ConditionAwaitingApproval)
+			if got.Status.Phase != PhasePending || awaiting == nil || awaiting.Status != metav1.ConditionTrue || awaiting.Reason != ReasonKeyPreviouslyDeleted {
+				t.Fatalf("phase = %q, AwaitingApproval = %+v, want Pending with reason %s", got.Status.Phase, awaiting, ReasonKeyPreviouslyDeleted)
+			}
+
+			setApproval(t, ctx, r, &got, tt.decision)
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Get(ctx, key, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status.Phase != tt.phase || got.Status.Reason != tt.reason || got.Status.ApprovedBy != "alice" || got.Status.ApprovalTimestamp == "" {
+				t.Fatalf("phase = %q, reason = %q, approvedBy = %q, approvalTimestamp = %q, want %s by alice",
+					got.Status.Phase, got.Status.Reason, got.Status.ApprovedBy, got.Status.ApprovalTimestamp, tt.phase)
+			}
+		})
+	}
+}
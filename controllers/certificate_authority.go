@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultCASecretName è il nome predefinito del Secret che contiene la CA dell'operatore.
+	DefaultCASecretName = "device-operator-ca"
+	// DefaultDeviceCertificateValidity è la durata predefinita dei certificati emessi ai dispositivi.
+	DefaultDeviceCertificateValidity = 365 * 24 * time.Hour
+
+	// caValidity è la durata della CA generata automaticamente al primo avvio.
+	caValidity = 10 * 365 * 24 * time.Hour
+	// clockSkewAllowance anticipa NotBefore per tollerare orologi non sincronizzati sui dispositivi.
+	clockSkewAllowance = 5 * time.Minute
+)
+
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;create
+
+// CertificateAuthority gestisce la CA con cui l'operatore firma i certificati client dei dispositivi.
+// La CA viene letta dal Secret SecretName/Namespace (tipo kubernetes.io/tls) oppure,
+// se il Secret non esiste, generata e salvata al primo utilizzo.
+type CertificateAuthority struct {
+	// Client scrive il Secret quando la CA viene generata.
+	Client client.Client
+	// Reader legge il Secret direttamente dall'API server, senza avviare un informer su tutti i Secret.
+	Reader client.Reader
+
+	SecretName string
+	Namespace  string
+	// Validity è la durata dei certificati emessi ai dispositivi.
+	Validity time.Duration
+
+	mu      sync.Mutex
+	cert    *x509.Certificate
+	certPEM []byte
+	key     crypto.Signer
+}
+
+// issuedCertificate è il risultato della firma di un certificato per un dispositivo.
+type issuedCertificate struct {
+	// ChainPEM contiene il certificato del dispositivo seguito da quello della CA.
+	ChainPEM     string
+	SerialNumber string
+	NotAfter     time.Time
+}
+
+// Start carica o genera la CA all'avvio del manager, così il primo enrollment non deve attendere.
+// Implementa manager.Runnable e viene eseguito solo dal leader.
+func (ca *CertificateAuthority) Start(ctx context.Context) error {
+	if err := ca.ensure(ctx); err != nil {
+		// Non blocchiamo il manager: ensure verrà ritentato al primo certificato da emettere.
+		logf.FromContext(ctx).Error(err, "Impossibile inizializzare la CA dei dispositivi")
+	}
+	return nil
+}
+
+// ensure carica la CA in memoria, generandola se il Secret non esiste ancora.
+func (ca *CertificateAuthority) ensure(ctx context.Context) error {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.cert != nil {
+		return nil
+	}
+
+	secret := &corev1.Secret{}
+	err := ca.Reader.Get(ctx, types.NamespacedName{Name: ca.SecretName, Namespace: ca.Namespace}, secret)
+	if apierrors.IsNotFound(err) {
+		secret, err = ca.generate(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("impossibile ottenere il Secret della CA %s/%s: %w", ca.Namespace, ca.SecretName, err)
+	}
+	return ca.loadFromSecret(secret)
+}
+
+// generate crea una nuova CA autofirmata e la salva nel Secret.
+// Se un'altra replica l'ha creata nel frattempo, viene usata quella già esistente.
+func (ca *CertificateAuthority) generate(ctx context.Context) (*corev1.Secret, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "device-operator CA", Organization: []string{"device-operator"}},
+		NotBefore:             now.Add(-clockSkewAllowance),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: ca.SecretName, Namespace: ca.Namespace},
+		Type:       corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			corev1.TLSPrivateKeyKey: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		},
+	}
+	if err := ca.Client.Create(ctx, secret); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			existing := &corev1.Secret{}
+			if err := ca.Reader.Get(ctx, client.ObjectKeyFromObject(secret), existing); err != nil {
+				return nil, err
+			}
+			return existing, nil
+		}
+		return nil, err
+	}
+	logf.FromContext(ctx).Info("Generata una nuova CA per i dispositivi", "secret", client.ObjectKeyFromObject(secret))
+	return secret, nil
+}
+
+// loadFromSecret decodifica certificato e chiave privata della CA.
+func (ca *CertificateAuthority) loadFromSecret(secret *corev1.Secret) error {
+	certBlock, _ := pem.Decode(secret.Data[corev1.TLSCertKey])
+	if certBlock == nil {
+		return fmt.Errorf("il Secret %s non contiene un certificato PEM in %s", secret.Name, corev1.TLSCertKey)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return fmt.Errorf("certificato della CA non valido: %w", err)
+	}
+	if !cert.IsCA {
+		return errors.New("il certificato nel Secret della CA non è un certificato di CA")
+	}
+
+	keyBlock, _ := pem.Decode(secret.Data[corev1.TLSPrivateKeyKey])
+	if keyBlock == nil {
+		return fmt.Errorf("il Secret %s non contiene una chiave PEM in %s", secret.Name, corev1.TLSPrivateKeyKey)
+	}
+	key, err := parseCAPrivateKey(keyBlock)
+	if err != nil {
+		return err
+	}
+
+	ca.cert = cert
+	ca.certPEM = pem.EncodeToMemory(certBlock)
+	ca.key = key
+	return nil
+}
+
+// parseCAPrivateKey accetta chiavi PKCS#8, PKCS#1 ed EC, come prodotte da openssl o cert-manager.
+func parseCAPrivateKey(block *pem.Block) (crypto.Signer, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("tipo di chiave privata della CA non supportato: %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("chiave privata della CA non valida: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("chiave privata della CA di tipo %T non utilizzabile per firmare", key)
+	}
+	return signer, nil
+}
+
+// IssueDeviceCertificate firma un certificato client per la chiave pubblica del dispositivo.
+// Il DeviceUUID compare sia come Common Name sia come SAN URI (urn:uuid:<uuid>).
+func (ca *CertificateAuthority) IssueDeviceCertificate(ctx context.Context, publicKey crypto.PublicKey, deviceUUID string) (*issuedCertificate, error) {
+	if err := ca.ensure(ctx); err != nil {
+		return nil, err
+	}
+
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	validity := ca.Validity
+	if validity <= 0 {
+		validity = DefaultDeviceCertificateValidity
+	}
+	now := time.Now()
+	notAfter := now.Add(validity)
+	// Il certificato del dispositivo non può sopravvivere alla CA che lo ha firmato.
+	if notAfter.After(ca.cert.NotAfter) {
+		notAfter = ca.cert.NotAfter
+	}
+
+	keyUsage := x509.KeyUsageDigitalSignature
+	if _, isRSA := publicKey.(*rsa.PublicKey); isRSA {
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: deviceUUID, Organization: []string{"device-operator"}},
+		URIs:                  []*url.URL{{Scheme: "urn", Opaque: "uuid:" + deviceUUID}},
+		NotBefore:             now.Add(-clockSkewAllowance),
+		NotAfter:              notAfter,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, publicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile firmare il certificato del dispositivo: %w", err)
+	}
+
+	chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), ca.certPEM...)
+	return &issuedCertificate{
+		ChainPEM:     string(chain),
+		SerialNumber: formatSerialNumber(serial),
+		NotAfter:     notAfter,
+	}, nil
+}
+
+// CertificatePEM restituisce il certificato della CA in PEM, pubblicato accanto alla CRL
+// perché il gateway possa verificare i certificati presentati dai dispositivi.
+func (ca *CertificateAuthority) CertificatePEM(ctx context.Context) ([]byte, error) {
+	if err := ca.ensure(ctx); err != nil {
+		return nil, err
+	}
+	return ca.certPEM, nil
+}
+
+// SignRevocationList firma una CRL con le voci indicate, valida da thisUpdate a nextUpdate.
+func (ca *CertificateAuthority) SignRevocationList(ctx context.Context, entries []x509.RevocationListEntry, number *big.Int, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	if err := ca.ensure(ctx); err != nil {
+		return nil, err
+	}
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: entries,
+		Number:                    number,
+		ThisUpdate:                thisUpdate,
+		NextUpdate:                nextUpdate,
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile firmare la CRL: %w", err)
+	}
+	return der, nil
+}
+
+// randomSerialNumber genera un numero di serie casuale di 128 bit, come raccomandato da RFC 5280.
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// formatSerialNumber rappresenta un numero di serie in esadecimale minuscolo.
+func formatSerialNumber(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
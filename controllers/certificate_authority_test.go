@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCertificateAuthorityIssuesDeviceCertificates(t *testing.T) {
+	ctx := context.Background()
+	c := fake.NewClientBuilder().Build()
+	ca := &CertificateAuthority{Client: c, Reader: c, SecretName: "ca", Namespace: "system", Validity: time.Hour}
+
+	devicePub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := ca.IssueDeviceCertificate(ctx, devicePub, "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// La CA generata deve essere stata salvata nel Secret.
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "ca", Namespace: "system"}, secret); err != nil {
+		t.Fatalf("CA secret not created: %v", err)
+	}
+
+	leafBlock, rest := pem.Decode([]byte(issued.ChainPEM))
+	caBlock, _ := pem.Decode(rest)
+	if leafBlock == nil || caBlock == nil {
+		t.Fatal("expected a chain with the device and CA certificates")
+	}
+	leaf, err := x509.ParseCertificate(leafBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := x509.ParseCertificate(caBlock.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(caCert)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Fatalf("device certificate does not verify against the CA: %v", err)
+	}
+	if leaf.Subject.CommonName != "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a" || len(leaf.URIs) != 1 || leaf.URIs[0].String() != "urn:uuid:5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a" {
+		t.Fatalf("unexpected identity: CN=%s URIs=%v", leaf.Subject.CommonName, leaf.URIs)
+	}
+	if !devicePub.Equal(leaf.PublicKey) {
+		t.Fatal("certificate does not carry the device public key")
+	}
+	if issued.SerialNumber != formatSerialNumber(leaf.SerialNumber) {
+		t.Fatalf("serial mismatch: %s vs %x", issued.SerialNumber, leaf.SerialNumber)
+	}
+
+	// Una seconda istanza deve riusare la CA esistente invece di generarne una nuova.
+	reloaded := &CertificateAuthority{Client: c, Reader: c, SecretName: "ca", Namespace: "system"}
+	if err := reloaded.ensure(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded.cert.Equal(caCert) {
+		t.Fatal("the CA was regenerated instead of being loaded from the Secret")
+	}
+}
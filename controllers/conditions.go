@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// Condizioni standard mantenute su ogni DeviceRegistration, su cui possono basarsi
+// kubectl wait e gli strumenti GitOps.
+const (
+	// ConditionReady è True quando il dispositivo è approvato, attivo e con un certificato valido.
+	ConditionReady = "Ready"
+	// ConditionApproved è True quando la registrazione è stata approvata, anche se in seguito
+	// il dispositivo è stato deattivato, sospeso, messo in quarantena, dismesso o il suo certificato è scaduto.
+	ConditionApproved = "Approved"
+	// ConditionPairingAllowed riporta l'esito dell'ultima valutazione della configurazione di pairing.
+	ConditionPairingAllowed = "PairingAllowed"
+	// ConditionKeyValid riporta l'esito della verifica della chiave pubblica.
+	ConditionKeyValid = "KeyValid"
+	// ConditionDeactivated è True mentre il dispositivo è deattivato da un amministratore.
+	ConditionDeactivated = "Deactivated"
+
+	// Motivi delle condizioni che non hanno un equivalente in status.reason.
+	ReasonDeviceReady  = "DeviceReady"
+	ReasonKeyAccepted  = "KeyAccepted"
+	ReasonDeviceActive = "DeviceActive"
+)
+
+// updateStatus salva lo status della registrazione dopo aver allineato alla fase le condizioni
+// Ready, Approved e Deactivated e aver registrato la generazione della spec elaborata.
+func (r *DeviceRegistrationReconciler) updateStatus(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) error {
+	setPhaseConditions(dr)
+	dr.Status.ObservedGeneration = dr.Generation
+	return r.Status().Update(ctx, dr)
+}
+
+// setCondition imposta una condizione riferita alla generazione corrente della spec.
+func setCondition(dr *devicesv1alpha1.DeviceRegistration, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&dr.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: dr.Generation,
+	})
+}
+
+// setPhaseConditions deriva dalla fase e da status.reason le condizioni Ready, Approved e Deactivated.
+func setPhaseConditions(dr *devicesv1alpha1.DeviceRegistration) {
+	phase := dr.Status.Phase
+	if phase == "" {
+		phase = PhasePending
+	}
+	// Il motivo delle condizioni False è quello già scritto in status.reason, se c'è.
+	reason := dr.Status.Reason
+	if reason == "" {
+		reason = phase
+	}
+
+	switch phase {
+	case PhaseApproved:
+		setCondition(dr, ConditionReady, metav1.ConditionTrue, ReasonDeviceReady, "Device is approved and its certificate is valid.")
+	case PhaseExpired:
+		setCondition(dr, ConditionReady, metav1.ConditionFalse, ReasonCertificateExpired, dr.Status.Message)
+	default:
+		setCondition(dr, ConditionReady, metav1.ConditionFalse, reason, dr.Status.Message)
+	}
+
+	approved := false
+	switch phase {
+	case PhaseApproved, PhaseDeactivated, PhaseSuspended, PhaseExpired, PhaseQuarantined:
+		approved = true
+	case PhaseRetired:
+		// Anche una richiesta mai approvata può essere dismessa.
+		approved = dr.Status.DeviceUUID != ""
+	}
+	if approved {
+		setCondition(dr, ConditionApproved, metav1.ConditionTrue, approvalReason(dr), approvalMessage(dr))
+	} else {
+		setCondition(dr, ConditionApproved, metav1.ConditionFalse, reason, dr.Status.Message)
+	}
+
+	if phase == PhaseDeactivated {
+		setCondition(dr, ConditionDeactivated, metav1.ConditionTrue, ReasonDeactivatedByAdministrator, dr.Status.Message)
+	} else {
+		setCondition(dr, ConditionDeactivated, metav1.ConditionFalse, ReasonDeviceActive, "Device is not deactivated.")
+	}
+}
+
+// approvalReason indica come è stata approvata una registrazione: riusando un dispositivo già registrato,
+// per decisione di un amministratore o automaticamente a pairing aperto.
+func approvalReason(dr *devicesv1alpha1.DeviceRegistration) string {
+	switch {
+	case dr.Status.DuplicateOf != "":
+		return ReasonDuplicateKey
+	case dr.Spec.Approval != nil:
+		return ReasonApprovedByAdministrator
+	}
+	return ReasonPairingOpen
+}
+
+func approvalMessage(dr *devicesv1alpha1.DeviceRegistration) string {
+	switch approvalReason(dr) {
+	case ReasonDuplicateKey:
+		return fmt.Sprintf("Public key already registered by %s.", dr.Status.DuplicateOf)
+	case ReasonApprovedByAdministrator:
+		return fmt.Sprintf("Approved by %s.", dr.Spec.Approval.ApprovedBy)
+	}
+	return "Approved automatically while pairing was open."
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestReconcileMaintainsConditions(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := devicesv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		publicKey  string
+		pairing    map[string]string
+		phase      string
+		conditions map[string]metav1.ConditionStatus
+		reasons    map[string]string
+	}{
+		{
+			name:      "invalid key",
+			publicKey: "not a key",
+			phase:     PhaseRejected,
+			conditions: map[string]metav1.ConditionStatus{
+				ConditionReady: metav1.ConditionFalse, ConditionApproved: metav1.ConditionFalse,
+				ConditionKeyValid: metav1.ConditionFalse, ConditionDeactivated: metav1.ConditionFalse,
+			},
+			reasons: map[string]string{ConditionReady: ReasonInvalidPublicKey, ConditionKeyValid: ReasonInvalidPublicKey},
+		},
+		{
+			name:      "pairing closed",
+			publicKey: base64.StdEncoding.EncodeToString(publicKey),
+			phase:     PhaseRejected,
+			conditions: map[string]metav1.ConditionStatus{
+				ConditionReady: metav1.ConditionFalse, ConditionKeyValid: metav1.ConditionTrue,
+				ConditionPairingAllowed: metav1.ConditionFalse,
+			},
+			reasons: map[string]string{ConditionApproved: ReasonPairingDisabled, ConditionPairingAllowed: ReasonPairingDisabled},
+		},
+		{
+			name:      "approved while pairing is open",
+			publicKey: base64.StdEncoding.EncodeToString(publicKey),
+			pairing:   map[string]string{PairingEnabledKey: "true"},
+			phase:     PhaseApproved,
+			conditions: map[string]metav1.ConditionStatus{
+				ConditionReady: metav1.ConditionTrue, ConditionApproved: metav1.ConditionTrue,
+				ConditionKeyValid: metav1.ConditionTrue, ConditionPairingAllowed: metav1.ConditionTrue,
+				ConditionDeactivated: metav1.ConditionFalse,
+			},
+			reasons: map[string]string{ConditionApproved: ReasonPairingOpen},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dr := &devicesv1alpha1.DeviceRegistration{
+				ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices", Generation: 3},
+				Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: tt.publicKey},
+			}
+			builder := fake.NewClientBuilder().WithScheme(scheme).
+				WithObjects(dr).
+				WithStatusSubresource(&devicesv1alpha1.DeviceRegistration{}, &devicesv1alpha1.Device{}).
+				WithIndex(&devicesv1alpha1.DeviceRegistration{}, KeyFingerprintField, keyFingerprintIndexer)
+			if tt.pairing != nil {
+				builder = builder.WithObjects(&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+					Data:       tt.pairing,
+				})
+			}
+			c := builder.Build()
+			r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+			key := types.NamespacedName{Name: "device", Namespace: "devices"}
+			if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+				t.Fatal(err)
+			}
+			var got devicesv1alpha1.DeviceRegistration
+			if err := c.Get(ctx, key, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Status.Phase != tt.phase {
+				t.Fatalf("phase = %q, want %q", got.Status.Phase, tt.phase)
+			}
+			if got.Status.ObservedGeneration != got.Generation {
+				t.Fatalf("observedGeneration = %d, want %d", got.Status.ObservedGeneration, got.Generation)
+			}
+			for conditionType, status := range tt.conditions {
+				condition := meta.FindStatusCondition(got.Status.Conditions, conditionType)
+				if condition == nil || condition.Status != status {
+					t.Errorf("condition %s = %+v, want status %s", conditionType, condition, status)
+				}
+			}
+			for conditionType, reason := range tt.reasons {
+				if condition := meta.FindStatusCondition(got.Status.Conditions, conditionType); condition == nil || condition.Reason != reason {
+					t.Errorf("condition %s = %+v, want reason %s", conditionType, condition, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestSetPhaseConditionsAfterDeactivation(t *testing.T) {
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Generation: 2},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{Deactivate: true},
+		Status:     devicesv1alpha1.DeviceRegistrationStatus{Phase: PhaseDeactivated, Message: "Device has been deactivated by an administrator."},
+	}
+	setPhaseConditions(dr)
+
+	if !meta.IsStatusConditionTrue(dr.Status.Conditions, ConditionDeactivated) {
+		t.Fatal("Deactivated must be True for a deactivated device")
+	}
+	if !meta.IsStatusConditionTrue(dr.Status.Conditions, ConditionApproved) {
+		t.Fatal("a deactivated device keeps its approval")
+	}
+	ready := meta.FindStatusCondition(dr.Status.Conditions, ConditionReady)
+	if ready == nil || ready.Status != metav1.ConditionFalse || ready.ObservedGeneration != 2 {
+		t.Fatalf("Ready = %+v, want False for generation 2", ready)
+	}
+}
@@ -0,0 +1,215 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// +kubebuilder:rbac:groups=devices.example.com,resources=devices,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=devices.example.com,resources=devices/status,verbs=get;update;patch
+
+// deviceConditions sono le condizioni della registrazione di origine riportate nello status del Device.
+var deviceConditions = []string{ConditionReady, ConditionDeactivated, ConditionTransitionAllowed, ConditionExpiringSoon}
+
+// getDevice restituisce il Device della registrazione, se esiste. Il nome del Device è il DeviceUUID:
+// anche i duplicati ritrovano così il Device della registrazione originale.
+func (r *DeviceRegistrationReconciler) getDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) (*devicesv1alpha1.Device, error) {
+	if dr.Status.DeviceUUID == "" {
+		return nil, nil
+	}
+	device := &devicesv1alpha1.Device{}
+	if err := r.Get(ctx, types.NamespacedName{Name: dr.Status.DeviceUUID, Namespace: dr.Namespace}, device); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("impossibile leggere il Device %s: %w", dr.Status.DeviceUUID, err)
+	}
+	return device, nil
+}
+
+// controlsFor restituisce le richieste dell'amministratore che valgono per la registrazione:
+// quelle del Device se esiste, altrimenti quelle della spec della registrazione.
+func controlsFor(dr *devicesv1alpha1.DeviceRegistration, device *devicesv1alpha1.Device) lifecycleControls {
+	if device != nil {
+		return deviceControls(device)
+	}
+	return registrationControls(dr)
+}
+
+// reconcileDevice crea il Device di una registrazione approvata e ne mantiene lo status allineato.
+// Va chiamata quando lo status della registrazione è già stato salvato: il collegamento al Device
+// ricarica l'oggetto dal server.
+func (r *DeviceRegistrationReconciler) reconcileDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, device *devicesv1alpha1.Device, logger logr.Logger) error {
+	if dr.Status.DeviceUUID == "" {
+		return nil
+	}
+	if device == nil {
+		// Un duplicato usa il Device della registrazione originale. Se la registrazione era già collegata
+		// a un Device che non esiste più, il Device è stato cancellato e il garbage collector sta per
+		// cancellare anche la registrazione: non va ricreato.
+		if dr.Status.DuplicateOf != "" || dr.Status.Device != "" {
+			return nil
+		}
+		created, err := r.createDevice(ctx, dr)
+		if err != nil {
+			logger.Error(err, "Impossibile creare il Device")
+			return err
+		}
+		device = created
+		logger.Info("Device creato", "device", device.Name)
+		r.recordEvent(dr, corev1.EventTypeNormal, EventReasonDeviceCreated,
+			"Device %s created; lifecycle requests are now read from its spec.", device.Name)
+	}
+
+	origin := device.Spec.RegistrationRef == dr.Name
+	if origin {
+		// Cancellare il Device cancella anche la registrazione di origine, il cui finalizer ripulisce il dispositivo.
+		if err := r.ensureDeviceOwner(ctx, dr, device); err != nil {
+			logger.Error(err, "Impossibile collegare la registrazione al suo Device")
+			return err
+		}
+	}
+	if dr.Status.Device != device.Name {
+		dr.Status.Device = device.Name
+		if err := r.updateStatus(ctx, dr); err != nil {
+			logger.Error(err, "Fallimento nell'aggiornare status.device")
+			return err
+		}
+	}
+	if !origin {
+		return nil
+	}
+	// I metadati del Device possono essere aggiornati, ad esempio dopo un aggiornamento del firmware.
+	if err := r.ensureMetadataLabels(ctx, device, device.Spec.Metadata); err != nil {
+		logger.Error(err, "Impossibile impostare le label con i metadati del Device")
+		return err
+	}
+	if err := r.syncDeviceStatus(ctx, dr, device); err != nil {
+		logger.Error(err, "Fallimento nell'aggiornare lo status del Device")
+		return err
+	}
+	return nil
+}
+
+// createDevice crea il Device di una registrazione approvata, con i suoi metadati e le relative label.
+// Le richieste sul ciclo di vita già presenti nella spec della registrazione vengono copiate:
+// per le registrazioni approvate prima dell'introduzione dei Device lo stato del dispositivo non cambia.
+func (r *DeviceRegistrationReconciler) createDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) (*devicesv1alpha1.Device, error) {
+	labels := metadataLabels(dr.Spec.Metadata)
+	labels[DeviceUUIDLabel] = dr.Status.DeviceUUID
+	if dr.Status.KeyFingerprint != "" {
+		labels[KeyFingerprintLabel] = keyFingerprintLabelValue(dr.Status.KeyFingerprint)
+	}
+	device := &devicesv1alpha1.Device{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      dr.Status.DeviceUUID,
+			Namespace: dr.Namespace,
+			Labels:    labels,
+		},
+		Spec: devicesv1alpha1.DeviceSpec{
+			PublicKey:       dr.Spec.PublicKey,
+			RegistrationRef: dr.Name,
+			Metadata:        dr.Spec.Metadata.DeepCopy(),
+			Deactivate:      dr.Spec.Deactivate,
+			SuspendUntil:    dr.Spec.SuspendUntil,
+			Quarantine:      dr.Spec.Quarantine,
+			Retire:          dr.Spec.Retire,
+		},
+	}
+	if err := r.Create(ctx, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// ensureDeviceOwner aggiunge alla registrazione un ownerReference verso il suo Device.
+// Come ensureLabel, la patch ricarica l'oggetto dal server.
+func (r *DeviceRegistrationReconciler) ensureDeviceOwner(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, device *devicesv1alpha1.Device) error {
+	for _, ref := range dr.OwnerReferences {
+		if ref.Kind == "Device" && ref.Name == device.Name && ref.UID == device.UID {
+			return nil
+		}
+	}
+	patch := client.MergeFrom(dr.DeepCopy())
+	if err := controllerutil.SetOwnerReference(device, dr, r.Scheme); err != nil {
+		return err
+	}
+	return r.Patch(ctx, dr, patch)
+}
+
+// syncDeviceStatus copia nello status del Device lo stato della registrazione di origine.
+// Il Device viene aggiornato solo se qualcosa è cambiato.
+func (r *DeviceRegistrationReconciler) syncDeviceStatus(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, device *devicesv1alpha1.Device) error {
+	status := devicesv1alpha1.DeviceStatus{
+		Phase:                   dr.Status.Phase,
+		Message:                 dr.Status.Message,
+		KeyAlgorithm:            dr.Status.KeyAlgorithm,
+		KeyFingerprint:          dr.Status.KeyFingerprint,
+		RegistrationTimestamp:   dr.Status.RegistrationTimestamp,
+		CertificateSerialNumber: dr.Status.CertificateSerialNumber,
+		CertificateNotAfter:     dr.Status.CertificateNotAfter,
+		CertificateRevokedAt:    dr.Status.CertificateRevokedAt,
+		ObservedGeneration:      device.Generation,
+		Conditions:              append([]metav1.Condition(nil), device.Status.Conditions...),
+	}
+	for _, conditionType := range deviceConditions {
+		condition := meta.FindStatusCondition(dr.Status.Conditions, conditionType)
+		if condition == nil {
+			meta.RemoveStatusCondition(&status.Conditions, conditionType)
+			continue
+		}
+		// La condizione si riferisce alla generazione del Device, le cui richieste sono appena state elaborate.
+		copied := *condition
+		copied.ObservedGeneration = device.Generation
+		meta.SetStatusCondition(&status.Conditions, copied)
+	}
+	if equality.Semantic.DeepEqual(device.Status, status) {
+		return nil
+	}
+	device.Status = status
+	return r.Status().Update(ctx, device)
+}
+
+// deleteDevice cancella il Device quando viene cancellata la sua registrazione di origine.
+func (r *DeviceRegistrationReconciler) deleteDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) error {
+	device, err := r.getDevice(ctx, dr)
+	if err != nil || device == nil || device.Spec.RegistrationRef != dr.Name || !device.DeletionTimestamp.IsZero() {
+		return err
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, device))
+}
+
+// registrationsForDevice mappa un Device alla sua registrazione di origine e ai suoi duplicati,
+// che leggono dal Device le richieste sul ciclo di vita.
+func (r *DeviceRegistrationReconciler) registrationsForDevice(ctx context.Context, obj client.Object) []reconcile.Request {
+	device, ok := obj.(*devicesv1alpha1.Device)
+	if !ok {
+		return nil
+	}
+	var list devicesv1alpha1.DeviceRegistrationList
+	if err := r.List(ctx, &list, client.InNamespace(device.Namespace)); err != nil {
+		r.Log.Error(err, "Impossibile elencare le registrazioni del Device", "device", device.Name)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, dr := range list.Items {
+		if dr.Name == device.Spec.RegistrationRef || dr.Status.Device == device.Name {
+			requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: dr.Name, Namespace: dr.Namespace}})
+		}
+	}
+	return requests
+}
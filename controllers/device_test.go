@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestApprovalCreatesDeviceThatOwnsLifecycle(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices"},
+		Spec: devicesv1alpha1.DeviceRegistrationSpec{
+			PublicKey: base64.StdEncoding.EncodeToString(publicKey),
+			Metadata:  &devicesv1alpha1.DeviceMetadata{Model: "th-sensor-v2", FirmwareVersion: "1.4.2"},
+		},
+	}
+	pairing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true"},
+	}
+	c := lifecycleTestClient(scheme, dr, pairing)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+	key := types.NamespacedName{Name: "device", Namespace: "devices"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseApproved || got.Status.Device != got.Status.DeviceUUID {
+		t.Fatalf("phase = %q, status.device = %q, want Approved and linked to Device %s", got.Status.Phase, got.Status.Device, got.Status.DeviceUUID)
+	}
+
+	deviceKey := types.NamespacedName{Name: got.Status.DeviceUUID, Namespace: "devices"}
+	var device devicesv1alpha1.Device
+	if err := c.Get(ctx, deviceKey, &device); err != nil {
+		t.Fatal(err)
+	}
+	if device.Spec.PublicKey != dr.Spec.PublicKey || device.Spec.RegistrationRef != "device" {
+		t.Fatalf("device spec = %+v, want the approved key and registrationRef device", device.Spec)
+	}
+	if device.Spec.Metadata == nil || device.Spec.Metadata.Model != "th-sensor-v2" || device.Labels[ModelLabel] != "th-sensor-v2" {
+		t.Fatalf("device metadata = %+v, labels = %v, want the metadata of the registration", device.Spec.Metadata, device.Labels)
+	}
+	if got.Labels[FirmwareVersionLabel] != "1.4.2" {
+		t.Fatalf("registration labels = %v, want %s", got.Labels, FirmwareVersionLabel)
+	}
+	if device.Status.Phase != PhaseApproved || device.Status.KeyFingerprint != got.Status.KeyFingerprint {
+		t.Fatalf("device status = %+v, want the status of the registration", device.Status)
+	}
+	if !meta.IsStatusConditionTrue(device.Status.Conditions, ConditionReady) {
+		t.Fatalf("device conditions = %+v, want Ready", device.Status.Conditions)
+	}
+	if len(got.OwnerReferences) != 1 || got.OwnerReferences[0].Kind != "Device" || got.OwnerReferences[0].Name != device.Name {
+		t.Fatalf("ownerReferences = %+v, want the Device", got.OwnerReferences)
+	}
+
+	// La deattivazione si chiede sul Device, che può anche aggiornare i propri metadati.
+	device.Spec.Deactivate = true
+	device.Spec.Metadata.FirmwareVersion = "1.5.0"
+	if err := c.Update(ctx, &device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseDeactivated {
+		t.Fatalf("registration phase = %q, want %q", got.Status.Phase, PhaseDeactivated)
+	}
+	if err := c.Get(ctx, deviceKey, &device); err != nil {
+		t.Fatal(err)
+	}
+	if device.Status.Phase != PhaseDeactivated || device.Status.ObservedGeneration != device.Generation {
+		t.Fatalf("device phase = %q, observedGeneration = %d, want Deactivated at generation %d",
+			device.Status.Phase, device.Status.ObservedGeneration, device.Generation)
+	}
+	if device.Labels[FirmwareVersionLabel] != "1.5.0" {
+		t.Fatalf("device labels = %v, want %s=1.5.0", device.Labels, FirmwareVersionLabel)
+	}
+
+	// Cancellando la registrazione di origine sparisce anche il Device.
+	if err := c.Delete(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, deviceKey, &devicesv1alpha1.Device{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("Device still exists after its registration was deleted: %v", err)
+	}
+}
@@ -3,28 +3,44 @@ package controllers
 
 import (
 	"context"
+	"crypto"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/google/uuid"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1" // Aggiorna con il tuo path corretto
+	"github.com/antonio/device-operator/internal/lifecycle"
 )
 
 const (
 	// Definiamo delle costanti per le fasi e il nome del ConfigMap per evitare errori di battitura.
-	PhasePending     = "Pending"
-	PhaseApproved    = "Approved"
-	PhaseRejected    = "Rejected"
-	PhaseDeactivated = "Deactivated"
+	PhasePending         = "Pending"
+	PhaseApproved        = "Approved"
+	PhaseRejected        = "Rejected"
+	PhaseDeactivated     = "Deactivated"
+	PhaseSuspended       = "Suspended"
+	PhaseExpired         = "Expired"
+	PhaseQuarantined     = "Quarantined"
+	PhaseRetired         = "Retired"
 	PairingConfigMapName = "device-pairing-config"
+
+	// Codici riportati in status.reason quando una registrazione viene rifiutata.
+	ReasonInvalidPublicKey = "InvalidPublicKey"
+	ReasonWeakPublicKey    = "WeakPublicKey"
+	ReasonPairingDisabled  = "PairingDisabled"
 )
 
 // DeviceRegistrationReconciler riconcilia un oggetto DeviceRegistration
@@ -32,12 +48,42 @@ type DeviceRegistrationReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// Recorder emette gli eventi Kubernetes sulle transizioni delle registrazioni.
+	// Se nil gli eventi non vengono emessi.
+	Recorder record.EventRecorder
+
+	// DuplicateKeyPolicy decide cosa fare con una richiesta la cui chiave è già registrata.
+	// Se vuoto viene usato DuplicateKeyPolicyReuse.
+	DuplicateKeyPolicy DuplicateKeyPolicy
+
+	// CA firma i certificati client dei dispositivi approvati. Se nil non viene emesso alcun certificato.
+	CA *CertificateAuthority
+
+	// CertificateRenewBefore è l'anticipo sulla scadenza con cui viene impostata la condizione ExpiringSoon.
+	// Se zero viene usato DefaultCertificateRenewBefore.
+	CertificateRenewBefore time.Duration
+
+	// Revocation pubblica la CRL con i certificati dei dispositivi deattivati o cancellati.
+	// Se nil i certificati non vengono revocati.
+	Revocation *RevocationPublisher
+
+	// ReevaluatePairingRejections rimette in valutazione le richieste rifiutate con PairingDisabled
+	// quando la configurazione di pairing del loro namespace cambia.
+	ReevaluatePairingRejections bool
+
+	// PendingRegistrationTTL è il tempo dopo il quale una richiesta ancora in attesa viene cancellata.
+	// Se zero le richieste in attesa non vengono mai cancellate.
+	PendingRegistrationTTL time.Duration
 }
 
 // +kubebuilder:rbac:groups=devices.example.com,resources=deviceregistrations,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=devices.example.com,resources=deviceregistrations/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=devices.example.com,resources=deviceregistrations/finalizers,verbs=update
+// +kubebuilder:rbac:groups=devices.example.com,resources=pairingpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=devices.example.com,resources=pairingpolicies/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;watch;list
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 // ^^^ Abbiamo bisogno dei permessi per leggere i ConfigMap!
 
 func (r *DeviceRegistrationReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
@@ -48,124 +94,367 @@ func (r *DeviceRegistrationReconciler) Reconcile(ctx context.Context, req ctrl.R
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	// === Gestione del ciclo di vita principale ===
+	// Un dispositivo cancellato revoca il proprio certificato e lascia una lapide prima di sparire.
+	if !dr.DeletionTimestamp.IsZero() {
+		return r.finalizeRegistration(ctx, &dr, logger)
+	}
+	// Una richiesta rimasta in attesa oltre il TTL del ticket di enrollment non verrà più ritirata dal dispositivo.
+	if remaining, expires := r.pendingExpiry(&dr, time.Now()); expires && remaining <= 0 {
+		return ctrl.Result{}, r.deleteStalePendingRegistration(ctx, &dr, logger)
+	}
+	if err := r.ensureCleanupFinalizer(ctx, &dr); err != nil {
+		logger.Error(err, "Impossibile aggiungere il finalizer di pulizia")
+		return ctrl.Result{}, err
+	}
+	// I metadati dichiarati dal dispositivo diventano label, per selezionare le registrazioni con kubectl get -l.
+	if err := r.ensureMetadataLabels(ctx, &dr, dr.Spec.Metadata); err != nil {
+		logger.Error(err, "Impossibile impostare le label con i metadati del dispositivo")
+		return ctrl.Result{}, err
+	}
 
-	// 1. Gestione deattivazione
-	if dr.Spec.Deactivate && dr.Status.Phase == PhaseApproved {
-		return r.deactivateDevice(ctx, &dr, logger)
+	// Le richieste sul ciclo di vita di un dispositivo registrato si leggono dal suo Device.
+	device, err := r.getDevice(ctx, &dr)
+	if err != nil {
+		logger.Error(err, "Impossibile leggere il Device della registrazione")
+		return ctrl.Result{}, err
 	}
 
-	// 2. Gestione riattivazione
-	if !dr.Spec.Deactivate && dr.Status.Phase == PhaseDeactivated {
-		return r.reactivateDevice(ctx, &dr, logger)
+	result, err := r.reconcileLifecycle(ctx, &dr, controlsFor(&dr, device), logger)
+	if err != nil {
+		return result, err
 	}
+	// Anche quando la spec modificata non provoca alcuna transizione, registriamo di averla elaborata.
+	if dr.Status.ObservedGeneration != dr.Generation {
+		if err := r.updateStatus(ctx, &dr); err != nil {
+			logger.Error(err, "Fallimento nell'aggiornare observedGeneration")
+			return ctrl.Result{}, err
+		}
+	}
+	// Un dispositivo approvato ottiene il suo Device, che riporta lo stato della registrazione.
+	if err := r.reconcileDevice(ctx, &dr, device, logger); err != nil {
+		return ctrl.Result{}, err
+	}
+	return r.requeueBeforePendingExpiry(&dr, result), nil
+}
 
-	// 3. Se la registrazione è già in uno stato terminale (Approved, Rejected), non fare nulla.
-	if dr.Status.Phase == PhaseApproved || dr.Status.Phase == PhaseRejected {
+// reconcileLifecycle applica alla registrazione la transizione richiesta dalla sua fase e dalle richieste
+// dell'amministratore. Le transizioni ammesse sono quelle della macchina a stati del pacchetto lifecycle.
+func (r *DeviceRegistrationReconciler) reconcileLifecycle(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, controls lifecycleControls, logger logr.Logger) (ctrl.Result, error) {
+	state, err := lifecycle.ParseState(dr.Status.Phase)
+	if err != nil {
+		// Una fase sconosciuta non può che essere stata scritta a mano: non sappiamo quali transizioni ammettere.
+		logger.Error(err, "Fase della registrazione non riconosciuta, nessuna transizione applicata")
 		return ctrl.Result{}, nil
 	}
 
-	// 4. Gestione della registrazione iniziale (lo stato è vuoto o Pending)
-	return r.handleInitialRegistration(ctx, &dr, logger)
+	// 1. Le transizioni chieste da un amministratore nella spec del Device o della registrazione
+	// (dismissione, quarantena, deattivazione, sospensione e i loro inversi) hanno la precedenza
+	// sul workflow della fase.
+	if event, requested := requestedTransition(controls, state, time.Now()); requested {
+		result, applied, err := r.applyRequestedTransition(ctx, dr, controls, state, event, logger)
+		if applied || err != nil {
+			return result, err
+		}
+		// Transizione non ammessa: la condizione TransitionAllowed lo segnala e la registrazione
+		// prosegue nella sua fase, ad esempio una richiesta Pending resta in valutazione.
+	} else if meta.RemoveStatusCondition(&dr.Status.Conditions, ConditionTransitionAllowed) {
+		if err := r.updateStatus(ctx, dr); err != nil {
+			logger.Error(err, "Fallimento nel rimuovere la condizione TransitionAllowed")
+			return ctrl.Result{}, err
+		}
+	}
+
+	switch state {
+	case lifecycle.Approved:
+		// 2. Un dispositivo approvato resta sotto osservazione per il rinnovo e la scadenza del certificato.
+		return r.reconcileApprovedDevice(ctx, dr, logger)
+	case lifecycle.Rejected:
+		// 3. Una richiesta rifiutata perché il pairing era chiuso può essere rivalutata, se richiesto.
+		if r.dependsOnPairing(dr) {
+			return r.handleInitialRegistration(ctx, dr, logger)
+		}
+	case lifecycle.Suspended:
+		// 4. La sospensione termina da sola: riconciliamo di nuovo quando scade.
+		if controls.SuspendUntil != nil {
+			return ctrl.Result{RequeueAfter: time.Until(controls.SuspendUntil.Time)}, nil
+		}
+	case lifecycle.Pending:
+		// 5. Gestione della registrazione iniziale (lo stato è vuoto o Pending)
+		return r.handleInitialRegistration(ctx, dr, logger)
+	}
+	// 6. Le altre fasi (Deactivated, Expired, Quarantined, Retired) cambiano solo su richiesta dell'amministratore.
+	return ctrl.Result{}, nil
 }
 
 // handleInitialRegistration gestisce il workflow di una nuova richiesta di registrazione.
 func (r *DeviceRegistrationReconciler) handleInitialRegistration(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
-	// Controlliamo se la modalità di pairing è attiva leggendo il ConfigMap.
-	isPairingEnabled, err := r.isPairingModeEnabled(ctx, dr.Namespace)
+	// Prima di tutto verifichiamo che la chiave pubblica sia una chiave reale e sufficientemente robusta.
+	keyInfo, err := parsePublicKey(dr.Spec.PublicKey)
+	if err != nil {
+		reason := publicKeyRejectionReason(err)
+		logger.Info("Chiave pubblica non valida. Rifiuto della registrazione.", "reason", reason, "error", err.Error())
+		setCondition(dr, ConditionKeyValid, metav1.ConditionFalse, reason, fmt.Sprintf("Public key rejected: %v.", err))
+		return r.rejectRegistration(ctx, dr, reason, fmt.Sprintf("Public key rejected: %v.", err), logger)
+	}
+
+	// Etichettiamo la risorsa con l'impronta della chiave prima di modificarne lo status,
+	// perché la patch dei metadati ricarica l'oggetto dal server.
+	if err := r.ensureLabel(ctx, dr, KeyFingerprintLabel, keyFingerprintLabelValue(keyInfo.Fingerprint)); err != nil {
+		logger.Error(err, "Impossibile impostare la label con l'impronta della chiave")
+		return ctrl.Result{}, err
+	}
+	dr.Status.KeyAlgorithm = keyInfo.Algorithm
+	dr.Status.KeySize = keyInfo.Size
+	dr.Status.KeyFingerprint = keyInfo.Fingerprint
+	setCondition(dr, ConditionKeyValid, metav1.ConditionTrue, ReasonKeyAccepted,
+		fmt.Sprintf("%s public key accepted.", keyInfo.Algorithm))
+
+	// Se la stessa chiave ha già un dispositivo registrato, applichiamo la politica sui duplicati.
+	// Il controllo precede quello sul pairing: un dispositivo già approvato che ripete l'enrollment
+	// deve poter recuperare il proprio UUID anche a pairing chiuso.
+	existing, err := r.findRegisteredDevice(ctx, dr, keyInfo.Fingerprint)
+	if err != nil {
+		logger.Error(err, "Impossibile verificare la presenza di registrazioni duplicate")
+		return ctrl.Result{}, err
+	}
+	if existing != nil && existing.Status.DeviceUUID == "" {
+		return r.awaitOriginalRegistration(ctx, dr, existing, logger)
+	}
+	if existing != nil {
+		return r.handleDuplicateRegistration(ctx, dr, existing, logger)
+	}
+
+	// Una decisione dell'amministratore ha la precedenza sulla configurazione del pairing, ma vale solo
+	// per una richiesta che l'operatore ha messo in attesa di approvazione: impostata alla creazione
+	// scavalcherebbe finestra di pairing, limiti, PairingPolicy e lapidi.
+	// Una richiesta già in attesa resta in attesa anche se il pairing viene chiuso.
+	awaitingApproval := meta.IsStatusConditionTrue(dr.Status.Conditions, ConditionAwaitingApproval)
+	if dr.Spec.Approval != nil {
+		if approvalRequested(dr) {
+			return r.applyApprovalDecision(ctx, dr, logger)
+		}
+		logger.Info("spec.approval ignorata: la registrazione non era in attesa di approvazione quando è stata impostata.")
+	}
+
+	// La chiave di un dispositivo cancellato non viene riusata in silenzio: la richiesta attende
+	// la decisione di un amministratore qualunque sia la modalità di pairing.
+	tombstone, err := r.findTombstone(ctx, dr.Namespace, keyInfo.Fingerprint)
+	if err != nil {
+		logger.Error(err, "Impossibile verificare le lapidi dei dispositivi cancellati")
+		return ctrl.Result{}, err
+	}
+	if tombstone != nil {
+		return r.awaitApproval(ctx, dr, ReasonKeyPreviouslyDeleted,
+			fmt.Sprintf("Public key belonged to device %s (registration %s), deleted at %s. An administrator must set spec.approval.",
+				tombstone.DeviceUUID, tombstone.Name, tombstone.DeletedAt.Format(time.RFC3339)), logger)
+	}
+
+	// Leggiamo la configurazione del pairing dalla PairingPolicy del namespace o, in sua assenza, dal ConfigMap.
+	pairing, err := r.resolvePairingPolicy(ctx, dr.Namespace)
 	if err != nil {
 		logger.Error(err, "Impossibile verificare lo stato della modalità di pairing")
+		r.recordEvent(dr, corev1.EventTypeWarning, EventReasonPairingPolicyReadError, "Unable to read the pairing configuration: %v", err)
 		// Se non possiamo leggere il ConfigMap, riproviamo più tardi.
 		return ctrl.Result{RequeueAfter: 15 * time.Second}, err
 	}
 
-	if !isPairingEnabled {
-		logger.Info("Modalità di pairing non attiva. Rifiuto della registrazione.")
-		dr.Status.Phase = PhaseRejected
-		dr.Status.Message = "Pairing mode is not enabled. The request is rejected."
-		if err := r.Status().Update(ctx, dr); err != nil {
-			logger.Error(err, "Fallimento nell'aggiornare lo stato a Rejected")
-			return ctrl.Result{}, err
+	// La condizione PairingAllowed riporta l'esito della valutazione anche per le richieste già
+	// in attesa di approvazione, che non vengono rifiutate.
+	now := time.Now()
+	admitted, why := pairing.admits(now)
+	if !admitted {
+		setCondition(dr, ConditionPairingAllowed, metav1.ConditionFalse, ReasonPairingDisabled, why)
+		if !awaitingApproval {
+			logger.Info("Modalità di pairing non attiva. Rifiuto della registrazione.", "detail", why)
+			result, err := r.rejectRegistration(ctx, dr, ReasonPairingDisabled, why+" The request is rejected.", logger)
+			// L'apertura di una finestra programmata non modifica il ConfigMap e quindi non genera eventi:
+			// una richiesta da rivalutare viene riconciliata di nuovo quando la finestra si apre.
+			if err == nil && r.dependsOnPairing(dr) && pairing.NotBefore != nil && now.Before(*pairing.NotBefore) {
+				result.RequeueAfter = pairing.NotBefore.Sub(now)
+			}
+			return result, err
 		}
-		return ctrl.Result{}, nil
+	} else if allowed, why := pairing.admitsKey(keyInfo); !allowed {
+		setCondition(dr, ConditionPairingAllowed, metav1.ConditionFalse, ReasonKeyNotAllowed, why)
+		if !awaitingApproval {
+			logger.Info("Chiave non ammessa dalla PairingPolicy. Rifiuto della registrazione.", "pairingPolicy", pairing.Policy, "detail", why)
+			return r.rejectRegistration(ctx, dr, ReasonKeyNotAllowed, why+" The request is rejected.", logger)
+		}
+	} else {
+		setCondition(dr, ConditionPairingAllowed, metav1.ConditionTrue, ReasonPairingOpen,
+			fmt.Sprintf("Pairing is open in %s mode.", pairing.Mode))
 	}
 
-	// La modalità di pairing è attiva, procediamo con l'approvazione.
+	if pairing.Mode == PairingModeManual || awaitingApproval {
+		return r.awaitApproval(ctx, dr, ReasonAwaitingApproval, "Waiting for an administrator to set spec.approval.", logger)
+	}
+
+	// La modalità di pairing è attiva: occupiamo un posto nella finestra prima di approvare,
+	// così il limite di maxEnrollments vale anche per richieste arrivate insieme.
+	admitted, err = r.countPairingEnrollment(ctx, dr.Namespace, dr.UID, pairing, true)
+	if err != nil {
+		logger.Error(err, "Impossibile conteggiare la registrazione nella finestra di pairing")
+		return ctrl.Result{}, err
+	}
+	if !admitted {
+		logger.Info("Finestra di pairing esaurita. Rifiuto della registrazione.")
+		setCondition(dr, ConditionPairingAllowed, metav1.ConditionFalse, ReasonPairingDisabled,
+			"Pairing window closed: the maximum number of enrollments has been reached.")
+		return r.rejectRegistration(ctx, dr, ReasonPairingDisabled,
+			"Pairing window closed: the maximum number of enrollments has been reached. The request is rejected.", logger)
+	}
 	logger.Info("Modalità di pairing attiva. Approvazione della registrazione in corso.")
+	return r.approveRegistration(ctx, dr, "Device registered successfully.", logger)
+}
 
+// approveRegistration assegna il DeviceUUID e porta la registrazione nella fase Approved:
+// il certificato viene emesso come effetto della transizione.
+func (r *DeviceRegistrationReconciler) approveRegistration(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, message string, logger logr.Logger) (ctrl.Result, error) {
 	// Genera un UUID univoco per il dispositivo.
 	dr.Status.DeviceUUID = uuid.New().String()
-	dr.Status.Phase = PhaseApproved
-	dr.Status.Message = "Device registered successfully."
 	dr.Status.RegistrationTimestamp = time.Now().Format(time.RFC3339)
 
-	if err := r.Status().Update(ctx, dr); err != nil {
-		logger.Error(err, "Fallimento nell'aggiornare lo stato a Approved")
+	previousPhase, err := r.transition(ctx, dr, lifecycle.Approve, "", message)
+	if err != nil {
+		logger.Error(err, "Fallimento nell'approvare la registrazione")
 		return ctrl.Result{}, err
 	}
+	recordDecision(dr, previousPhase, DecisionApproved, approvalReason(dr))
+	r.recordEvent(dr, corev1.EventTypeNormal, EventReasonApproved, "%s DeviceUUID: %s.", dr.Status.Message, dr.Status.DeviceUUID)
 
 	logger.Info("Registrazione approvata con successo", "DeviceUUID", dr.Status.DeviceUUID)
+
+	// Etichettiamo la registrazione con il DeviceUUID, così il gateway può ritrovarla al momento del rinnovo.
+	if err := r.ensureLabel(ctx, dr, DeviceUUIDLabel, dr.Status.DeviceUUID); err != nil {
+		logger.Error(err, "Impossibile impostare la label con il DeviceUUID")
+		return ctrl.Result{}, err
+	}
 	return ctrl.Result{}, nil
 }
 
-// isPairingModeEnabled controlla il ConfigMap per vedere se il pairing è abilitato.
-func (r *DeviceRegistrationReconciler) isPairingModeEnabled(ctx context.Context, namespace string) (bool, error) {
-	pairingConfig := &corev1.ConfigMap{}
-	err := r.Get(ctx, types.NamespacedName{Name: PairingConfigMapName, Namespace: namespace}, pairingConfig)
+// handleDuplicateRegistration applica la DuplicateKeyPolicy a una richiesta la cui chiave
+// appartiene già al dispositivo registrato da existing.
+func (r *DeviceRegistrationReconciler) handleDuplicateRegistration(ctx context.Context, dr, existing *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
+	logger = logger.WithValues("existingRegistration", existing.Name, "DeviceUUID", existing.Status.DeviceUUID)
 
-	if err != nil {
-		// Se il ConfigMap non esiste, consideriamo il pairing disabilitato per sicurezza.
-		if apierrors.IsNotFound(err) {
-			r.Log.Info("ConfigMap di pairing non trovato, si presume disabilitato", "configMap", PairingConfigMapName)
-			return false, nil
-		}
-		// Per altri errori, restituiamo l'errore.
-		return false, fmt.Errorf("impossibile ottenere il ConfigMap di pairing: %w", err)
+	// Un dispositivo deattivato, sospeso, in quarantena o dismesso non può tornare attivo registrandosi di nuovo.
+	if existing.Status.Phase != PhaseApproved {
+		logger.Info("La chiave appartiene a un dispositivo non attivo. Rifiuto della registrazione.", "existingPhase", existing.Status.Phase)
+		return r.rejectRegistration(ctx, dr, ReasonDuplicateKey,
+			fmt.Sprintf("Public key belongs to %s device registration %s.", strings.ToLower(existing.Status.Phase), existing.Name), logger)
 	}
 
-	enabled, ok := pairingConfig.Data["enabled"]
-	if !ok {
-		// Se la chiave 'enabled' non è presente, consideriamo disabilitato.
-		r.Log.Info("Chiave 'enabled' non trovata nel ConfigMap, si presume disabilitato", "configMap", PairingConfigMapName)
-		return false, nil
+	if r.DuplicateKeyPolicy == DuplicateKeyPolicyReject {
+		logger.Info("Chiave già registrata. Rifiuto della registrazione duplicata.")
+		return r.rejectRegistration(ctx, dr, ReasonDuplicateKey,
+			fmt.Sprintf("Public key is already registered by %s.", existing.Name), logger)
 	}
 
-	return enabled == "true", nil
+	logger.Info("Chiave già registrata. Riuso del DeviceUUID esistente.")
+	dr.Status.DeviceUUID = existing.Status.DeviceUUID
+	dr.Status.DuplicateOf = existing.Name
+	dr.Status.Certificate = existing.Status.Certificate
+	dr.Status.CertificateSerialNumber = existing.Status.CertificateSerialNumber
+	dr.Status.CertificateNotAfter = existing.Status.CertificateNotAfter
+	dr.Status.RegistrationTimestamp = existing.Status.RegistrationTimestamp
+	previousPhase, err := r.transition(ctx, dr, lifecycle.Adopt, "",
+		fmt.Sprintf("Device already registered by %s; the existing DeviceUUID is returned.", existing.Name))
+	if err != nil {
+		logger.Error(err, "Fallimento nell'aggiornare lo stato della registrazione duplicata")
+		return ctrl.Result{}, err
+	}
+	recordDecision(dr, previousPhase, DecisionApproved, approvalReason(dr))
+	r.recordEvent(dr, corev1.EventTypeNormal, EventReasonApproved, "%s DeviceUUID: %s.", dr.Status.Message, dr.Status.DeviceUUID)
+	return ctrl.Result{}, nil
 }
 
-// deactivateDevice gestisce la logica per deattivare un dispositivo.
-func (r *DeviceRegistrationReconciler) deactivateDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
-	logger.Info("Deattivazione del dispositivo in corso...")
-	dr.Status.Phase = PhaseDeactivated
-	dr.Status.Message = "Device has been deactivated by an administrator."
-	// Manteniamo il timestamp di registrazione originale.
-	if err := r.Status().Update(ctx, dr); err != nil {
-		logger.Error(err, "Fallimento nell'aggiornare lo stato a Deactivated")
+// awaitOriginalRegistration lascia in attesa una richiesta la cui chiave è già in valutazione nella
+// richiesta first, creata prima. Quando first viene approvata la richiesta ne adotta il DeviceUUID secondo
+// la DuplicateKeyPolicy; se first viene rifiutata o cancellata, la richiesta viene valutata per conto suo.
+func (r *DeviceRegistrationReconciler) awaitOriginalRegistration(ctx context.Context, dr, first *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
+	message := fmt.Sprintf("Waiting for the decision on registration %s, which has the same public key.", first.Name)
+	if dr.Status.Phase == PhasePending && dr.Status.Reason == ReasonAwaitingOriginalRegistration && dr.Status.Message == message {
+		return ctrl.Result{}, nil
+	}
+	logger.Info("Una richiesta precedente con la stessa chiave è in valutazione. La registrazione resta in attesa.", "firstRegistration", first.Name)
+	if _, err := r.transition(ctx, dr, lifecycle.AwaitApproval, ReasonAwaitingOriginalRegistration, message); err != nil {
+		logger.Error(err, "Fallimento nell'aggiornare lo stato a Pending")
 		return ctrl.Result{}, err
 	}
-	logger.Info("Dispositivo deattivato con successo")
 	return ctrl.Result{}, nil
 }
 
-// reactivateDevice gestisce la logica per riattivare un dispositivo.
-func (r *DeviceRegistrationReconciler) reactivateDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
-	logger.Info("Riattivazione del dispositivo in corso...")
-	dr.Status.Phase = PhaseApproved
-	dr.Status.Message = "Device has been reactivated."
-	// Potremmo decidere di aggiornare o meno il timestamp. Lasciamolo così per ora.
-	if err := r.Status().Update(ctx, dr); err != nil {
-		logger.Error(err, "Fallimento nell'aggiornare lo stato ad Approved (riattivazione)")
+// issueCertificate firma il certificato client del dispositivo e lo registra nello status.
+func (r *DeviceRegistrationReconciler) issueCertificate(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, publicKey crypto.PublicKey) error {
+	if r.CA == nil {
+		return nil
+	}
+	issued, err := r.CA.IssueDeviceCertificate(ctx, publicKey, dr.Status.DeviceUUID)
+	if err != nil {
+		return err
+	}
+	dr.Status.Certificate = issued.ChainPEM
+	dr.Status.CertificateSerialNumber = issued.SerialNumber
+	notAfter := metav1.NewTime(issued.NotAfter)
+	dr.Status.CertificateNotAfter = &notAfter
+	return nil
+}
+
+// ensureLabel imposta una label sulla registrazione, se non ha già il valore richiesto.
+// La patch ricarica l'oggetto dal server: eventuali modifiche allo status non salvate vanno perse.
+func (r *DeviceRegistrationReconciler) ensureLabel(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, key, value string) error {
+	if dr.Labels[key] == value {
+		return nil
+	}
+	patch := client.MergeFrom(dr.DeepCopy())
+	if dr.Labels == nil {
+		dr.Labels = map[string]string{}
+	}
+	dr.Labels[key] = value
+	return r.Patch(ctx, dr, patch)
+}
+
+// rejectRegistration porta la registrazione nella fase Rejected riportando il motivo del rifiuto.
+func (r *DeviceRegistrationReconciler) rejectRegistration(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, reason, message string, logger logr.Logger) (ctrl.Result, error) {
+	previousPhase, err := r.transition(ctx, dr, lifecycle.Reject, reason, message)
+	if err != nil {
+		logger.Error(err, "Fallimento nell'aggiornare lo stato a Rejected")
 		return ctrl.Result{}, err
 	}
-	logger.Info("Dispositivo riattivato con successo")
+	recordDecision(dr, previousPhase, DecisionRejected, reason)
+	r.recordRejection(dr, previousPhase)
 	return ctrl.Result{}, nil
 }
 
 func (r *DeviceRegistrationReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Indicizziamo le registrazioni per impronta della chiave, così la ricerca dei duplicati
+	// avviene sulla cache del manager senza interrogare l'API server.
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &devicesv1alpha1.DeviceRegistration{}, KeyFingerprintField, keyFingerprintIndexer); err != nil {
+		return err
+	}
+	// Le metriche per fase e sullo stato del pairing vengono calcolate dalla stessa cache a ogni scrape.
+	if err := registerLifecycleCollector(mgr); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&devicesv1alpha1.DeviceRegistration{}).
-		// Aggiungiamo un watch sul ConfigMap.
-		// Se il ConfigMap cambia, vogliamo riconciliare TUTTE le risorse in stato Pending.
-		Owns(&corev1.ConfigMap{}).
+		// Se la configurazione di pairing di un namespace cambia, riconciliamo le risorse in stato Pending
+		// (e, se richiesto, quelle rifiutate a pairing chiuso). Il ConfigMap non ha owner reference,
+		// quindi serve una mappatura esplicita verso le registrazioni del namespace.
+		Watches(&corev1.ConfigMap{},
+			handler.EnqueueRequestsFromMapFunc(r.registrationsForPairingChange),
+			builder.WithPredicates(isPairingConfigMap, pairingConfigChanged)).
+		Watches(&devicesv1alpha1.PairingPolicy{},
+			handler.EnqueueRequestsFromMapFunc(r.registrationsForPairingChange),
+			builder.WithPredicates(pairingPolicyChanged)).
+		// Una richiesta in attesa di un'altra con la stessa chiave viene riconciliata quando quella cambia.
+		Watches(&devicesv1alpha1.DeviceRegistration{},
+			handler.EnqueueRequestsFromMapFunc(r.registrationsWithSameKey)).
+		// Le richieste sul ciclo di vita si impostano sul Device: ogni modifica alla sua spec
+		// riconcilia la registrazione di origine e i suoi duplicati.
+		Watches(&devicesv1alpha1.Device{},
+			handler.EnqueueRequestsFromMapFunc(r.registrationsForDevice),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{})).
 		Complete(r)
-}
\ No newline at end of file
+}
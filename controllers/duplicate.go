@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+const (
+	// KeyFingerprintField è il nome dell'indice registrato nella cache del manager su status.keyFingerprint.
+	KeyFingerprintField = ".status.keyFingerprint"
+
+	// KeyFingerprintLabel contiene i primi 128 bit (32 caratteri esadecimali) dell'impronta della chiave:
+	// le label sono limitate a 63 caratteri, quindi l'impronta completa resta in status.keyFingerprint.
+	// Serve a selezionare le registrazioni di una chiave con kubectl get -l.
+	KeyFingerprintLabel = "devices.example.com/key-fingerprint"
+
+	// ReasonDuplicateKey indica che la chiave pubblica è già associata a un dispositivo registrato.
+	ReasonDuplicateKey = "DuplicateKey"
+	// ReasonAwaitingOriginalRegistration indica che una richiesta precedente con la stessa chiave è ancora in valutazione.
+	ReasonAwaitingOriginalRegistration = "AwaitingOriginalRegistration"
+)
+
+// DuplicateKeyPolicy stabilisce come trattare una nuova richiesta con una chiave già registrata.
+type DuplicateKeyPolicy string
+
+const (
+	// DuplicateKeyPolicyReuse approva la richiesta restituendo il DeviceUUID già assegnato (re-enroll idempotente).
+	DuplicateKeyPolicyReuse DuplicateKeyPolicy = "Reuse"
+	// DuplicateKeyPolicyReject rifiuta la richiesta duplicata.
+	DuplicateKeyPolicyReject DuplicateKeyPolicy = "Reject"
+)
+
+// ParseDuplicateKeyPolicy valida il valore passato da riga di comando.
+func ParseDuplicateKeyPolicy(value string) (DuplicateKeyPolicy, error) {
+	switch policy := DuplicateKeyPolicy(value); policy {
+	case DuplicateKeyPolicyReuse, DuplicateKeyPolicyReject:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid duplicate key policy %q: must be %s or %s", value, DuplicateKeyPolicyReuse, DuplicateKeyPolicyReject)
+	}
+}
+
+// keyFingerprintIndexer estrae l'impronta della chiave per l'indice della cache.
+// Finché l'operatore non l'ha riportata nello status, l'impronta viene calcolata dalla spec:
+// così due richieste con la stessa chiave create insieme si vedono già alla prima riconciliazione.
+func keyFingerprintIndexer(obj client.Object) []string {
+	dr, ok := obj.(*devicesv1alpha1.DeviceRegistration)
+	if !ok {
+		return nil
+	}
+	if dr.Status.KeyFingerprint != "" {
+		return []string{dr.Status.KeyFingerprint}
+	}
+	keyInfo, err := parsePublicKey(dr.Spec.PublicKey)
+	if err != nil {
+		return nil
+	}
+	return []string{keyInfo.Fingerprint}
+}
+
+// keyFingerprintLabelValue restituisce il valore della label per un'impronta completa.
+func keyFingerprintLabelValue(fingerprint string) string {
+	if len(fingerprint) > 32 {
+		return fingerprint[:32]
+	}
+	return fingerprint
+}
+
+// findRegisteredDevice cerca, nello stesso namespace, la registrazione originale che ha già
+// ottenuto un DeviceUUID per la stessa chiave. Le registrazioni che sono a loro volta duplicati
+// vengono ignorate, così il DeviceUUID restituito è sempre quello del dispositivo originale.
+// Un dispositivo il cui certificato è scaduto non trattiene più la chiave.
+//
+// In assenza di un dispositivo registrato, restituisce la richiesta ancora in valutazione con la stessa
+// chiave che precede dr (creata prima o, a parità, con il nome minore): dr ne attende la decisione,
+// così due richieste concorrenti non ottengono due DeviceUUID per lo stesso dispositivo.
+func (r *DeviceRegistrationReconciler) findRegisteredDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, fingerprint string) (*devicesv1alpha1.DeviceRegistration, error) {
+	var registrations devicesv1alpha1.DeviceRegistrationList
+	if err := r.List(ctx, &registrations, client.InNamespace(dr.Namespace), client.MatchingFields{KeyFingerprintField: fingerprint}); err != nil {
+		return nil, fmt.Errorf("impossibile cercare registrazioni con la stessa chiave: %w", err)
+	}
+
+	var first *devicesv1alpha1.DeviceRegistration
+	for i := range registrations.Items {
+		other := &registrations.Items[i]
+		if other.UID == dr.UID || other.Status.DuplicateOf != "" {
+			continue
+		}
+		switch other.Status.Phase {
+		case PhaseApproved, PhaseDeactivated, PhaseSuspended, PhaseQuarantined, PhaseRetired:
+			if other.Status.DeviceUUID != "" {
+				return other, nil
+			}
+		case "", PhasePending:
+			if other.DeletionTimestamp == nil && precedes(other, dr) && (first == nil || precedes(other, first)) {
+				first = other
+			}
+		}
+	}
+	return first, nil
+}
+
+// precedes indica se la richiesta a viene valutata prima di b: la più vecchia, poi quella con il nome minore.
+func precedes(a, b *devicesv1alpha1.DeviceRegistration) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return a.CreationTimestamp.Before(&b.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
+
+// registrationsWithSameKey riconcilia le richieste in valutazione con la stessa chiave di una registrazione
+// modificata o cancellata: quelle in attesa della decisione sulla richiesta originale la adottano.
+func (r *DeviceRegistrationReconciler) registrationsWithSameKey(ctx context.Context, obj client.Object) []reconcile.Request {
+	dr, ok := obj.(*devicesv1alpha1.DeviceRegistration)
+	if !ok {
+		return nil
+	}
+	fingerprints := keyFingerprintIndexer(dr)
+	if len(fingerprints) == 0 {
+		return nil
+	}
+	var list devicesv1alpha1.DeviceRegistrationList
+	if err := r.List(ctx, &list, client.InNamespace(dr.Namespace), client.MatchingFields{KeyFingerprintField: fingerprints[0]}); err != nil {
+		r.Log.Error(err, "Impossibile elencare le registrazioni con la stessa chiave", "registration", dr.Name)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, other := range list.Items {
+		if other.UID != dr.UID && other.Status.Reason == ReasonAwaitingOriginalRegistration {
+			requests = append(requests, ctrl.Request{NamespacedName: types.NamespacedName{Name: other.Name, Namespace: other.Namespace}})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,85 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestConcurrentRequestsWithSameKeyShareOneDevice(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Now().Add(-time.Minute).Truncate(time.Second)
+	// La richiesta "b" è la più vecchia: è lei a essere valutata, anche se il suo nome viene dopo.
+	first := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "b", Namespace: "devices", UID: "uid-b", Generation: 1, CreationTimestamp: metav1.NewTime(created)},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: base64.StdEncoding.EncodeToString(publicKey)},
+	}
+	second := first.DeepCopy()
+	second.Name = "a"
+	second.UID = "uid-a"
+	second.CreationTimestamp = metav1.NewTime(created.Add(time.Second))
+	pairing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true", PairingModeKey: PairingModeManual},
+	}
+	c := lifecycleTestClient(scheme, first, second, pairing)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), DuplicateKeyPolicy: DuplicateKeyPolicyReuse}
+
+	reconcile := func(name string) *devicesv1alpha1.DeviceRegistration {
+		t.Helper()
+		key := types.NamespacedName{Name: name, Namespace: "devices"}
+		if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+			t.Fatal(err)
+		}
+		var got devicesv1alpha1.DeviceRegistration
+		if err := c.Get(ctx, key, &got); err != nil {
+			t.Fatal(err)
+		}
+		return &got
+	}
+
+	// La richiesta più recente attende la decisione sulla prima, senza chiedere una propria approvazione.
+	got := reconcile("a")
+	if got.Status.Phase != PhasePending || got.Status.Reason != ReasonAwaitingOriginalRegistration ||
+		meta.FindStatusCondition(got.Status.Conditions, ConditionAwaitingApproval) != nil {
+		t.Fatalf("a: phase = %q, reason = %q, conditions = %+v, want Pending waiting for b",
+			got.Status.Phase, got.Status.Reason, got.Status.Conditions)
+	}
+	original := reconcile("b")
+	if original.Status.Phase != PhasePending || !meta.IsStatusConditionTrue(original.Status.Conditions, ConditionAwaitingApproval) {
+		t.Fatalf("b: phase = %q, conditions = %+v, want Pending and AwaitingApproval", original.Status.Phase, original.Status.Conditions)
+	}
+
+	// La decisione sulla prima richiesta riconcilia quella in attesa, che ne adotta il DeviceUUID.
+	setApproval(t, ctx, r, original, ApprovalDecisionApproved)
+	original = reconcile("b")
+	if original.Status.Phase != PhaseApproved {
+		t.Fatalf("b: phase = %q, want Approved", original.Status.Phase)
+	}
+	requests := r.registrationsWithSameKey(ctx, original)
+	if len(requests) != 1 || requests[0].Name != "a" {
+		t.Fatalf("requests = %+v, want only a", requests)
+	}
+	got = reconcile("a")
+	if got.Status.Phase != PhaseApproved || got.Status.DuplicateOf != "b" || got.Status.DeviceUUID != original.Status.DeviceUUID {
+		t.Fatalf("a: phase = %q, duplicateOf = %q, DeviceUUID = %q, want Approved as a duplicate of b with %s",
+			got.Status.Phase, got.Status.DuplicateOf, got.Status.DeviceUUID, original.Status.DeviceUUID)
+	}
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// Motivi degli eventi Kubernetes emessi sulle DeviceRegistration. I rifiuti usano come motivo
+// lo stesso codice scritto in status.reason.
+const (
+	EventReasonApproved               = "Approved"
+	EventReasonAwaitingApproval       = "AwaitingApproval"
+	EventReasonDeactivated            = "Deactivated"
+	EventReasonReactivated            = "Reactivated"
+	EventReasonSuspended              = "Suspended"
+	EventReasonResumed                = "Resumed"
+	EventReasonQuarantined            = "Quarantined"
+	EventReasonReleased               = "ReleasedFromQuarantine"
+	EventReasonRetired                = "Retired"
+	EventReasonDeviceCreated          = "DeviceCreated"
+	EventReasonTransitionRefused      = "TransitionNotAllowed"
+	EventReasonDeleted                = "Deleted"
+	EventReasonCertificateRenewed     = "CertificateRenewed"
+	EventReasonCertificateExpired     = "CertificateExpired"
+	EventReasonPairingPolicyReadError = "PairingPolicyReadFailed"
+	EventReasonPendingExpired         = "PendingRegistrationExpired"
+	EventReasonTombstoneFailed        = "TombstoneFailed"
+)
+
+// recordEvent emette un evento sulla registrazione, visibile con kubectl describe.
+// Senza Recorder (ad esempio nei test) non fa nulla.
+func (r *DeviceRegistrationReconciler) recordEvent(dr *devicesv1alpha1.DeviceRegistration, eventType, reason, messageFmt string, args ...interface{}) {
+	if r.Recorder == nil {
+		return
+	}
+	r.Recorder.Eventf(dr, eventType, reason, messageFmt, args...)
+}
+
+// recordRejection emette un evento Warning con il motivo del rifiuto, solo quando la registrazione
+// entra nella fase Rejected: una rivalutazione che conferma il rifiuto non genera un nuovo evento.
+func (r *DeviceRegistrationReconciler) recordRejection(dr *devicesv1alpha1.DeviceRegistration, previousPhase string) {
+	if previousPhase == PhaseRejected {
+		return
+	}
+	r.recordEvent(dr, corev1.EventTypeWarning, dr.Status.Reason, "Registration rejected: %s", dr.Status.Message)
+}
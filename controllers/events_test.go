@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestRejectionEventIsEmittedOnce(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := devicesv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices"},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: base64.StdEncoding.EncodeToString(publicKey)},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(dr).
+		WithStatusSubresource(&devicesv1alpha1.DeviceRegistration{}, &devicesv1alpha1.Device{}).
+		WithIndex(&devicesv1alpha1.DeviceRegistration{}, KeyFingerprintField, keyFingerprintIndexer).
+		Build()
+	recorder := record.NewFakeRecorder(10)
+	r := &DeviceRegistrationReconciler{
+		Client:                      c,
+		Scheme:                      scheme,
+		Log:                         logr.Discard(),
+		Recorder:                    recorder,
+		ReevaluatePairingRejections: true,
+	}
+
+	// Il pairing è chiuso: la prima riconciliazione rifiuta, la seconda rivaluta e conferma il rifiuto.
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "device", Namespace: "devices"}}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(ctx, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	if len(events) != 1 {
+		t.Fatalf("events = %q, want exactly one rejection", events)
+	}
+	if !strings.HasPrefix(events[0], "Warning "+ReasonPairingDisabled+" ") {
+		t.Fatalf("event = %q, want a Warning with reason %s", events[0], ReasonPairingDisabled)
+	}
+}
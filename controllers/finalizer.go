@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// CleanupFinalizer trattiene la cancellazione di un dispositivo registrato finché l'operatore non ha
+// revocato il suo certificato, cancellato i Secret e il Device che ne dipendono, scritto la lapide
+// della sua chiave ed emesso l'evento di audit.
+const CleanupFinalizer = "devices.example.com/device-cleanup"
+
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=deletecollection
+
+// needsCleanupFinalizer indica se la registrazione appartiene a un dispositivo che ha ottenuto un DeviceUUID
+// e che va quindi ripulito alla cancellazione. I duplicati condividono identità e certificato dell'originale:
+// la loro cancellazione non tocca nulla.
+func needsCleanupFinalizer(dr *devicesv1alpha1.DeviceRegistration) bool {
+	return dr.Status.DuplicateOf == "" && dr.Status.DeviceUUID != ""
+}
+
+// ensureCleanupFinalizer aggiunge il finalizer di pulizia alle registrazioni che ne hanno bisogno.
+// Come ensureLabel, la patch ricarica l'oggetto dal server.
+func (r *DeviceRegistrationReconciler) ensureCleanupFinalizer(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) error {
+	if !needsCleanupFinalizer(dr) || controllerutil.ContainsFinalizer(dr, CleanupFinalizer) {
+		return nil
+	}
+	patch := client.MergeFrom(dr.DeepCopy())
+	controllerutil.AddFinalizer(dr, CleanupFinalizer)
+	return r.Patch(ctx, dr, patch)
+}
+
+// finalizeRegistration ripulisce un dispositivo in cancellazione e rilascia il finalizer.
+// Ogni passo è idempotente: se uno fallisce, la riconciliazione successiva li ripete tutti.
+func (r *DeviceRegistrationReconciler) finalizeRegistration(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(dr, CleanupFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	if needsCleanupFinalizer(dr) {
+		logger = logger.WithValues("DeviceUUID", dr.Status.DeviceUUID)
+
+		// 1. Il certificato entra nella CRL prima che la registrazione sparisca.
+		if r.Revocation != nil && dr.Status.CertificateSerialNumber != "" {
+			logger.Info("Registrazione in cancellazione: revoca del certificato", "serialNumber", dr.Status.CertificateSerialNumber)
+			if err := r.Revocation.RecordDeletion(ctx, dr); err != nil {
+				logger.Error(err, "Impossibile revocare il certificato della registrazione cancellata")
+				return ctrl.Result{}, err
+			}
+		}
+
+		// 2. I Secret con le credenziali del dispositivo sono riconoscibili dalla label con il suo UUID.
+		if err := r.DeleteAllOf(ctx, &corev1.Secret{}, client.InNamespace(dr.Namespace),
+			client.MatchingLabels{DeviceUUIDLabel: dr.Status.DeviceUUID}); err != nil {
+			logger.Error(err, "Impossibile cancellare i Secret del dispositivo")
+			return ctrl.Result{}, err
+		}
+
+		// 3. La lapide impedisce che la stessa chiave venga riusata senza una decisione di un amministratore.
+		// Se non può essere scritta, la cancellazione viene ripetuta finché un amministratore non la risolve
+		// o non rinuncia esplicitamente alla lapide con l'annotazione SkipTombstoneAnnotation.
+		skipTombstone := dr.Annotations[SkipTombstoneAnnotation] == "true"
+		if skipTombstone {
+			logger.Info("Lapide non registrata su richiesta dell'amministratore", "annotation", SkipTombstoneAnnotation)
+		} else if err := r.writeTombstone(ctx, dr); err != nil {
+			logger.Error(err, "Impossibile registrare la lapide del dispositivo cancellato")
+			r.recordEvent(dr, corev1.EventTypeWarning, EventReasonTombstoneFailed,
+				"Unable to record the tombstone of device %s: %v. Deletion is retried; set the annotation %s=true to delete the registration without a tombstone.",
+				dr.Status.DeviceUUID, err, SkipTombstoneAnnotation)
+			return ctrl.Result{}, err
+		}
+
+		// 4. Il Device sparisce con la sua registrazione di origine.
+		if err := r.deleteDevice(ctx, dr); err != nil {
+			logger.Error(err, "Impossibile cancellare il Device")
+			return ctrl.Result{}, err
+		}
+
+		// 5. Audit: un log strutturato per chi raccoglie i log dell'operatore e un evento sulla registrazione.
+		logger.Info("Audit: dispositivo cancellato", "audit", true,
+			"phase", dr.Status.Phase, "keyFingerprint", dr.Status.KeyFingerprint,
+			"serialNumber", dr.Status.CertificateSerialNumber, "registrationTimestamp", dr.Status.RegistrationTimestamp)
+		if skipTombstone {
+			r.recordEvent(dr, corev1.EventTypeNormal, EventReasonDeleted,
+				"Device %s deleted: its certificate has been revoked and its Secrets deleted. No tombstone was recorded for its public key.",
+				dr.Status.DeviceUUID)
+		} else {
+			r.recordEvent(dr, corev1.EventTypeNormal, EventReasonDeleted,
+				"Device %s deleted: its certificate has been revoked, its Secrets deleted and its public key recorded in %s.",
+				dr.Status.DeviceUUID, tombstoneConfigMapName(dr.Status.KeyFingerprint))
+		}
+	}
+
+	patch := client.MergeFrom(dr.DeepCopy())
+	controllerutil.RemoveFinalizer(dr, CleanupFinalizer)
+	if err := r.Patch(ctx, dr, patch); err != nil {
+		logger.Error(err, "Impossibile rimuovere il finalizer di pulizia")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
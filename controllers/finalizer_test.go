@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestDeletionCleansUpAndBlocksSilentKeyReuse(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(publicKey)
+	keyInfo, err := parsePublicKey(encodedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const deviceUUID = "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a"
+	now := metav1.Now()
+	deleted := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "deleted", Namespace: "devices",
+			Finalizers:        []string{CleanupFinalizer},
+			DeletionTimestamp: &now,
+		},
+		Spec: devicesv1alpha1.DeviceRegistrationSpec{PublicKey: encodedKey},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:          PhaseApproved,
+			DeviceUUID:     deviceUUID,
+			KeyFingerprint: keyInfo.Fingerprint,
+		},
+	}
+	credentials := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+		Name: "device-credentials", Namespace: "devices", Labels: map[string]string{DeviceUUIDLabel: deviceUUID},
+	}}
+	unrelated := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "devices"}}
+	pairing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true"},
+	}
+	c := lifecycleTestClient(scheme, deleted, credentials, unrelated, pairing)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "deleted", Namespace: "devices"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Name: "deleted", Namespace: "devices"}, &devicesv1alpha1.DeviceRegistration{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("registration still exists after finalization: %v", err)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Name: "device-credentials", Namespace: "devices"}, &corev1.Secret{}); !apierrors.IsNotFound(err) {
+		t.Fatalf("device Secret not deleted: %v", err)
+	}
+	if err := c.Get(ctx, types.NamespacedName{Name: "unrelated", Namespace: "devices"}, &corev1.Secret{}); err != nil {
+		t.Fatalf("unrelated Secret deleted: %v", err)
+	}
+
+	tombstones := &corev1.ConfigMap{}
+	if err := c.Get(ctx, types.NamespacedName{Name: tombstoneConfigMapName(keyInfo.Fingerprint), Namespace: "devices"}, tombstones); err != nil {
+		t.Fatal(err)
+	}
+	if tombstones.Labels[TombstoneLabel] != "true" || tombstones.Labels[KeyFingerprintLabel] != keyFingerprintLabelValue(keyInfo.Fingerprint) {
+		t.Fatalf("tombstone labels = %v", tombstones.Labels)
+	}
+	var tombstone Tombstone
+	if err := json.Unmarshal([]byte(tombstones.Data[TombstoneDataKey]), &tombstone); err != nil {
+		t.Fatal(err)
+	}
+	if tombstone.DeviceUUID != deviceUUID || tombstone.Name != "deleted" || tombstone.DeletedAt.IsZero() {
+		t.Fatalf("tombstone = %+v", tombstone)
+	}
+
+	// Anche a pairing aperto, la stessa chiave non viene approvata senza un amministratore.
+	retry := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "retry", Namespace: "devices"},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: encodedKey},
+	}
+	if err := c.Create(ctx, retry); err != nil {
+		t.Fatal(err)
+	}
+	key := types.NamespacedName{Name: "retry", Namespace: "devices"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhasePending || got.Status.DeviceUUID != "" {
+		t.Fatalf("phase = %q, DeviceUUID = %q, want Pending without a DeviceUUID", got.Status.Phase, got.Status.DeviceUUID)
+	}
+	awaiting := meta.FindStatusCondition(got.Status.Conditions, ConditionAwaitingApproval)
+	if awaiting == nil || awaiting.Status != metav1.ConditionTrue || awaiting.Reason != ReasonKeyPreviouslyDeleted {
+		t.Fatalf("AwaitingApproval = %+v, want True with reason %s", awaiting, ReasonKeyPreviouslyDeleted)
+	}
+}
+
+func TestTombstoneFailureCanBeOverridden(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedKey := base64.StdEncoding.EncodeToString(publicKey)
+	keyInfo, err := parsePublicKey(encodedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := metav1.Now()
+	deleted := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "deleted", Namespace: "devices",
+			Finalizers:        []string{CleanupFinalizer},
+			DeletionTimestamp: &now,
+		},
+		Spec: devicesv1alpha1.DeviceRegistrationSpec{PublicKey: encodedKey},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:          PhaseApproved,
+			DeviceUUID:     "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+			KeyFingerprint: keyInfo.Fingerprint,
+		},
+	}
+	// L'API server rifiuta la creazione della lapide, ad esempio per una quota sui ConfigMap.
+	c := fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(deleted).
+		WithStatusSubresource(&devicesv1alpha1.DeviceRegistration{}).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				if _, ok := obj.(*corev1.ConfigMap); ok {
+					return apierrors.NewForbidden(corev1.Resource("configmaps"), obj.GetName(), errors.New("exceeded quota"))
+				}
+				return c.Create(ctx, obj, opts...)
+			},
+		}).
+		Build()
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+	key := types.NamespacedName{Name: "deleted", Namespace: "devices"}
+
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err == nil {
+		t.Fatal("finalization succeeded without writing the tombstone")
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatalf("registration deleted without a tombstone: %v", err)
+	}
+
+	// Un amministratore può completare la cancellazione rinunciando alla lapide.
+	got.Annotations = map[string]string{SkipTombstoneAnnotation: "true"}
+	if err := c.Update(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &got); !apierrors.IsNotFound(err) {
+		t.Fatalf("registration still exists after skipping the tombstone: %v", err)
+	}
+}
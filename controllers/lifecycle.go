@@ -0,0 +1,297 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+	"github.com/antonio/device-operator/internal/lifecycle"
+)
+
+const (
+	// ConditionTransitionAllowed è False mentre la spec chiede una transizione che la fase corrente
+	// non ammette, ad esempio spec.deactivate su una richiesta ancora Pending. Viene rimossa quando
+	// la transizione viene applicata o la richiesta viene ritirata.
+	ConditionTransitionAllowed = "TransitionAllowed"
+
+	// ReasonIllegalTransition indica che la transizione richiesta non è prevista nella fase corrente.
+	// Quando la transizione è prevista ma una sua guard non è soddisfatta, il motivo è quello della guard.
+	ReasonIllegalTransition = "IllegalTransition"
+)
+
+// lifecycleControls sono le richieste di un amministratore sul ciclo di vita del dispositivo.
+// Si leggono dal Device quando esiste, altrimenti dalla spec della registrazione.
+type lifecycleControls struct {
+	Deactivate   bool
+	SuspendUntil *metav1.Time
+	Quarantine   bool
+	Retire       bool
+}
+
+// registrationControls restituisce le richieste scritte nella spec della registrazione.
+func registrationControls(dr *devicesv1alpha1.DeviceRegistration) lifecycleControls {
+	return lifecycleControls{
+		Deactivate:   dr.Spec.Deactivate,
+		SuspendUntil: dr.Spec.SuspendUntil,
+		Quarantine:   dr.Spec.Quarantine,
+		Retire:       dr.Spec.Retire,
+	}
+}
+
+// deviceControls restituisce le richieste scritte nella spec del Device.
+func deviceControls(device *devicesv1alpha1.Device) lifecycleControls {
+	return lifecycleControls{
+		Deactivate:   device.Spec.Deactivate,
+		SuspendUntil: device.Spec.SuspendUntil,
+		Quarantine:   device.Spec.Quarantine,
+		Retire:       device.Spec.Retire,
+	}
+}
+
+// lifecycleFacts raccoglie dalla registrazione e dalle richieste dell'amministratore le informazioni
+// su cui si basano le guard della macchina a stati.
+func lifecycleFacts(dr *devicesv1alpha1.DeviceRegistration, controls lifecycleControls, now time.Time) lifecycle.Facts {
+	facts := lifecycle.Facts{Now: now, HasIdentity: dr.Status.DeviceUUID != ""}
+	if dr.Status.CertificateNotAfter != nil {
+		notAfter := dr.Status.CertificateNotAfter.Time
+		facts.CertificateNotAfter = &notAfter
+	}
+	if controls.SuspendUntil != nil {
+		until := controls.SuspendUntil.Time
+		facts.SuspendUntil = &until
+	}
+	return facts
+}
+
+// transition applica un evento del workflow della registrazione (approvazione, rifiuto, scadenza...),
+// le cui guard non dipendono dalle richieste dell'amministratore. Vedi applyTransition.
+func (r *DeviceRegistrationReconciler) transition(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, event lifecycle.Event, reason, message string) (string, error) {
+	return r.applyTransition(ctx, dr, lifecycleControls{}, event, reason, message)
+}
+
+// applyTransition applica un evento del ciclo di vita alla registrazione: chiede la transizione alla
+// macchina a stati, ne esegue gli effetti, imposta fase, motivo e messaggio e salva lo status.
+// Restituisce la fase precedente. Se la transizione non è ammessa lo status resta invariato e
+// l'errore è un *lifecycle.IllegalTransitionError o un *lifecycle.GuardError.
+func (r *DeviceRegistrationReconciler) applyTransition(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, controls lifecycleControls, event lifecycle.Event, reason, message string) (string, error) {
+	previousPhase := dr.Status.Phase
+	from, err := lifecycle.ParseState(previousPhase)
+	if err != nil {
+		return previousPhase, err
+	}
+	now := time.Now()
+	tr, err := lifecycle.Fire(from, event, lifecycleFacts(dr, controls, now))
+	if err != nil {
+		return previousPhase, err
+	}
+
+	revocationsChanged := false
+	for _, effect := range tr.Effects {
+		if err := r.applyEffect(ctx, dr, tr, effect, now); err != nil {
+			return previousPhase, err
+		}
+		revocationsChanged = revocationsChanged || effect != lifecycle.IssueCertificate
+	}
+	dr.Status.Phase = string(tr.To)
+	dr.Status.Reason = reason
+	dr.Status.Message = message
+	if err := r.updateStatus(ctx, dr); err != nil {
+		return previousPhase, err
+	}
+	if revocationsChanged {
+		r.publishRevocations()
+	}
+	return previousPhase, nil
+}
+
+// applyEffect esegue un effetto della transizione prima che la nuova fase venga salvata.
+// I duplicati condividono il certificato della registrazione originale: non ne ricevono uno proprio
+// e non lo revocano.
+func (r *DeviceRegistrationReconciler) applyEffect(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, tr lifecycle.Transition, effect lifecycle.Effect, now time.Time) error {
+	switch effect {
+	case lifecycle.IssueCertificate:
+		if dr.Status.DuplicateOf != "" {
+			return nil
+		}
+		keyInfo, err := parsePublicKey(dr.Spec.PublicKey)
+		if err != nil {
+			return fmt.Errorf("impossibile emettere il certificato: %w", err)
+		}
+		if err := r.issueCertificate(ctx, dr, keyInfo.Key); err != nil {
+			return fmt.Errorf("impossibile emettere il certificato: %w", err)
+		}
+	case lifecycle.HoldCertificate:
+		// Il certificato resta sospeso dalla prima sospensione, anche passando da Suspended a Deactivated.
+		if dr.Status.CertificateSerialNumber != "" && dr.Status.CertificateRevokedAt == nil {
+			revokedAt := metav1.NewTime(now)
+			dr.Status.CertificateRevokedAt = &revokedAt
+		}
+	case lifecycle.ReleaseCertificate:
+		dr.Status.CertificateRevokedAt = nil
+	case lifecycle.RevokeCertificate:
+		if dr.Status.CertificateSerialNumber == "" {
+			return nil
+		}
+		// La revoca definitiva viene salvata nella CRL prima del cambio di fase: se il salvataggio
+		// dello status fallisce, la transizione viene ripetuta e la revoca è idempotente.
+		if r.Revocation != nil && dr.Status.DuplicateOf == "" {
+			if err := r.Revocation.RecordRevocation(ctx, dr, revocationReason(tr.To)); err != nil {
+				return err
+			}
+		}
+		if dr.Status.CertificateRevokedAt == nil {
+			revokedAt := metav1.NewTime(now)
+			dr.Status.CertificateRevokedAt = &revokedAt
+		}
+	default:
+		return fmt.Errorf("effetto del ciclo di vita sconosciuto: %s", effect)
+	}
+	return nil
+}
+
+// revocationReason restituisce il motivo di revoca definitiva per la fase di arrivo.
+func revocationReason(state lifecycle.State) string {
+	if state == lifecycle.Quarantined {
+		return RevocationReasonQuarantined
+	}
+	return RevocationReasonRetired
+}
+
+// requestedTransition deriva dalle richieste dell'amministratore l'evento da applicare nella fase corrente.
+// Le richieste sono valutate dalla più grave alla meno grave: dismissione, quarantena,
+// deattivazione e sospensione; quando un flag viene rimosso l'evento è quello inverso.
+// Retired è una fase terminale: le richieste non vengono più considerate.
+func requestedTransition(controls lifecycleControls, state lifecycle.State, now time.Time) (lifecycle.Event, bool) {
+	suspended := controls.SuspendUntil != nil && now.Before(controls.SuspendUntil.Time)
+	switch {
+	case state == lifecycle.Retired:
+		return "", false
+	case controls.Retire:
+		return lifecycle.Retire, true
+	case controls.Quarantine:
+		return lifecycle.Quarantine, state != lifecycle.Quarantined
+	case state == lifecycle.Quarantined:
+		return lifecycle.Release, true
+	case controls.Deactivate:
+		return lifecycle.Deactivate, state != lifecycle.Deactivated
+	case state == lifecycle.Deactivated:
+		return lifecycle.Reactivate, true
+	case suspended:
+		return lifecycle.Suspend, state != lifecycle.Suspended
+	case state == lifecycle.Suspended:
+		return lifecycle.Resume, true
+	}
+	return "", false
+}
+
+// applyRequestedTransition applica la transizione chiesta dall'amministratore. Se la fase corrente non la ammette
+// imposta la condizione TransitionAllowed a False e restituisce applied=false: la registrazione
+// prosegue allora il workflow della sua fase.
+func (r *DeviceRegistrationReconciler) applyRequestedTransition(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, controls lifecycleControls, state lifecycle.State, event lifecycle.Event, logger logr.Logger) (result ctrl.Result, applied bool, err error) {
+	logger = logger.WithValues("event", event, "phase", state)
+
+	var illegal *lifecycle.IllegalTransitionError
+	var guard *lifecycle.GuardError
+	_, err = lifecycle.Fire(state, event, lifecycleFacts(dr, controls, time.Now()))
+	switch {
+	case errors.As(err, &illegal):
+		return ctrl.Result{}, false, r.refuseTransition(ctx, dr, ReasonIllegalTransition,
+			fmt.Sprintf("Transition %s is not allowed in phase %s; the request in the spec is ignored.", event, state), logger)
+	case errors.As(err, &guard):
+		return ctrl.Result{}, false, r.refuseTransition(ctx, dr, guard.Reason,
+			fmt.Sprintf("Transition %s cannot be applied yet: %s.", event, guard.Message), logger)
+	case err != nil:
+		return ctrl.Result{}, true, err
+	}
+
+	// La condizione viene rimossa prima della transizione, così lo status salvato non la contiene più.
+	meta.RemoveStatusCondition(&dr.Status.Conditions, ConditionTransitionAllowed)
+	message := requestedTransitionMessage(controls, event)
+	previousPhase, err := r.applyTransition(ctx, dr, controls, event, "", message)
+	if err != nil {
+		logger.Error(err, "Fallimento nell'applicare la transizione richiesta")
+		return ctrl.Result{}, true, err
+	}
+	logger.Info("Transizione del ciclo di vita applicata", "newPhase", dr.Status.Phase)
+	if event == lifecycle.Deactivate {
+		recordDecision(dr, previousPhase, DecisionDeactivated, ReasonDeactivatedByAdministrator)
+	}
+	eventType, eventReason := requestedTransitionEvent(event)
+	r.recordEvent(dr, eventType, eventReason, "%s", message)
+
+	// La sospensione termina da sola: riconciliamo di nuovo quando scade.
+	if event == lifecycle.Suspend {
+		return ctrl.Result{RequeueAfter: time.Until(controls.SuspendUntil.Time)}, true, nil
+	}
+	return ctrl.Result{}, true, nil
+}
+
+// refuseTransition segnala con la condizione TransitionAllowed una transizione non ammessa.
+// La condizione viene salvata subito, perché il workflow della fase può ricaricare l'oggetto dal server;
+// l'evento Warning viene emesso solo quando la condizione cambia, non a ogni riconciliazione.
+func (r *DeviceRegistrationReconciler) refuseTransition(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, reason, message string, logger logr.Logger) error {
+	if !meta.SetStatusCondition(&dr.Status.Conditions, metav1.Condition{
+		Type:               ConditionTransitionAllowed,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: dr.Generation,
+	}) {
+		return nil
+	}
+	logger.Info("Transizione richiesta non ammessa nella fase corrente", "reason", reason)
+	if err := r.updateStatus(ctx, dr); err != nil {
+		logger.Error(err, "Fallimento nell'aggiornare la condizione TransitionAllowed")
+		return err
+	}
+	r.recordEvent(dr, corev1.EventTypeWarning, EventReasonTransitionRefused, "%s", message)
+	return nil
+}
+
+// requestedTransitionMessage restituisce il messaggio di stato di una transizione chiesta dall'amministratore.
+func requestedTransitionMessage(controls lifecycleControls, event lifecycle.Event) string {
+	switch event {
+	case lifecycle.Deactivate:
+		return "Device has been deactivated by an administrator."
+	case lifecycle.Reactivate:
+		return "Device has been reactivated."
+	case lifecycle.Suspend:
+		return fmt.Sprintf("Device has been suspended until %s.", controls.SuspendUntil.UTC().Format(time.RFC3339))
+	case lifecycle.Resume:
+		return "Device suspension has ended."
+	case lifecycle.Quarantine:
+		return "Device has been quarantined by an administrator and its certificate has been revoked."
+	case lifecycle.Release:
+		return "Device has been released from quarantine with a new certificate."
+	case lifecycle.Retire:
+		return "Device has been retired."
+	}
+	return fmt.Sprintf("Lifecycle event %s applied.", event)
+}
+
+// requestedTransitionEvent restituisce tipo e motivo dell'evento Kubernetes di una transizione chiesta dall'amministratore.
+func requestedTransitionEvent(event lifecycle.Event) (string, string) {
+	switch event {
+	case lifecycle.Deactivate:
+		return corev1.EventTypeNormal, EventReasonDeactivated
+	case lifecycle.Reactivate:
+		return corev1.EventTypeNormal, EventReasonReactivated
+	case lifecycle.Suspend:
+		return corev1.EventTypeNormal, EventReasonSuspended
+	case lifecycle.Resume:
+		return corev1.EventTypeNormal, EventReasonResumed
+	case lifecycle.Quarantine:
+		return corev1.EventTypeWarning, EventReasonQuarantined
+	case lifecycle.Release:
+		return corev1.EventTypeNormal, EventReasonReleased
+	}
+	return corev1.EventTypeNormal, EventReasonRetired
+}
@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func lifecycleTestScheme(t *testing.T) *runtime.Scheme {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := devicesv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	return scheme
+}
+
+func lifecycleTestClient(scheme *runtime.Scheme, objects ...client.Object) client.Client {
+	return fake.NewClientBuilder().WithScheme(scheme).
+		WithObjects(objects...).
+		WithStatusSubresource(&devicesv1alpha1.DeviceRegistration{}, &devicesv1alpha1.Device{}, &devicesv1alpha1.PairingPolicy{}).
+		WithIndex(&devicesv1alpha1.DeviceRegistration{}, KeyFingerprintField, keyFingerprintIndexer).
+		Build()
+}
+
+func TestReconcileRefusesIllegalTransition(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// spec.deactivate su una richiesta non ancora approvata non è una transizione ammessa.
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices"},
+		Spec: devicesv1alpha1.DeviceRegistrationSpec{
+			PublicKey:  base64.StdEncoding.EncodeToString(publicKey),
+			Deactivate: true,
+		},
+	}
+	c := lifecycleTestClient(scheme, dr)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+	key := types.NamespacedName{Name: "device", Namespace: "devices"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	// La richiesta viene comunque valutata: il pairing è chiuso, quindi viene rifiutata.
+	if got.Status.Phase != PhaseRejected {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, PhaseRejected)
+	}
+	condition := meta.FindStatusCondition(got.Status.Conditions, ConditionTransitionAllowed)
+	if condition == nil || condition.Status != metav1.ConditionFalse || condition.Reason != ReasonIllegalTransition {
+		t.Fatalf("TransitionAllowed = %+v, want False with reason %s", condition, ReasonIllegalTransition)
+	}
+
+	// Ritirata la richiesta, la condizione sparisce.
+	got.Spec.Deactivate = false
+	if err := c.Update(ctx, &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if condition := meta.FindStatusCondition(got.Status.Conditions, ConditionTransitionAllowed); condition != nil {
+		t.Fatalf("TransitionAllowed = %+v, want it removed", condition)
+	}
+}
+
+func TestSuspensionEndsAutomatically(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	notAfter := metav1.NewTime(time.Now().Add(24 * time.Hour))
+	until := metav1.NewTime(time.Now().Add(time.Hour))
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices"},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: "unused", SuspendUntil: &until},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:                   PhaseApproved,
+			DeviceUUID:              "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+			CertificateSerialNumber: "a1",
+			CertificateNotAfter:     &notAfter,
+		},
+	}
+	c := lifecycleTestClient(scheme, dr)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+	key := types.NamespacedName{Name: "device", Namespace: "devices"}
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseSuspended || got.Status.CertificateRevokedAt == nil {
+		t.Fatalf("phase = %q, certificateRevokedAt = %v, want Suspended with the certificate on hold", got.Status.Phase, got.Status.CertificateRevokedAt)
+	}
+	if result.RequeueAfter <= 0 || result.RequeueAfter > time.Hour {
+		t.Fatalf("RequeueAfter = %v, want the time left until suspendUntil", result.RequeueAfter)
+	}
+
+	// La registrazione approvata prima dei Device ottiene il suo Device, con la sospensione già richiesta.
+	var device devicesv1alpha1.Device
+	if err := c.Get(ctx, types.NamespacedName{Name: got.Status.DeviceUUID, Namespace: "devices"}, &device); err != nil {
+		t.Fatal(err)
+	}
+	if device.Spec.SuspendUntil == nil || device.Status.Phase != PhaseSuspended {
+		t.Fatalf("device spec.suspendUntil = %v, status.phase = %q, want the suspension copied from the registration", device.Spec.SuspendUntil, device.Status.Phase)
+	}
+
+	// Passato suspendUntil, il dispositivo torna Approved e il certificato esce dalla CRL.
+	past := metav1.NewTime(time.Now().Add(-time.Second))
+	device.Spec.SuspendUntil = &past
+	if err := c.Update(ctx, &device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseApproved || got.Status.CertificateRevokedAt != nil {
+		t.Fatalf("phase = %q, certificateRevokedAt = %v, want Approved with the hold released", got.Status.Phase, got.Status.CertificateRevokedAt)
+	}
+}
+
+func TestQuarantineRevokesCertificatePermanently(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := lifecycleTestClient(scheme)
+	ca := &CertificateAuthority{Client: c, Reader: c, SecretName: "ca", Namespace: "system", Validity: time.Hour}
+	issued, err := ca.IssueDeviceCertificate(ctx, publicKey, "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := metav1.NewTime(issued.NotAfter)
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices"},
+		Spec: devicesv1alpha1.DeviceRegistrationSpec{
+			PublicKey:  base64.StdEncoding.EncodeToString(publicKey),
+			Quarantine: true,
+		},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:                   PhaseApproved,
+			DeviceUUID:              "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+			Certificate:             issued.ChainPEM,
+			CertificateSerialNumber: issued.SerialNumber,
+			CertificateNotAfter:     &notAfter,
+		},
+	}
+	if err := c.Create(ctx, dr); err != nil {
+		t.Fatal(err)
+	}
+	// Il fake client non salva lo status alla creazione.
+	dr.Status.Phase = PhaseApproved
+	dr.Status.DeviceUUID = "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a"
+	dr.Status.Certificate = issued.ChainPEM
+	dr.Status.CertificateSerialNumber = issued.SerialNumber
+	dr.Status.CertificateNotAfter = &notAfter
+	if err := c.Status().Update(ctx, dr); err != nil {
+		t.Fatal(err)
+	}
+	publisher := &RevocationPublisher{Client: c, Reader: c, CA: ca, ConfigMapName: "crl", Namespace: "system"}
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), CA: ca, Revocation: publisher}
+
+	key := types.NamespacedName{Name: "device", Namespace: "devices"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseQuarantined {
+		t.Fatalf("phase = %q, want %q", got.Status.Phase, PhaseQuarantined)
+	}
+
+	// Rilasciato dalla quarantena sul suo Device, il dispositivo riceve un nuovo certificato.
+	var device devicesv1alpha1.Device
+	if err := c.Get(ctx, types.NamespacedName{Name: got.Status.DeviceUUID, Namespace: "devices"}, &device); err != nil {
+		t.Fatal(err)
+	}
+	device.Spec.Quarantine = false
+	if err := c.Update(ctx, &device); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseApproved || got.Status.CertificateRevokedAt != nil {
+		t.Fatalf("phase = %q, certificateRevokedAt = %v, want Approved", got.Status.Phase, got.Status.CertificateRevokedAt)
+	}
+	if got.Status.CertificateSerialNumber == issued.SerialNumber {
+		t.Fatal("the quarantined certificate was not replaced")
+	}
+
+	// Il vecchio certificato resta revocato per compromissione della chiave anche dopo il rilascio.
+	if err := publisher.Publish(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "crl", Namespace: "system"}, cm); err != nil {
+		t.Fatal(err)
+	}
+	var revoked []RevokedCertificate
+	if err := json.Unmarshal([]byte(cm.Data[CRLRevokedKey]), &revoked); err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber != issued.SerialNumber || revoked[0].Reason != RevocationReasonQuarantined {
+		t.Fatalf("revoked = %+v, want only the quarantined certificate", revoked)
+	}
+	block, _ := pem.Decode([]byte(cm.Data[CRLPEMKey]))
+	if block == nil {
+		t.Fatal("crl.pem does not contain a PEM block")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].ReasonCode != 1 {
+		t.Fatalf("CRL entries = %+v, want one keyCompromise entry", crl.RevokedCertificateEntries)
+	}
+}
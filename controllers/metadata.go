@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+const (
+	// Label derivate da spec.metadata, per selezionare i dispositivi con kubectl get -l.
+	ModelLabel           = "devices.example.com/model"
+	SerialNumberLabel    = "devices.example.com/serial-number"
+	FirmwareVersionLabel = "devices.example.com/firmware-version"
+	// MACAddressLabel contiene l'indirizzo MAC senza separatori, perché i due punti non sono ammessi nelle label.
+	MACAddressLabel = "devices.example.com/mac-address"
+
+	// MetadataLabelPrefix è il prefisso con cui le label libere di spec.metadata.labels diventano label Kubernetes.
+	MetadataLabelPrefix = "labels.devices.example.com/"
+)
+
+// metadataLabels restituisce le label Kubernetes derivate dai metadati del dispositivo.
+// I metadati sono dichiarati dal dispositivo: i valori che non sono label valide vengono omessi.
+func metadataLabels(metadata *devicesv1alpha1.DeviceMetadata) map[string]string {
+	labels := map[string]string{}
+	if metadata == nil {
+		return labels
+	}
+	for key, value := range map[string]string{
+		ModelLabel:           metadata.Model,
+		SerialNumberLabel:    metadata.SerialNumber,
+		FirmwareVersionLabel: metadata.FirmwareVersion,
+		MACAddressLabel:      strings.ReplaceAll(metadata.MACAddress, ":", ""),
+	} {
+		if value != "" && len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+	for key, value := range metadata.Labels {
+		key = MetadataLabelPrefix + key
+		if len(validation.IsQualifiedName(key)) == 0 && len(validation.IsValidLabelValue(value)) == 0 {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+// isMetadataLabel indica se una label è gestita dall'operatore a partire da spec.metadata.
+func isMetadataLabel(key string) bool {
+	switch key {
+	case ModelLabel, SerialNumberLabel, FirmwareVersionLabel, MACAddressLabel:
+		return true
+	}
+	return strings.HasPrefix(key, MetadataLabelPrefix)
+}
+
+// ensureMetadataLabels allinea le label di una registrazione o di un Device ai suoi metadati:
+// aggiunge quelle mancanti e rimuove quelle che non corrispondono più ad alcun metadato.
+// Come ensureLabel, la patch ricarica l'oggetto dal server.
+func (r *DeviceRegistrationReconciler) ensureMetadataLabels(ctx context.Context, obj client.Object, metadata *devicesv1alpha1.DeviceMetadata) error {
+	desired := metadataLabels(metadata)
+	current := obj.GetLabels()
+	changed := false
+	for key := range current {
+		if _, ok := desired[key]; !ok && isMetadataLabel(key) {
+			changed = true
+		}
+	}
+	for key, value := range desired {
+		if current[key] != value {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	labels := map[string]string{}
+	for key, value := range current {
+		if !isMetadataLabel(key) {
+			labels[key] = value
+		}
+	}
+	for key, value := range desired {
+		labels[key] = value
+	}
+	obj.SetLabels(labels)
+	return r.Patch(ctx, obj, patch)
+}
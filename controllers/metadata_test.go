@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestMetadataLabels(t *testing.T) {
+	labels := metadataLabels(&devicesv1alpha1.DeviceMetadata{
+		Model:           "th-sensor-v2",
+		SerialNumber:    "SN 0042", // lo spazio non è ammesso in una label
+		FirmwareVersion: "1.4.2",
+		MACAddress:      "aa:bb:cc:00:11:22",
+		Labels: map[string]string{
+			"site":    "plant-3",
+			"note":    "installed near the north door",
+			"release": strings.Repeat("r", 64),
+		},
+	})
+	want := map[string]string{
+		ModelLabel:                   "th-sensor-v2",
+		FirmwareVersionLabel:         "1.4.2",
+		MACAddressLabel:              "aabbcc001122",
+		MetadataLabelPrefix + "site": "plant-3",
+	}
+	if len(labels) != len(want) {
+		t.Fatalf("metadataLabels() = %v, want %v", labels, want)
+	}
+	for key, value := range want {
+		if labels[key] != value {
+			t.Fatalf("metadataLabels()[%s] = %q, want %q", key, labels[key], value)
+		}
+	}
+
+	if labels := metadataLabels(nil); len(labels) != 0 {
+		t.Fatalf("metadataLabels(nil) = %v, want no labels", labels)
+	}
+}
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// Decisioni riportate nella metrica device_operator_registration_decisions_total.
+const (
+	DecisionApproved    = "approved"
+	DecisionRejected    = "rejected"
+	DecisionDeactivated = "deactivated"
+
+	// Motivi delle approvazioni e delle deattivazioni, che non hanno un valore in status.reason.
+	ReasonPairingOpen                = "PairingOpen"
+	ReasonApprovedByAdministrator    = "ApprovedByAdministrator"
+	ReasonDeactivatedByAdministrator = "DeactivatedByAdministrator"
+)
+
+// metricsCollectTimeout limita la lettura dalla cache eseguita a ogni scrape.
+const metricsCollectTimeout = 5 * time.Second
+
+// registrationPhases sono le fasi sempre riportate per ogni namespace, anche a zero,
+// così le serie non spariscono quando l'ultima registrazione cambia fase.
+var registrationPhases = []string{
+	PhasePending, PhaseApproved, PhaseRejected, PhaseDeactivated, PhaseSuspended, PhaseExpired, PhaseQuarantined, PhaseRetired,
+}
+
+var (
+	registrationDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "device_operator_registration_decisions_total",
+		Help: "Approvazioni, rifiuti e deattivazioni di DeviceRegistration, per namespace e motivo.",
+	}, []string{"namespace", "decision", "reason"})
+
+	registrationDecisionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "device_operator_registration_decision_duration_seconds",
+		Help:    "Tempo tra la creazione di una DeviceRegistration e la sua approvazione o il suo rifiuto.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+	}, []string{"decision"})
+
+	registrationsDesc = prometheus.NewDesc(
+		"device_operator_registrations",
+		"DeviceRegistration presenti nella cache dell'operatore, per namespace e fase.",
+		[]string{"namespace", "phase"}, nil)
+
+	pairingOpenDesc = prometheus.NewDesc(
+		"device_operator_pairing_open",
+		"1 se il pairing del namespace accetta nuove registrazioni, 0 altrimenti. Riportato solo per i namespace "+
+			"con una PairingPolicy o un ConfigMap device-pairing-config.",
+		[]string{"namespace"}, nil)
+)
+
+func init() {
+	metrics.Registry.MustRegister(registrationDecisions, registrationDecisionDuration)
+}
+
+// recordDecision aggiorna le metriche quando una registrazione cambia fase per una decisione.
+// previousPhase è la fase prima dell'aggiornamento: una registrazione rivalutata che resta
+// nella stessa fase non viene contata due volte.
+func recordDecision(dr *devicesv1alpha1.DeviceRegistration, previousPhase, decision, reason string) {
+	if previousPhase == dr.Status.Phase {
+		return
+	}
+	registrationDecisions.WithLabelValues(dr.Namespace, decision, reason).Inc()
+	if decision == DecisionDeactivated || dr.CreationTimestamp.IsZero() {
+		return
+	}
+	registrationDecisionDuration.WithLabelValues(decision).Observe(time.Since(dr.CreationTimestamp.Time).Seconds())
+}
+
+// lifecycleCollector calcola a ogni scrape il numero di registrazioni per fase e lo stato del pairing
+// di ogni namespace, leggendo dalla cache del manager senza interrogare l'API server.
+type lifecycleCollector struct {
+	reader client.Reader
+}
+
+// registerLifecycleCollector registra il collector nel registry delle metriche di controller-runtime.
+func registerLifecycleCollector(mgr ctrl.Manager) error {
+	return metrics.Registry.Register(&lifecycleCollector{reader: mgr.GetClient()})
+}
+
+func (c *lifecycleCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- registrationsDesc
+	ch <- pairingOpenDesc
+}
+
+func (c *lifecycleCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), metricsCollectTimeout)
+	defer cancel()
+	logger := ctrl.Log.WithName("metrics")
+
+	var registrations devicesv1alpha1.DeviceRegistrationList
+	if err := c.reader.List(ctx, &registrations); err != nil {
+		logger.Error(err, "Impossibile elencare le DeviceRegistration per le metriche")
+	} else {
+		for namespace, phases := range countRegistrationsByPhase(registrations.Items) {
+			for phase, count := range phases {
+				ch <- prometheus.MustNewConstMetric(registrationsDesc, prometheus.GaugeValue, float64(count), namespace, phase)
+			}
+		}
+	}
+
+	var policies devicesv1alpha1.PairingPolicyList
+	if err := c.reader.List(ctx, &policies); err != nil {
+		logger.Error(err, "Impossibile elencare le PairingPolicy per le metriche")
+		return
+	}
+	var configMaps corev1.ConfigMapList
+	if err := c.reader.List(ctx, &configMaps); err != nil {
+		logger.Error(err, "Impossibile elencare i ConfigMap di pairing per le metriche")
+		return
+	}
+	for namespace, open := range pairingOpenByNamespace(policies.Items, configMaps.Items, time.Now()) {
+		value := 0.0
+		if open {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(pairingOpenDesc, prometheus.GaugeValue, value, namespace)
+	}
+}
+
+// countRegistrationsByPhase conta le registrazioni per namespace e fase. Una registrazione
+// non ancora elaborata, senza fase, viene contata come Pending.
+func countRegistrationsByPhase(items []devicesv1alpha1.DeviceRegistration) map[string]map[string]int {
+	counts := map[string]map[string]int{}
+	for i := range items {
+		dr := &items[i]
+		phases, ok := counts[dr.Namespace]
+		if !ok {
+			phases = map[string]int{}
+			for _, phase := range registrationPhases {
+				phases[phase] = 0
+			}
+			counts[dr.Namespace] = phases
+		}
+		phase := dr.Status.Phase
+		if phase == "" {
+			phase = PhasePending
+		}
+		phases[phase]++
+	}
+	return counts
+}
+
+// pairingOpenByNamespace indica, per ogni namespace con una configurazione di pairing, se all'istante now
+// il pairing accetta nuove registrazioni. Segue le stesse regole di resolvePairingPolicy: la PairingPolicy
+// in vigore ha la precedenza sul ConfigMap, e un ConfigMap non valido equivale a pairing chiuso.
+func pairingOpenByNamespace(policies []devicesv1alpha1.PairingPolicy, configMaps []corev1.ConfigMap, now time.Time) map[string]bool {
+	byNamespace := map[string][]devicesv1alpha1.PairingPolicy{}
+	for _, policy := range policies {
+		byNamespace[policy.Namespace] = append(byNamespace[policy.Namespace], policy)
+	}
+
+	open := map[string]bool{}
+	for namespace, items := range byNamespace {
+		// Le policy in cancellazione non sono in vigore: in quel caso decide il ConfigMap.
+		if policy := activePairingPolicy(items); policy != nil {
+			admitted, _ := policyPairingConfig(policy, now).admits(now)
+			open[namespace] = admitted
+		}
+	}
+	for i := range configMaps {
+		cm := &configMaps[i]
+		if cm.Name != PairingConfigMapName {
+			continue
+		}
+		if _, hasPolicy := open[cm.Namespace]; hasPolicy {
+			continue
+		}
+		config, err := parsePairingConfig(cm.Data)
+		admitted, _ := config.admits(now)
+		open[cm.Namespace] = err == nil && admitted
+	}
+	return open
+}
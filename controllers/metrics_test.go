@@ -0,0 +1,79 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestCountRegistrationsByPhase(t *testing.T) {
+	items := []devicesv1alpha1.DeviceRegistration{
+		{ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "devices"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "approved-1", Namespace: "devices"}, Status: devicesv1alpha1.DeviceRegistrationStatus{Phase: PhaseApproved}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "approved-2", Namespace: "devices"}, Status: devicesv1alpha1.DeviceRegistrationStatus{Phase: PhaseApproved}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "rejected", Namespace: "lab"}, Status: devicesv1alpha1.DeviceRegistrationStatus{Phase: PhaseRejected}},
+	}
+
+	counts := countRegistrationsByPhase(items)
+	if got := counts["devices"][PhasePending]; got != 1 {
+		t.Fatalf("a registration without a phase must be counted as Pending, got %d", got)
+	}
+	if got := counts["devices"][PhaseApproved]; got != 2 {
+		t.Fatalf("approved in devices = %d, want 2", got)
+	}
+	if got, ok := counts["lab"][PhaseApproved]; !ok || got != 0 {
+		t.Fatalf("every phase must be reported for a namespace, got %d (present: %v)", got, ok)
+	}
+}
+
+func TestPairingOpenByNamespace(t *testing.T) {
+	now := time.Date(2025, 6, 1, 9, 0, 0, 0, time.UTC)
+	policies := []devicesv1alpha1.PairingPolicy{
+		{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "policy-open"}, Spec: devicesv1alpha1.PairingPolicySpec{Enabled: true}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "policy-closed"}},
+	}
+	configMaps := []corev1.ConfigMap{
+		// Nel namespace con una PairingPolicy il ConfigMap viene ignorato.
+		{ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "policy-closed"}, Data: map[string]string{PairingEnabledKey: "true"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "legacy-open"}, Data: map[string]string{PairingEnabledKey: "true"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "legacy-invalid"}, Data: map[string]string{PairingEnabledKey: "true", PairingDurationKey: "soon"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "unrelated", Namespace: "other"}, Data: map[string]string{PairingEnabledKey: "true"}},
+	}
+
+	want := map[string]bool{
+		"policy-open":    true,
+		"policy-closed":  false,
+		"legacy-open":    true,
+		"legacy-invalid": false,
+	}
+	got := pairingOpenByNamespace(policies, configMaps, now)
+	if len(got) != len(want) {
+		t.Fatalf("pairingOpenByNamespace() = %v, want %v", got, want)
+	}
+	for namespace, open := range want {
+		if got[namespace] != open {
+			t.Errorf("namespace %s: open = %v, want %v", namespace, got[namespace], open)
+		}
+	}
+}
+
+func TestRecordDecisionCountsPhaseChangesOnce(t *testing.T) {
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "metrics-test", CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Minute))},
+		Status:     devicesv1alpha1.DeviceRegistrationStatus{Phase: PhaseRejected},
+	}
+	counter := registrationDecisions.WithLabelValues("metrics-test", DecisionRejected, ReasonPairingDisabled)
+
+	recordDecision(dr, PhasePending, DecisionRejected, ReasonPairingDisabled)
+	// Una richiesta rivalutata e rifiutata di nuovo non è una nuova decisione.
+	recordDecision(dr, PhaseRejected, DecisionRejected, ReasonPairingDisabled)
+
+	if got := testutil.ToFloat64(counter); got != 1 {
+		t.Fatalf("rejections counted = %v, want 1", got)
+	}
+}
@@ -0,0 +1,362 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+const (
+	// PairingModeAuto approva automaticamente le richieste finché il pairing è attivo.
+	PairingModeAuto = "auto"
+	// PairingModeManual lascia le richieste in Pending finché un amministratore non le approva.
+	PairingModeManual = "manual"
+
+	// Chiavi del ConfigMap device-pairing-config.
+	PairingEnabledKey        = "enabled"
+	PairingModeKey           = "mode"
+	PairingOpenedAtKey       = "openedAt"
+	PairingDurationKey       = "duration"
+	PairingNotBeforeKey      = "notBefore"
+	PairingNotAfterKey       = "notAfter"
+	PairingMaxEnrollmentsKey = "maxEnrollments"
+	// PairingEnrollmentsKey è il contatore, gestito dall'operatore, dei dispositivi approvati nella finestra corrente.
+	PairingEnrollmentsKey = "enrollments"
+	// PairingCountedKey elenca, separati da virgole, gli UID delle registrazioni conteggiate più di recente.
+	PairingCountedKey = "countedRegistrations"
+	// PairingClosedAtKey e PairingClosedReasonKey vengono scritti dall'operatore quando chiude la finestra.
+	PairingClosedAtKey     = "closedAt"
+	PairingClosedReasonKey = "closedReason"
+
+	// maxCountedRegistrations limita gli UID ricordati per rendere idempotente il conteggio: basta coprire
+	// le riconciliazioni ripetute di una stessa richiesta, che avvengono subito dopo il conteggio.
+	maxCountedRegistrations = 100
+)
+
+// pairingConfig è la configurazione del pairing in vigore in un namespace, risolta da una PairingPolicy
+// oppure, in sua assenza, dal ConfigMap device-pairing-config.
+type pairingConfig struct {
+	// Policy è il nome della PairingPolicy da cui deriva la configurazione; vuoto per il ConfigMap.
+	Policy string
+	// ActiveWindow è il nome della finestra della PairingPolicy aperta in questo momento.
+	ActiveWindow string
+
+	// Enabled corrisponde alla chiave "enabled": solo il valore "true" abilita il pairing.
+	Enabled bool
+	// Mode corrisponde alla chiave "mode" (auto o manual). Se assente viene usato auto.
+	Mode string
+
+	// NotBefore e NotAfter delimitano la finestra di pairing. Derivano da notBefore/notAfter
+	// oppure da openedAt/duration; se nil la finestra non ha limiti da quel lato.
+	NotBefore *time.Time
+	NotAfter  *time.Time
+
+	// MaxEnrollments è il numero massimo di dispositivi approvabili nella finestra (0 = nessun limite).
+	MaxEnrollments int
+	// Enrollments è il numero di dispositivi già approvati nella finestra corrente.
+	Enrollments int
+
+	// MaxTotalEnrollments e TotalEnrollments sono la quota complessiva della PairingPolicy e il suo utilizzo.
+	MaxTotalEnrollments int
+	TotalEnrollments    int
+
+	// AllowedKeyAlgorithms e AllowedKeyFingerprints, se non vuoti, restringono le chiavi ammesse.
+	AllowedKeyAlgorithms   []string
+	AllowedKeyFingerprints []string
+}
+
+// admits indica se la configurazione consente nuove registrazioni all'istante now.
+// Se no, restituisce anche la spiegazione da riportare nello status della richiesta.
+func (c pairingConfig) admits(now time.Time) (bool, string) {
+	switch {
+	case !c.Enabled:
+		return false, "Pairing mode is not enabled."
+	case c.NotBefore != nil && now.Before(*c.NotBefore):
+		return false, fmt.Sprintf("Pairing window opens at %s.", c.NotBefore.Format(time.RFC3339))
+	case c.NotAfter != nil && !now.Before(*c.NotAfter):
+		return false, fmt.Sprintf("Pairing window closed at %s.", c.NotAfter.Format(time.RFC3339))
+	case c.MaxEnrollments > 0 && c.Enrollments >= c.MaxEnrollments:
+		return false, fmt.Sprintf("Pairing window closed: the maximum of %d enrollments has been reached.", c.MaxEnrollments)
+	case c.MaxTotalEnrollments > 0 && c.TotalEnrollments >= c.MaxTotalEnrollments:
+		return false, fmt.Sprintf("Pairing policy %s has admitted its maximum of %d devices.", c.Policy, c.MaxTotalEnrollments)
+	}
+	return true, ""
+}
+
+// admitsKey indica se la chiave rispetta le restrizioni su algoritmo e allowlist della configurazione.
+func (c pairingConfig) admitsKey(key *publicKeyInfo) (bool, string) {
+	if len(c.AllowedKeyAlgorithms) > 0 && !slices.Contains(c.AllowedKeyAlgorithms, key.Algorithm) {
+		return false, fmt.Sprintf("Key algorithm %s is not allowed by pairing policy %s.", key.Algorithm, c.Policy)
+	}
+	if len(c.AllowedKeyFingerprints) > 0 && !slices.Contains(c.AllowedKeyFingerprints, key.Fingerprint) {
+		return false, fmt.Sprintf("Public key is not in the allowlist of pairing policy %s.", c.Policy)
+	}
+	return true, ""
+}
+
+// loadPairingConfigMap legge il ConfigMap di pairing del namespace.
+// Un ConfigMap o una chiave mancante equivalgono a pairing disabilitato.
+func (r *DeviceRegistrationReconciler) loadPairingConfigMap(ctx context.Context, namespace string) (pairingConfig, error) {
+	cm := &corev1.ConfigMap{}
+	err := r.Get(ctx, types.NamespacedName{Name: PairingConfigMapName, Namespace: namespace}, cm)
+	if err != nil {
+		// Se il ConfigMap non esiste, consideriamo il pairing disabilitato per sicurezza.
+		if apierrors.IsNotFound(err) {
+			r.Log.Info("ConfigMap di pairing non trovato, si presume disabilitato", "configMap", PairingConfigMapName)
+			return pairingConfig{Mode: PairingModeAuto}, nil
+		}
+		// Per altri errori, restituiamo l'errore.
+		return pairingConfig{}, fmt.Errorf("impossibile ottenere il ConfigMap di pairing: %w", err)
+	}
+
+	if _, ok := cm.Data[PairingEnabledKey]; !ok {
+		// Se la chiave 'enabled' non è presente, consideriamo disabilitato.
+		r.Log.Info("Chiave 'enabled' non trovata nel ConfigMap, si presume disabilitato", "configMap", PairingConfigMapName)
+	}
+	config, err := parsePairingConfig(cm.Data)
+	if err != nil {
+		// Una finestra scritta male non deve lasciare il pairing aperto senza limiti.
+		r.Log.Info("Configurazione di pairing non valida, si presume disabilitato", "configMap", PairingConfigMapName, "error", err.Error())
+		config.Enabled = false
+	}
+	return config, nil
+}
+
+// parsePairingConfig interpreta i dati del ConfigMap di pairing.
+// In caso di errore restituisce comunque la parte di configurazione già letta.
+func parsePairingConfig(data map[string]string) (pairingConfig, error) {
+	config := pairingConfig{
+		Enabled: data[PairingEnabledKey] == "true",
+		Mode:    PairingModeAuto,
+	}
+
+	switch mode := data[PairingModeKey]; mode {
+	case "", PairingModeAuto:
+	case PairingModeManual:
+		config.Mode = PairingModeManual
+	default:
+		// Un valore sconosciuto non deve aprire l'approvazione automatica: ripieghiamo sulla modalità più restrittiva.
+		config.Mode = PairingModeManual
+		return config, fmt.Errorf("invalid %s %q: must be %s or %s", PairingModeKey, mode, PairingModeAuto, PairingModeManual)
+	}
+
+	var err error
+	if config.NotBefore, err = parsePairingTime(data, PairingNotBeforeKey); err != nil {
+		return config, err
+	}
+	if config.NotAfter, err = parsePairingTime(data, PairingNotAfterKey); err != nil {
+		return config, err
+	}
+	openedAt, err := parsePairingTime(data, PairingOpenedAtKey)
+	if err != nil {
+		return config, err
+	}
+	if raw := data[PairingDurationKey]; raw != "" {
+		if openedAt == nil {
+			return config, fmt.Errorf("%s requires %s", PairingDurationKey, PairingOpenedAtKey)
+		}
+		duration, err := time.ParseDuration(raw)
+		if err != nil || duration <= 0 {
+			return config, fmt.Errorf("invalid %s %q: must be a positive duration such as 30m or 2h", PairingDurationKey, raw)
+		}
+		end := openedAt.Add(duration)
+		// Se sono presenti entrambe le forme vale la finestra più stretta.
+		if config.NotAfter == nil || end.Before(*config.NotAfter) {
+			config.NotAfter = &end
+		}
+	}
+	if openedAt != nil && (config.NotBefore == nil || openedAt.After(*config.NotBefore)) {
+		config.NotBefore = openedAt
+	}
+
+	if config.MaxEnrollments, err = parsePairingCounter(data, PairingMaxEnrollmentsKey); err != nil {
+		return config, err
+	}
+	if config.Enrollments, err = parsePairingCounter(data, PairingEnrollmentsKey); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+func parsePairingTime(data map[string]string, key string) (*time.Time, error) {
+	raw := data[key]
+	if raw == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: must be an RFC3339 timestamp", key, raw)
+	}
+	return &t, nil
+}
+
+func parsePairingCounter(data map[string]string, key string) (int, error) {
+	raw := data[key]
+	if raw == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a non-negative integer", key, raw)
+	}
+	return n, nil
+}
+
+// countPairingEnrollment conteggia l'approvazione della registrazione uid nella configurazione di pairing da cui deriva config.
+// Con enforceLimit il contatore non supera i limiti e il risultato indica se c'era ancora posto;
+// senza, l'approvazione viene solo conteggiata (decisioni manuali dell'amministratore).
+// L'aggiornamento usa la resourceVersion letta, quindi due approvazioni concorrenti non possono occupare lo stesso posto.
+// Il conteggio è idempotente: una registrazione già conteggiata, ad esempio perché il salvataggio del suo status
+// è fallito dopo il conteggio, risulta ammessa senza occupare un secondo posto.
+func (r *DeviceRegistrationReconciler) countPairingEnrollment(ctx context.Context, namespace string, uid types.UID, config pairingConfig, enforceLimit bool) (bool, error) {
+	if config.Policy != "" {
+		return r.countPolicyEnrollment(ctx, types.NamespacedName{Name: config.Policy, Namespace: namespace}, uid, enforceLimit)
+	}
+
+	admitted := false
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		cm := &corev1.ConfigMap{}
+		if err := r.Get(ctx, types.NamespacedName{Name: PairingConfigMapName, Namespace: namespace}, cm); err != nil {
+			if apierrors.IsNotFound(err) {
+				// Senza ConfigMap non c'è alcuna finestra da conteggiare.
+				admitted = !enforceLimit
+				return nil
+			}
+			return err
+		}
+		counted := splitCountedRegistrations(cm.Data[PairingCountedKey])
+		if slices.Contains(counted, string(uid)) {
+			admitted = true
+			return nil
+		}
+		config, err := parsePairingConfig(cm.Data)
+		if err != nil {
+			// Con una configurazione non valida il pairing è chiuso e il contatore non è affidabile.
+			admitted = !enforceLimit
+			return nil
+		}
+		if enforceLimit && config.MaxEnrollments > 0 && config.Enrollments >= config.MaxEnrollments {
+			admitted = false
+			return nil
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[PairingEnrollmentsKey] = strconv.Itoa(config.Enrollments + 1)
+		cm.Data[PairingCountedKey] = strings.Join(appendCountedRegistration(counted, uid), ",")
+		admitted = true
+		return r.Update(ctx, cm)
+	})
+	if err != nil {
+		return false, fmt.Errorf("impossibile aggiornare il contatore delle registrazioni: %w", err)
+	}
+	return admitted, nil
+}
+
+// splitCountedRegistrations legge l'elenco degli UID conteggiati dal ConfigMap di pairing.
+func splitCountedRegistrations(raw string) []string {
+	if raw == "" {
+		return nil
+	}
+	return strings.Split(raw, ",")
+}
+
+// appendCountedRegistration aggiunge uid agli UID conteggiati, tenendo solo i più recenti.
+func appendCountedRegistration(counted []string, uid types.UID) []string {
+	counted = append(counted, string(uid))
+	if len(counted) > maxCountedRegistrations {
+		counted = counted[len(counted)-maxCountedRegistrations:]
+	}
+	return counted
+}
+
+// isPairingConfigMap seleziona i ConfigMap di pairing tra tutti quelli osservati dal manager.
+var isPairingConfigMap = predicate.NewPredicateFuncs(func(obj client.Object) bool {
+	return obj.GetName() == PairingConfigMapName
+})
+
+// pairingConfigChanged filtra gli aggiornamenti del ConfigMap di pairing che possono cambiare l'esito di una richiesta.
+// I contatori scritti dall'operatore a ogni approvazione vengono ignorati: altrimenti ogni approvazione
+// riconcilierebbe di nuovo tutte le richieste in attesa. La chiusura della finestra al raggiungimento
+// di maxEnrollments modifica enabled e viene quindi osservata.
+var pairingConfigChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldCM, okOld := e.ObjectOld.(*corev1.ConfigMap)
+		newCM, okNew := e.ObjectNew.(*corev1.ConfigMap)
+		if !okOld || !okNew {
+			return true
+		}
+		return !maps.Equal(withoutPairingCounters(oldCM.Data), withoutPairingCounters(newCM.Data))
+	},
+}
+
+// withoutPairingCounters restituisce una copia di data senza i contatori gestiti dall'operatore.
+func withoutPairingCounters(data map[string]string) map[string]string {
+	filtered := maps.Clone(data)
+	delete(filtered, PairingEnrollmentsKey)
+	delete(filtered, PairingCountedKey)
+	return filtered
+}
+
+// pairingPolicyChanged filtra gli aggiornamenti delle PairingPolicy che possono cambiare l'esito di una richiesta:
+// modifiche allo spec, apertura o chiusura di una finestra, cambio della condizione Active.
+// Il solo incremento dei contatori di approvazione viene ignorato.
+var pairingPolicyChanged = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldPolicy, okOld := e.ObjectOld.(*devicesv1alpha1.PairingPolicy)
+		newPolicy, okNew := e.ObjectNew.(*devicesv1alpha1.PairingPolicy)
+		if !okOld || !okNew {
+			return true
+		}
+		if oldPolicy.Generation != newPolicy.Generation || oldPolicy.Status.ActiveWindow != newPolicy.Status.ActiveWindow {
+			return true
+		}
+		return meta.IsStatusConditionTrue(oldPolicy.Status.Conditions, ConditionPolicyActive) !=
+			meta.IsStatusConditionTrue(newPolicy.Status.Conditions, ConditionPolicyActive)
+	},
+}
+
+// registrationsForPairingChange mappa una modifica della configurazione di pairing di un namespace
+// sulle registrazioni che ne dipendono: quelle ancora da decidere e, se ReevaluatePairingRejections
+// è attivo, quelle rifiutate perché il pairing era chiuso.
+func (r *DeviceRegistrationReconciler) registrationsForPairingChange(ctx context.Context, obj client.Object) []reconcile.Request {
+	var registrations devicesv1alpha1.DeviceRegistrationList
+	if err := r.List(ctx, &registrations, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Log.Error(err, "Impossibile elencare le registrazioni da rivalutare", "namespace", obj.GetNamespace())
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range registrations.Items {
+		if r.dependsOnPairing(&registrations.Items[i]) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&registrations.Items[i])})
+		}
+	}
+	return requests
+}
+
+// dependsOnPairing indica se l'esito della registrazione può cambiare con la configurazione di pairing.
+func (r *DeviceRegistrationReconciler) dependsOnPairing(dr *devicesv1alpha1.DeviceRegistration) bool {
+	switch dr.Status.Phase {
+	case "", PhasePending:
+		return true
+	case PhaseRejected:
+		return r.ReevaluatePairingRejections && dr.Status.Reason == ReasonPairingDisabled
+	}
+	return false
+}
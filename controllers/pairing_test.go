@@ -0,0 +1,408 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestPairingWindowAdmission(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		data     map[string]string
+		admitted bool
+		invalid  bool
+	}{
+		{name: "legacy switch on", data: map[string]string{"enabled": "true"}, admitted: true},
+		{name: "legacy switch off", data: map[string]string{"enabled": "false"}},
+		{name: "missing enabled key", data: map[string]string{}},
+		{
+			name:     "inside openedAt and duration",
+			data:     map[string]string{"enabled": "true", "openedAt": "2025-06-01T11:30:00Z", "duration": "1h"},
+			admitted: true,
+		},
+		{
+			name: "after openedAt and duration",
+			data: map[string]string{"enabled": "true", "openedAt": "2025-06-01T10:00:00Z", "duration": "1h"},
+		},
+		{
+			name: "before notBefore",
+			data: map[string]string{"enabled": "true", "notBefore": "2025-06-01T13:00:00Z"},
+		},
+		{
+			name: "at notAfter",
+			data: map[string]string{"enabled": "true", "notAfter": "2025-06-01T12:00:00Z"},
+		},
+		{
+			name:     "between notBefore and notAfter",
+			data:     map[string]string{"enabled": "true", "notBefore": "2025-06-01T11:00:00Z", "notAfter": "2025-06-01T13:00:00Z"},
+			admitted: true,
+		},
+		{
+			name: "narrowest window wins",
+			data: map[string]string{"enabled": "true", "notAfter": "2025-06-02T00:00:00Z", "openedAt": "2025-06-01T11:00:00Z", "duration": "30m"},
+		},
+		{
+			name:     "below max enrollments",
+			data:     map[string]string{"enabled": "true", "maxEnrollments": "3", "enrollments": "2"},
+			admitted: true,
+		},
+		{
+			name: "max enrollments reached",
+			data: map[string]string{"enabled": "true", "maxEnrollments": "3", "enrollments": "3"},
+		},
+		{
+			name:    "duration without openedAt",
+			data:    map[string]string{"enabled": "true", "duration": "1h"},
+			invalid: true,
+		},
+		{
+			name:    "malformed timestamp",
+			data:    map[string]string{"enabled": "true", "notAfter": "tomorrow"},
+			invalid: true,
+		},
+		{
+			name:    "negative max enrollments",
+			data:    map[string]string{"enabled": "true", "maxEnrollments": "-1"},
+			invalid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parsePairingConfig(tt.data)
+			if (err != nil) != tt.invalid {
+				t.Fatalf("parsePairingConfig() error = %v, invalid = %v", err, tt.invalid)
+			}
+			if tt.invalid {
+				return
+			}
+			admitted, why := config.admits(now)
+			if admitted != tt.admitted {
+				t.Fatalf("admits() = %v (%s), want %v", admitted, why, tt.admitted)
+			}
+			if !admitted && why == "" {
+				t.Fatal("a closed window must explain why")
+			}
+		})
+	}
+}
+
+func TestUnknownPairingModeFallsBackToManual(t *testing.T) {
+	config, err := parsePairingConfig(map[string]string{"enabled": "true", "mode": "automatic"})
+	if err == nil {
+		t.Fatal("expected an error for an unknown mode")
+	}
+	if config.Mode != PairingModeManual {
+		t.Fatalf("unknown mode must fall back to %s, got %s", PairingModeManual, config.Mode)
+	}
+}
+
+func TestEnrollmentIsCountedOncePerRegistration(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	maxEnrollments := int32(2)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true", PairingMaxEnrollmentsKey: "2"},
+	}
+	policy := &devicesv1alpha1.PairingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "policies"},
+		Spec: devicesv1alpha1.PairingPolicySpec{
+			Enabled:        true,
+			MaxEnrollments: &maxEnrollments,
+		},
+	}
+	c := lifecycleTestClient(scheme, cm, policy)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+	tests := []struct {
+		name      string
+		namespace string
+		config    pairingConfig
+		counted   func() int
+	}{
+		{
+			name:      "configmap",
+			namespace: "devices",
+			counted: func() int {
+				var got corev1.ConfigMap
+				if err := c.Get(ctx, types.NamespacedName{Name: PairingConfigMapName, Namespace: "devices"}, &got); err != nil {
+					t.Fatal(err)
+				}
+				config, err := parsePairingConfig(got.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return config.Enrollments
+			},
+		},
+		{
+			name:      "policy",
+			namespace: "policies",
+			config:    pairingConfig{Policy: "default"},
+			counted: func() int {
+				var got devicesv1alpha1.PairingPolicy
+				if err := c.Get(ctx, types.NamespacedName{Name: "default", Namespace: "policies"}, &got); err != nil {
+					t.Fatal(err)
+				}
+				return int(got.Status.AdmittedCount)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Una riconciliazione ripetuta dopo un salvataggio fallito non occupa un secondo posto.
+			for i := 0; i < 2; i++ {
+				admitted, err := r.countPairingEnrollment(ctx, tt.namespace, "first", tt.config, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !admitted {
+					t.Fatalf("attempt %d: first registration not admitted", i+1)
+				}
+			}
+			if got := tt.counted(); got != 1 {
+				t.Fatalf("enrollments = %d after counting the same registration twice, want 1", got)
+			}
+
+			// Il posto rimasto resta disponibile per un'altra registrazione, poi la quota è esaurita.
+			for _, uid := range []types.UID{"second", "third"} {
+				admitted, err := r.countPairingEnrollment(ctx, tt.namespace, uid, tt.config, true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if admitted != (uid == "second") {
+					t.Fatalf("registration %s admitted = %t", uid, admitted)
+				}
+			}
+			if got := tt.counted(); got != 2 {
+				t.Fatalf("enrollments = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestDependsOnPairing(t *testing.T) {
+	tests := []struct {
+		name       string
+		phase      string
+		reason     string
+		reevaluate bool
+		want       bool
+	}{
+		{name: "new request", want: true},
+		{name: "pending", phase: PhasePending, want: true},
+		{name: "approved", phase: PhaseApproved},
+		{name: "rejected while pairing was closed", phase: PhaseRejected, reason: ReasonPairingDisabled},
+		{name: "rejected while pairing was closed, re-evaluated", phase: PhaseRejected, reason: ReasonPairingDisabled, reevaluate: true, want: true},
+		{name: "rejected by an administrator, re-evaluated", phase: PhaseRejected, reason: ReasonRejectedByAdministrator, reevaluate: true},
+		{name: "deactivated, re-evaluated", phase: PhaseDeactivated, reevaluate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DeviceRegistrationReconciler{ReevaluatePairingRejections: tt.reevaluate}
+			dr := &devicesv1alpha1.DeviceRegistration{
+				Status: devicesv1alpha1.DeviceRegistrationStatus{Phase: tt.phase, Reason: tt.reason},
+			}
+			if got := r.dependsOnPairing(dr); got != tt.want {
+				t.Fatalf("dependsOnPairing() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistrationsForPairingChange(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	registration := func(name, namespace, phase, reason string) *devicesv1alpha1.DeviceRegistration {
+		return &devicesv1alpha1.DeviceRegistration{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Status:     devicesv1alpha1.DeviceRegistrationStatus{Phase: phase, Reason: reason},
+		}
+	}
+	c := lifecycleTestClient(scheme,
+		registration("new", "devices", "", ""),
+		registration("pending", "devices", PhasePending, ReasonAwaitingApproval),
+		registration("approved", "devices", PhaseApproved, ""),
+		registration("closed", "devices", PhaseRejected, ReasonPairingDisabled),
+		registration("invalid", "devices", PhaseRejected, ReasonInvalidPublicKey),
+		registration("elsewhere", "other", PhasePending, ""),
+	)
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"}}
+
+	tests := []struct {
+		name       string
+		reevaluate bool
+		want       []string
+	}{
+		{name: "pending requests only", want: []string{"new", "pending"}},
+		{name: "with re-evaluation of rejections", reevaluate: true, want: []string{"closed", "new", "pending"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), ReevaluatePairingRejections: tt.reevaluate}
+			var got []string
+			for _, req := range r.registrationsForPairingChange(ctx, cm) {
+				if req.Namespace != "devices" {
+					t.Fatalf("request %s is outside the namespace of the pairing configuration", req.NamespacedName)
+				}
+				got = append(got, req.Name)
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("registrationsForPairingChange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPairingPolicyChanged(t *testing.T) {
+	base := &devicesv1alpha1.PairingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "devices", Generation: 1},
+		Status: devicesv1alpha1.PairingPolicyStatus{
+			ActiveWindow: "morning",
+			Conditions:   []metav1.Condition{{Type: ConditionPolicyActive, Status: metav1.ConditionTrue, Reason: ReasonPolicyOpen}},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		update func(*devicesv1alpha1.PairingPolicy)
+		want   bool
+	}{
+		{name: "spec changed", update: func(p *devicesv1alpha1.PairingPolicy) { p.Generation++ }, want: true},
+		{name: "window changed", update: func(p *devicesv1alpha1.PairingPolicy) { p.Status.ActiveWindow = "afternoon" }, want: true},
+		{
+			name: "policy closed",
+			update: func(p *devicesv1alpha1.PairingPolicy) {
+				p.Status.Conditions[0].Status = metav1.ConditionFalse
+				p.Status.Conditions[0].Reason = ReasonPolicyClosed
+			},
+			want: true,
+		},
+		{
+			name: "enrollment counted",
+			update: func(p *devicesv1alpha1.PairingPolicy) {
+				p.Status.AdmittedCount++
+				p.Status.LastAdmissionTime = &metav1.Time{Time: time.Now()}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := base.DeepCopy()
+			tt.update(updated)
+			if got := pairingPolicyChanged.Update(event.UpdateEvent{ObjectOld: base, ObjectNew: updated}); got != tt.want {
+				t.Fatalf("pairingPolicyChanged.Update() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPairingConfigChanged(t *testing.T) {
+	base := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true", PairingMaxEnrollmentsKey: "2", PairingEnrollmentsKey: "0"},
+	}
+
+	tests := []struct {
+		name   string
+		update func(*corev1.ConfigMap)
+		want   bool
+	}{
+		{name: "pairing disabled", update: func(cm *corev1.ConfigMap) { cm.Data[PairingEnabledKey] = "false" }, want: true},
+		{name: "limit raised", update: func(cm *corev1.ConfigMap) { cm.Data[PairingMaxEnrollmentsKey] = "5" }, want: true},
+		{
+			name: "enrollment counted",
+			update: func(cm *corev1.ConfigMap) {
+				cm.Data[PairingEnrollmentsKey] = "1"
+				cm.Data[PairingCountedKey] = "uid-a"
+			},
+		},
+		{
+			name: "window closed",
+			update: func(cm *corev1.ConfigMap) {
+				cm.Data[PairingEnabledKey] = "false"
+				cm.Data[PairingClosedReasonKey] = PairingClosedMaxEnrollmentsReached
+				delete(cm.Data, PairingEnrollmentsKey)
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := base.DeepCopy()
+			tt.update(updated)
+			if got := pairingConfigChanged.Update(event.UpdateEvent{ObjectOld: base, ObjectNew: updated}); got != tt.want {
+				t.Fatalf("pairingConfigChanged.Update() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRejectionBeforeNotBeforeIsReevaluatedWhenTheWindowOpens(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices", Generation: 1},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: base64.StdEncoding.EncodeToString(publicKey)},
+	}
+	notBefore := time.Now().Add(time.Hour)
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true", PairingNotBeforeKey: notBefore.Format(time.RFC3339)},
+	}
+
+	tests := []struct {
+		name       string
+		reevaluate bool
+		requeue    bool
+	}{
+		{name: "rejections are final"},
+		{name: "rejections are re-evaluated", reevaluate: true, requeue: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := lifecycleTestClient(scheme, dr.DeepCopy(), cm.DeepCopy())
+			r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), ReevaluatePairingRejections: tt.reevaluate}
+			key := types.NamespacedName{Name: "device", Namespace: "devices"}
+			// La seconda riconciliazione rivaluta la richiesta già rifiutata e deve mantenere la riprogrammazione.
+			for i := 0; i < 2; i++ {
+				result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key})
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got devicesv1alpha1.DeviceRegistration
+				if err := c.Get(ctx, key, &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Status.Phase != PhaseRejected || got.Status.Reason != ReasonPairingDisabled {
+					t.Fatalf("phase = %q, reason = %q, want Rejected with reason %s", got.Status.Phase, got.Status.Reason, ReasonPairingDisabled)
+				}
+				if requeued := result.RequeueAfter > 0 && result.RequeueAfter <= time.Hour; requeued != tt.requeue {
+					t.Fatalf("reconcile %d: RequeueAfter = %s, want a requeue at notBefore: %t", i+1, result.RequeueAfter, tt.requeue)
+				}
+			}
+		})
+	}
+}
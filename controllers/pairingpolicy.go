@@ -0,0 +1,201 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// ReasonKeyNotAllowed indica che la chiave non rispetta le restrizioni della PairingPolicy.
+const ReasonKeyNotAllowed = "KeyNotAllowed"
+
+// resolvePairingPolicy restituisce la configurazione di pairing del namespace: quella della PairingPolicy
+// in vigore, se esiste, altrimenti quella del ConfigMap device-pairing-config (legacy).
+func (r *DeviceRegistrationReconciler) resolvePairingPolicy(ctx context.Context, namespace string) (pairingConfig, error) {
+	var policies devicesv1alpha1.PairingPolicyList
+	if err := r.List(ctx, &policies, client.InNamespace(namespace)); err != nil {
+		return pairingConfig{}, fmt.Errorf("impossibile elencare le PairingPolicy: %w", err)
+	}
+	if policy := activePairingPolicy(policies.Items); policy != nil {
+		return policyPairingConfig(policy, time.Now()), nil
+	}
+	return r.loadPairingConfigMap(ctx, namespace)
+}
+
+// activePairingPolicy sceglie la policy in vigore tra quelle di un namespace: la più vecchia,
+// a parità di età quella con il nome minore. Le altre vengono ignorate.
+func activePairingPolicy(policies []devicesv1alpha1.PairingPolicy) *devicesv1alpha1.PairingPolicy {
+	var active *devicesv1alpha1.PairingPolicy
+	for i := range policies {
+		p := &policies[i]
+		if !p.DeletionTimestamp.IsZero() {
+			continue
+		}
+		if active == nil || p.CreationTimestamp.Before(&active.CreationTimestamp) ||
+			(p.CreationTimestamp.Equal(&active.CreationTimestamp) && p.Name < active.Name) {
+			active = p
+		}
+	}
+	return active
+}
+
+// policyPairingConfig traduce una PairingPolicy nella configurazione di pairing valida all'istante now.
+// Se la policy ha delle finestre ma nessuna è aperta, NotBefore punta alla prossima apertura
+// oppure NotAfter all'ultima chiusura, così admits spiega perché il pairing è chiuso.
+func policyPairingConfig(policy *devicesv1alpha1.PairingPolicy, now time.Time) pairingConfig {
+	config := pairingConfig{
+		Policy:                 policy.Name,
+		Enabled:                policy.Spec.Enabled,
+		Mode:                   policy.Spec.Mode,
+		TotalEnrollments:       int(policy.Status.AdmittedCount),
+		AllowedKeyFingerprints: policy.Spec.AllowedKeyFingerprints,
+	}
+	if config.Mode == "" {
+		config.Mode = PairingModeAuto
+	}
+	if policy.Spec.MaxEnrollments != nil {
+		config.MaxTotalEnrollments = int(*policy.Spec.MaxEnrollments)
+	}
+	for _, algorithm := range policy.Spec.AllowedKeyAlgorithms {
+		config.AllowedKeyAlgorithms = append(config.AllowedKeyAlgorithms, string(algorithm))
+	}
+	if len(policy.Spec.Windows) == 0 {
+		return config
+	}
+
+	if window := activePairingWindow(policy, now); window != nil {
+		start, end := window.Start.Time, pairingWindowEnd(window)
+		config.ActiveWindow = window.Name
+		config.NotBefore, config.NotAfter = &start, &end
+		if window.MaxEnrollments != nil {
+			config.MaxEnrollments = int(*window.MaxEnrollments)
+		}
+		config.Enrollments = int(pairingWindowEnrollments(policy, window.Name))
+		return config
+	}
+
+	var next, last *time.Time
+	for i := range policy.Spec.Windows {
+		w := &policy.Spec.Windows[i]
+		start, end := w.Start.Time, pairingWindowEnd(w)
+		if now.Before(start) && (next == nil || start.Before(*next)) {
+			next = &start
+		}
+		if !now.Before(end) && (last == nil || end.After(*last)) {
+			last = &end
+		}
+	}
+	if next != nil {
+		config.NotBefore = next
+	} else {
+		config.NotAfter = last
+	}
+	return config
+}
+
+// activePairingWindow restituisce la finestra aperta all'istante now; se più finestre si sovrappongono
+// vale quella che chiude per prima.
+func activePairingWindow(policy *devicesv1alpha1.PairingPolicy, now time.Time) *devicesv1alpha1.PairingWindow {
+	var active *devicesv1alpha1.PairingWindow
+	for i := range policy.Spec.Windows {
+		w := &policy.Spec.Windows[i]
+		if now.Before(w.Start.Time) || !now.Before(pairingWindowEnd(w)) {
+			continue
+		}
+		if active == nil || pairingWindowEnd(w).Before(pairingWindowEnd(active)) {
+			active = w
+		}
+	}
+	return active
+}
+
+// pairingWindowEnd calcola la chiusura di una finestra definita con End o con Duration.
+func pairingWindowEnd(w *devicesv1alpha1.PairingWindow) time.Time {
+	if w.End != nil {
+		return w.End.Time
+	}
+	if w.Duration != nil {
+		return w.Start.Add(w.Duration.Duration)
+	}
+	// Lo schema della CRD richiede End o Duration: una finestra senza fine non è mai aperta.
+	return w.Start.Time
+}
+
+// nextPairingPolicyTransition restituisce il prossimo istante dopo now in cui una finestra si apre o si chiude.
+func nextPairingPolicyTransition(policy *devicesv1alpha1.PairingPolicy, now time.Time) *time.Time {
+	var next *time.Time
+	for i := range policy.Spec.Windows {
+		w := &policy.Spec.Windows[i]
+		for _, t := range []time.Time{w.Start.Time, pairingWindowEnd(w)} {
+			if t.After(now) && (next == nil || t.Before(*next)) {
+				t := t
+				next = &t
+			}
+		}
+	}
+	return next
+}
+
+func pairingWindowEnrollments(policy *devicesv1alpha1.PairingPolicy, name string) int32 {
+	for _, w := range policy.Status.Windows {
+		if w.Name == name {
+			return w.Enrollments
+		}
+	}
+	return 0
+}
+
+// countPolicyEnrollment registra l'approvazione della registrazione uid nello status della PairingPolicy,
+// con le stesse regole di countPairingEnrollment.
+func (r *DeviceRegistrationReconciler) countPolicyEnrollment(ctx context.Context, key types.NamespacedName, uid types.UID, enforceLimit bool) (bool, error) {
+	admitted := false
+	err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		policy := &devicesv1alpha1.PairingPolicy{}
+		if err := r.Get(ctx, key, policy); err != nil {
+			return err
+		}
+		if slices.Contains(policy.Status.CountedRegistrations, string(uid)) {
+			admitted = true
+			return nil
+		}
+		now := time.Now()
+		config := policyPairingConfig(policy, now)
+		if ok, _ := config.admits(now); enforceLimit && !ok {
+			admitted = false
+			return nil
+		}
+
+		policy.Status.AdmittedCount++
+		policy.Status.CountedRegistrations = appendCountedRegistration(policy.Status.CountedRegistrations, uid)
+		lastAdmission := metav1.NewTime(now)
+		policy.Status.LastAdmissionTime = &lastAdmission
+		if config.ActiveWindow != "" {
+			found := false
+			for i := range policy.Status.Windows {
+				if policy.Status.Windows[i].Name == config.ActiveWindow {
+					policy.Status.Windows[i].Enrollments++
+					found = true
+				}
+			}
+			if !found {
+				policy.Status.Windows = append(policy.Status.Windows, devicesv1alpha1.PairingWindowStatus{Name: config.ActiveWindow, Enrollments: 1})
+				sort.Slice(policy.Status.Windows, func(i, j int) bool { return policy.Status.Windows[i].Name < policy.Status.Windows[j].Name })
+			}
+		}
+		admitted = true
+		return r.Status().Update(ctx, policy)
+	})
+	if err != nil {
+		return false, fmt.Errorf("impossibile aggiornare il conteggio della PairingPolicy %s: %w", key.Name, err)
+	}
+	return admitted, nil
+}
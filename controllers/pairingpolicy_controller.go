@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+const (
+	// ConditionPolicyActive è True quando la PairingPolicy ammette nuove registrazioni.
+	ConditionPolicyActive = "Active"
+
+	// Motivi della condizione Active.
+	ReasonPolicyOpen       = "Open"
+	ReasonPolicyClosed     = "Closed"
+	ReasonPolicySuperseded = "Superseded"
+)
+
+// PairingPolicyReconciler mantiene aggiornato lo status delle PairingPolicy: la finestra aperta
+// e la condizione Active. Il conteggio delle approvazioni è aggiornato dal DeviceRegistrationReconciler.
+type PairingPolicyReconciler struct {
+	client.Client
+	Log logr.Logger
+}
+
+// +kubebuilder:rbac:groups=devices.example.com,resources=pairingpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=devices.example.com,resources=pairingpolicies/status,verbs=get;update;patch
+
+func (r *PairingPolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Log.WithValues("pairingpolicy", req.NamespacedName)
+
+	var policies devicesv1alpha1.PairingPolicyList
+	if err := r.List(ctx, &policies, client.InNamespace(req.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	var policy *devicesv1alpha1.PairingPolicy
+	for i := range policies.Items {
+		if policies.Items[i].Name == req.Name {
+			policy = &policies.Items[i]
+		}
+	}
+	if policy == nil {
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+	config := policyPairingConfig(policy, now)
+	condition := metav1.Condition{
+		Type:               ConditionPolicyActive,
+		Status:             metav1.ConditionTrue,
+		Reason:             ReasonPolicyOpen,
+		Message:            "The policy admits new device registrations.",
+		ObservedGeneration: policy.Generation,
+	}
+	if active := activePairingPolicy(policies.Items); active != nil && active.Name != policy.Name {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = ReasonPolicySuperseded
+		condition.Message = fmt.Sprintf("Pairing policy %s is older and takes precedence in this namespace.", active.Name)
+	} else if admitted, why := config.admits(now); !admitted {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = ReasonPolicyClosed
+		condition.Message = why
+	}
+
+	original := policy.DeepCopy()
+	policy.Status.ObservedGeneration = policy.Generation
+	policy.Status.ActiveWindow = config.ActiveWindow
+	meta.SetStatusCondition(&policy.Status.Conditions, condition)
+	if !equalPairingPolicyStatus(original, policy) {
+		if err := r.Status().Patch(ctx, policy, client.MergeFrom(original)); err != nil {
+			logger.Error(err, "Fallimento nell'aggiornare lo stato della PairingPolicy")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Ricalcoliamo lo stato all'apertura o alla chiusura della prossima finestra.
+	if next := nextPairingPolicyTransition(policy, now); next != nil {
+		return ctrl.Result{RequeueAfter: next.Sub(now)}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+func equalPairingPolicyStatus(a, b *devicesv1alpha1.PairingPolicy) bool {
+	if a.Status.ObservedGeneration != b.Status.ObservedGeneration || a.Status.ActiveWindow != b.Status.ActiveWindow {
+		return false
+	}
+	ca := meta.FindStatusCondition(a.Status.Conditions, ConditionPolicyActive)
+	cb := meta.FindStatusCondition(b.Status.Conditions, ConditionPolicyActive)
+	if ca == nil || cb == nil {
+		return ca == cb
+	}
+	return ca.Status == cb.Status && ca.Reason == cb.Reason && ca.Message == cb.Message && ca.ObservedGeneration == cb.ObservedGeneration
+}
+
+// policiesInNamespace rimette in coda tutte le policy del namespace: quale policy è in vigore
+// dipende anche dalla creazione e cancellazione delle altre.
+func (r *PairingPolicyReconciler) policiesInNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	var policies devicesv1alpha1.PairingPolicyList
+	if err := r.List(ctx, &policies, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Log.Error(err, "Impossibile elencare le PairingPolicy", "namespace", obj.GetNamespace())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(policies.Items))
+	for _, p := range policies.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&p)})
+	}
+	return requests
+}
+
+func (r *PairingPolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&devicesv1alpha1.PairingPolicy{}).
+		Watches(&devicesv1alpha1.PairingPolicy{}, handler.EnqueueRequestsFromMapFunc(r.policiesInNamespace)).
+		Complete(r)
+}
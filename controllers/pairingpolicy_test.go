@@ -0,0 +1,99 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestPolicyPairingConfigWindows(t *testing.T) {
+	start := time.Date(2025, 6, 1, 9, 0, 0, 0, time.UTC)
+	end := metav1.NewTime(start.Add(2 * time.Hour))
+	maxPerWindow := int32(2)
+	policy := &devicesv1alpha1.PairingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "default"},
+		Spec: devicesv1alpha1.PairingPolicySpec{
+			Enabled: true,
+			Windows: []devicesv1alpha1.PairingWindow{
+				{Name: "morning", Start: metav1.NewTime(start), End: &end, MaxEnrollments: &maxPerWindow},
+				{Name: "afternoon", Start: metav1.NewTime(start.Add(5 * time.Hour)), Duration: &metav1.Duration{Duration: time.Hour}},
+			},
+		},
+		Status: devicesv1alpha1.PairingPolicyStatus{
+			Windows: []devicesv1alpha1.PairingWindowStatus{{Name: "morning", Enrollments: 1}},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		window   string
+		admitted bool
+	}{
+		{name: "before the first window", now: start.Add(-time.Minute)},
+		{name: "inside the first window", now: start.Add(time.Hour), window: "morning", admitted: true},
+		{name: "between windows", now: start.Add(3 * time.Hour)},
+		{name: "inside the second window", now: start.Add(5*time.Hour + time.Minute), window: "afternoon", admitted: true},
+		{name: "after the last window", now: start.Add(7 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := policyPairingConfig(policy, tt.now)
+			if config.ActiveWindow != tt.window {
+				t.Fatalf("active window = %q, want %q", config.ActiveWindow, tt.window)
+			}
+			if admitted, why := config.admits(tt.now); admitted != tt.admitted {
+				t.Fatalf("admits() = %v (%s), want %v", admitted, why, tt.admitted)
+			}
+		})
+	}
+
+	// Il conteggio della finestra nello status fa scattare il limite per finestra.
+	policy.Status.Windows[0].Enrollments = 2
+	if admitted, _ := policyPairingConfig(policy, start.Add(time.Hour)).admits(start.Add(time.Hour)); admitted {
+		t.Fatal("a window that reached maxEnrollments must not admit new registrations")
+	}
+
+	next := nextPairingPolicyTransition(policy, start.Add(3*time.Hour))
+	if next == nil || !next.Equal(start.Add(5*time.Hour)) {
+		t.Fatalf("next transition = %v, want the opening of the afternoon window", next)
+	}
+}
+
+func TestPolicyRestrictsKeys(t *testing.T) {
+	policy := &devicesv1alpha1.PairingPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "restricted"},
+		Spec: devicesv1alpha1.PairingPolicySpec{
+			Enabled:                true,
+			AllowedKeyAlgorithms:   []devicesv1alpha1.KeyAlgorithm{KeyAlgorithmEd25519},
+			AllowedKeyFingerprints: []string{"aa"},
+		},
+	}
+	config := policyPairingConfig(policy, time.Now())
+
+	if ok, _ := config.admitsKey(&publicKeyInfo{Algorithm: KeyAlgorithmRSA, Fingerprint: "aa"}); ok {
+		t.Fatal("RSA keys must be rejected when only Ed25519 is allowed")
+	}
+	if ok, _ := config.admitsKey(&publicKeyInfo{Algorithm: KeyAlgorithmEd25519, Fingerprint: "bb"}); ok {
+		t.Fatal("keys outside the allowlist must be rejected")
+	}
+	if ok, why := config.admitsKey(&publicKeyInfo{Algorithm: KeyAlgorithmEd25519, Fingerprint: "aa"}); !ok {
+		t.Fatalf("allowed key rejected: %s", why)
+	}
+}
+
+func TestOldestPairingPolicyTakesPrecedence(t *testing.T) {
+	older := metav1.NewTime(time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	newer := metav1.NewTime(older.Add(time.Hour))
+	policies := []devicesv1alpha1.PairingPolicy{
+		{ObjectMeta: metav1.ObjectMeta{Name: "a-newer", CreationTimestamp: newer}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "z-older", CreationTimestamp: older}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "b-older", CreationTimestamp: older}},
+	}
+	if active := activePairingPolicy(policies); active == nil || active.Name != "b-older" {
+		t.Fatalf("active policy = %v, want b-older", active)
+	}
+}
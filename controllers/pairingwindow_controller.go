@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	// Motivi di chiusura riportati nella chiave closedReason del ConfigMap di pairing.
+	PairingClosedWindowExpired         = "WindowExpired"
+	PairingClosedMaxEnrollmentsReached = "MaxEnrollmentsReached"
+)
+
+// PairingWindowReconciler chiude automaticamente la finestra di pairing quando scade
+// o quando ha raggiunto il numero massimo di registrazioni, così il pairing non resta aperto per dimenticanza.
+type PairingWindowReconciler struct {
+	client.Client
+	Log logr.Logger
+}
+
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;update
+
+func (r *PairingWindowReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := r.Log.WithValues("configmap", req.NamespacedName)
+
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, req.NamespacedName, cm); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	config, err := parsePairingConfig(cm.Data)
+	if err != nil {
+		// Il DeviceRegistrationReconciler tratta già una configurazione non valida come pairing chiuso.
+		logger.Info("Configurazione di pairing non valida, nessuna chiusura automatica", "error", err.Error())
+		return ctrl.Result{}, nil
+	}
+
+	// A pairing chiuso il contatore riparte da zero, pronto per la prossima finestra.
+	if !config.Enabled {
+		_, counting := cm.Data[PairingEnrollmentsKey]
+		if _, ok := cm.Data[PairingCountedKey]; !ok && !counting {
+			return ctrl.Result{}, nil
+		}
+		delete(cm.Data, PairingEnrollmentsKey)
+		delete(cm.Data, PairingCountedKey)
+		if err := r.Update(ctx, cm); err != nil {
+			logger.Error(err, "Impossibile azzerare il contatore della finestra di pairing")
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+	switch {
+	case config.NotAfter != nil && !now.Before(*config.NotAfter):
+		return r.closeWindow(ctx, cm, PairingClosedWindowExpired, now, logger)
+	case config.MaxEnrollments > 0 && config.Enrollments >= config.MaxEnrollments:
+		return r.closeWindow(ctx, cm, PairingClosedMaxEnrollmentsReached, now, logger)
+	case config.NotAfter != nil:
+		// Torniamo a controllare esattamente alla scadenza della finestra.
+		return ctrl.Result{RequeueAfter: config.NotAfter.Sub(now)}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// closeWindow disabilita il pairing e registra quando e perché la finestra è stata chiusa.
+func (r *PairingWindowReconciler) closeWindow(ctx context.Context, cm *corev1.ConfigMap, reason string, now time.Time, logger logr.Logger) (ctrl.Result, error) {
+	logger.Info("Chiusura automatica della finestra di pairing", "reason", reason)
+	cm.Data[PairingEnabledKey] = "false"
+	cm.Data[PairingClosedAtKey] = now.UTC().Format(time.RFC3339)
+	cm.Data[PairingClosedReasonKey] = reason
+	delete(cm.Data, PairingEnrollmentsKey)
+	delete(cm.Data, PairingCountedKey)
+	if err := r.Update(ctx, cm); err != nil {
+		logger.Error(err, "Impossibile chiudere la finestra di pairing")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *PairingWindowReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// Ci interessano solo i ConfigMap di pairing, uno per namespace.
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("pairingwindow").
+		For(&corev1.ConfigMap{}, builder.WithPredicates(isPairingConfigMap)).
+		Complete(r)
+}
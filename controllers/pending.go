@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+// DefaultPendingRegistrationTTL coincide con la validità del ticket di enrollment rilasciato dal gateway:
+// oltre questo tempo il gateway considera scaduta una richiesta ancora in attesa.
+const DefaultPendingRegistrationTTL = 24 * time.Hour
+
+// pendingExpiry restituisce quanto manca alla scadenza di una richiesta non ancora decisa.
+// Il secondo valore è false se la registrazione non è in attesa o se le richieste in attesa non scadono.
+// Una richiesta in attesa della decisione di un amministratore (condizione AwaitingApproval) non scade:
+// la sua cancellazione spetta all'amministratore.
+func (r *DeviceRegistrationReconciler) pendingExpiry(dr *devicesv1alpha1.DeviceRegistration, now time.Time) (time.Duration, bool) {
+	if r.PendingRegistrationTTL <= 0 || dr.CreationTimestamp.IsZero() {
+		return 0, false
+	}
+	if dr.Status.Phase != "" && dr.Status.Phase != PhasePending {
+		return 0, false
+	}
+	if meta.IsStatusConditionTrue(dr.Status.Conditions, ConditionAwaitingApproval) {
+		return 0, false
+	}
+	return dr.CreationTimestamp.Add(r.PendingRegistrationTTL).Sub(now), true
+}
+
+// deleteStalePendingRegistration cancella una richiesta rimasta in attesa oltre PendingRegistrationTTL.
+// Il dispositivo ha già ricevuto dal gateway l'esito TIMEOUT e deve ripetere l'enrollment: la richiesta
+// non servirebbe più e occuperebbe un posto nel limite delle registrazioni in attesa del gateway.
+func (r *DeviceRegistrationReconciler) deleteStalePendingRegistration(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) error {
+	logger.Info("Richiesta in attesa da troppo tempo. Cancellazione della registrazione.", "ttl", r.PendingRegistrationTTL.String())
+	r.recordEvent(dr, corev1.EventTypeWarning, EventReasonPendingExpired,
+		"Registration was not decided within %s and is deleted; the device must enroll again.", r.PendingRegistrationTTL)
+	return client.IgnoreNotFound(r.Delete(ctx, dr, client.Preconditions{UID: &dr.UID}))
+}
+
+// requeueBeforePendingExpiry fa in modo che una richiesta ancora in attesa venga riconciliata di nuovo
+// alla sua scadenza.
+func (r *DeviceRegistrationReconciler) requeueBeforePendingExpiry(dr *devicesv1alpha1.DeviceRegistration, result ctrl.Result) ctrl.Result {
+	remaining, expires := r.pendingExpiry(dr, time.Now())
+	if !expires {
+		return result
+	}
+	if remaining < time.Second {
+		remaining = time.Second
+	}
+	if result.RequeueAfter == 0 || remaining < result.RequeueAfter {
+		result.RequeueAfter = remaining
+	}
+	return result
+}
@@ -0,0 +1,83 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestStalePendingRegistrationIsDeleted(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ttl = 24 * time.Hour
+	registration := func(name string, age time.Duration) *devicesv1alpha1.DeviceRegistration {
+		return &devicesv1alpha1.DeviceRegistration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: name, Namespace: "devices", UID: types.UID(name), Generation: 1,
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+			},
+			Spec: devicesv1alpha1.DeviceRegistrationSpec{PublicKey: base64.StdEncoding.EncodeToString(publicKey)},
+		}
+	}
+	// In modalità manuale le richieste restano in attesa di un amministratore.
+	pairing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: PairingConfigMapName, Namespace: "devices"},
+		Data:       map[string]string{PairingEnabledKey: "true", PairingModeKey: PairingModeManual},
+	}
+	held := registration("held", ttl+time.Minute)
+	held.Status = devicesv1alpha1.DeviceRegistrationStatus{
+		Phase:  PhasePending,
+		Reason: ReasonAwaitingApproval,
+		Conditions: []metav1.Condition{{
+			Type: ConditionAwaitingApproval, Status: metav1.ConditionTrue, Reason: ReasonAwaitingApproval,
+			ObservedGeneration: 1, LastTransitionTime: metav1.Now(),
+		}},
+	}
+	c := lifecycleTestClient(scheme, registration("stale", ttl+time.Minute), held, pairing)
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), PendingRegistrationTTL: ttl}
+
+	// Una richiesta ancora da valutare viene riconciliata di nuovo alla scadenza del suo ticket.
+	fresh := registration("fresh", time.Hour)
+	if result := r.requeueBeforePendingExpiry(fresh, ctrl.Result{}); result.RequeueAfter <= ttl-2*time.Hour || result.RequeueAfter > ttl-time.Hour {
+		t.Fatalf("RequeueAfter = %s, want about %s", result.RequeueAfter, ttl-time.Hour)
+	}
+
+	// Scaduto il ticket, la richiesta viene cancellata.
+	staleKey := types.NamespacedName{Name: "stale", Namespace: "devices"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: staleKey}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, staleKey, &got); !apierrors.IsNotFound(err) {
+		t.Fatalf("stale registration: err = %v, phase = %q, want it deleted", err, got.Status.Phase)
+	}
+
+	// Una richiesta in attesa di approvazione manuale resta finché un amministratore non decide.
+	heldKey := types.NamespacedName{Name: "held", Namespace: "devices"}
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: heldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, heldKey, &got); err != nil {
+		t.Fatalf("registration awaiting approval deleted: %v", err)
+	}
+	if got.Status.Phase != PhasePending || result.RequeueAfter != 0 {
+		t.Fatalf("phase = %q, RequeueAfter = %s, want Pending without an expiry", got.Status.Phase, result.RequeueAfter)
+	}
+}
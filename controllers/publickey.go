@@ -0,0 +1,171 @@
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Algoritmi di chiave riconosciuti, così come vengono riportati in status.keyAlgorithm.
+	KeyAlgorithmRSA     = "RSA"
+	KeyAlgorithmECDSA   = "ECDSA"
+	KeyAlgorithmEd25519 = "Ed25519"
+
+	// minRSAKeyBits è la dimensione minima accettata per il modulo di una chiave RSA.
+	minRSAKeyBits = 2048
+)
+
+// errWeakPublicKey indica una chiave sintatticamente valida ma crittograficamente troppo debole
+// o basata su un algoritmo/curva non supportati.
+var errWeakPublicKey = errors.New("weak or unsupported public key")
+
+// publicKeyInfo raccoglie la chiave decodificata e le informazioni da riportare nello status.
+type publicKeyInfo struct {
+	Key         crypto.PublicKey
+	Algorithm   string
+	Size        int
+	Fingerprint string
+}
+
+// parsePublicKey decodifica la chiave pubblica inviata dal dispositivo e ne verifica la robustezza.
+// Sono supportati: PEM PKIX ("PUBLIC KEY"), PEM PKCS#1 ("RSA PUBLIC KEY"), il formato
+// authorized_keys di OpenSSH e una chiave Ed25519 grezza codificata in base64 o esadecimale.
+// Gli errori dovuti a chiavi deboli avvolgono errWeakPublicKey.
+func parsePublicKey(raw string) (*publicKeyInfo, error) {
+	data := strings.TrimSpace(raw)
+	if data == "" {
+		return nil, errors.New("public key is empty")
+	}
+
+	key, err := decodePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	info, err := classifyPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if info.Fingerprint, err = publicKeyFingerprint(key); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// publicKeyFingerprint calcola lo SHA-256 (in esadecimale) della codifica DER PKIX della chiave.
+// Usando la forma canonica, la stessa chiave ha la stessa impronta qualunque sia il formato di invio.
+func publicKeyFingerprint(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", fmt.Errorf("cannot encode public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// decodePublicKey prova, in ordine, tutti i formati supportati.
+func decodePublicKey(data string) (crypto.PublicKey, error) {
+	if strings.HasPrefix(data, "-----BEGIN") {
+		block, rest := pem.Decode([]byte(data))
+		if block == nil {
+			return nil, errors.New("malformed PEM block")
+		}
+		if len(strings.TrimSpace(string(rest))) > 0 {
+			return nil, errors.New("unexpected data after the PEM block")
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PKIX public key: %w", err)
+			}
+			return key, nil
+		case "RSA PUBLIC KEY":
+			key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PKCS#1 public key: %w", err)
+			}
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+		}
+	}
+
+	// Formato OpenSSH: "<tipo> <base64> [commento]".
+	if strings.ContainsAny(data, " \t") {
+		sshKey, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OpenSSH public key: %w", err)
+		}
+		if len(strings.TrimSpace(string(rest))) > 0 {
+			return nil, errors.New("unexpected data after the OpenSSH public key")
+		}
+		cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: OpenSSH key type %q", errWeakPublicKey, sshKey.Type())
+		}
+		return cryptoKey.CryptoPublicKey(), nil
+	}
+
+	// Chiave Ed25519 grezza (32 byte) in base64 o esadecimale.
+	if raw, err := base64.StdEncoding.DecodeString(data); err == nil && len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+	if raw, err := base64.RawURLEncoding.DecodeString(data); err == nil && len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+	if raw, err := hex.DecodeString(data); err == nil && len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+
+	return nil, errors.New("unrecognized public key format")
+}
+
+// classifyPublicKey rileva algoritmo e dimensione della chiave e rifiuta quelle deboli.
+func classifyPublicKey(key crypto.PublicKey) (*publicKeyInfo, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		bits := k.N.BitLen()
+		if k.E < 3 || k.E%2 == 0 {
+			return nil, fmt.Errorf("invalid RSA public exponent %d", k.E)
+		}
+		if bits < minRSAKeyBits {
+			return nil, fmt.Errorf("%w: RSA key is %d bits, at least %d are required", errWeakPublicKey, bits, minRSAKeyBits)
+		}
+		return &publicKeyInfo{Key: k, Algorithm: KeyAlgorithmRSA, Size: bits}, nil
+	case *ecdsa.PublicKey:
+		params := k.Curve.Params()
+		switch params.Name {
+		case "P-256", "P-384", "P-521":
+			return &publicKeyInfo{Key: k, Algorithm: KeyAlgorithmECDSA, Size: params.BitSize}, nil
+		default:
+			return nil, fmt.Errorf("%w: ECDSA curve %s is not supported", errWeakPublicKey, params.Name)
+		}
+	case ed25519.PublicKey:
+		if len(k) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid Ed25519 public key length %d", len(k))
+		}
+		return &publicKeyInfo{Key: k, Algorithm: KeyAlgorithmEd25519, Size: 256}, nil
+	default:
+		return nil, fmt.Errorf("%w: key type %T", errWeakPublicKey, key)
+	}
+}
+
+// publicKeyRejectionReason traduce un errore di parsePublicKey nel codice da riportare in status.reason.
+func publicKeyRejectionReason(err error) string {
+	if errors.Is(err, errWeakPublicKey) {
+		return ReasonWeakPublicKey
+	}
+	return ReasonInvalidPublicKey
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParsePublicKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		algorithm string
+		size      int
+		reason    string
+	}{
+		{name: "PKIX RSA", key: pkixPEM(t, &rsaKey.PublicKey), algorithm: KeyAlgorithmRSA, size: 2048},
+		{name: "PKCS#1 RSA", key: pkcs1PEM(&rsaKey.PublicKey), algorithm: KeyAlgorithmRSA, size: 2048},
+		{name: "PKIX ECDSA P-256", key: pkixPEM(t, &ecKey.PublicKey), algorithm: KeyAlgorithmECDSA, size: 256},
+		{name: "PKIX Ed25519", key: pkixPEM(t, edPub), algorithm: KeyAlgorithmEd25519, size: 256},
+		{name: "OpenSSH RSA", key: authorizedKey(t, &rsaKey.PublicKey), algorithm: KeyAlgorithmRSA, size: 2048},
+		{name: "OpenSSH ECDSA", key: authorizedKey(t, &ecKey.PublicKey), algorithm: KeyAlgorithmECDSA, size: 256},
+		{name: "OpenSSH Ed25519", key: authorizedKey(t, edPub), algorithm: KeyAlgorithmEd25519, size: 256},
+		{name: "raw Ed25519 base64", key: base64.StdEncoding.EncodeToString(edPub), algorithm: KeyAlgorithmEd25519, size: 256},
+		{name: "raw Ed25519 hex", key: hex.EncodeToString(edPub), algorithm: KeyAlgorithmEd25519, size: 256},
+		{name: "empty", key: "  ", reason: ReasonInvalidPublicKey},
+		{name: "fake OpenSSH key", key: "ssh-rsa FAKE-KEY", reason: ReasonInvalidPublicKey},
+		{name: "garbage", key: "not-a-key", reason: ReasonInvalidPublicKey},
+		{name: "unknown PEM type", key: "-----BEGIN CERTIFICATE-----\nAAAA\n-----END CERTIFICATE-----\n", reason: ReasonInvalidPublicKey},
+		{name: "weak RSA", key: pkixPEM(t, &weakRSAKey.PublicKey), reason: ReasonWeakPublicKey},
+		{name: "unsupported curve", key: pkixPEM(t, &p224Key.PublicKey), reason: ReasonWeakPublicKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := parsePublicKey(tt.key)
+			if tt.reason != "" {
+				if err == nil {
+					t.Fatalf("expected rejection with reason %s, got %s/%d", tt.reason, info.Algorithm, info.Size)
+				}
+				if got := publicKeyRejectionReason(err); got != tt.reason {
+					t.Fatalf("expected reason %s, got %s (%v)", tt.reason, got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if info.Algorithm != tt.algorithm || info.Size != tt.size {
+				t.Fatalf("expected %s/%d, got %s/%d", tt.algorithm, tt.size, info.Algorithm, info.Size)
+			}
+		})
+	}
+}
+
+func TestWeakKeyErrorsAreDistinguishable(t *testing.T) {
+	_, err := classifyPublicKey("unsupported")
+	if !errors.Is(err, errWeakPublicKey) {
+		t.Fatalf("expected errWeakPublicKey, got %v", err)
+	}
+}
+
+func pkixPEM(t *testing.T, key interface{}) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func pkcs1PEM(key *rsa.PublicKey) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(key)}))
+}
+
+func authorizedKey(t *testing.T, key interface{}) string {
+	t.Helper()
+	sshKey, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshKey))) + " device-comment"
+}
+
+func TestFingerprintIsFormatIndependent(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fingerprints []string
+	for _, key := range []string{pkixPEM(t, edPub), authorizedKey(t, edPub), base64.StdEncoding.EncodeToString(edPub)} {
+		info, err := parsePublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprints = append(fingerprints, info.Fingerprint)
+	}
+	for _, fp := range fingerprints[1:] {
+		if fp != fingerprints[0] {
+			t.Fatalf("fingerprints differ: %v", fingerprints)
+		}
+	}
+	if len(fingerprints[0]) != 64 {
+		t.Fatalf("expected a hex SHA-256 fingerprint, got %q", fingerprints[0])
+	}
+}
@@ -0,0 +1,185 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+	"github.com/antonio/device-operator/internal/lifecycle"
+)
+
+const (
+	// RenewalRequestAnnotation viene impostata dal gateway con un token univoco quando un dispositivo,
+	// autenticato con il certificato corrente, chiede un nuovo certificato.
+	RenewalRequestAnnotation = "devices.example.com/renewal-request"
+
+	// DeviceUUIDLabel permette al gateway di trovare la registrazione originale di un dispositivo a partire dal suo UUID.
+	DeviceUUIDLabel = "devices.example.com/device-uuid"
+
+	// ConditionExpiringSoon è True quando il certificato del dispositivo entra nella finestra di rinnovo.
+	ConditionExpiringSoon = "ExpiringSoon"
+
+	// ReasonCertificateExpired indica che il dispositivo non ha rinnovato il certificato in tempo.
+	ReasonCertificateExpired = "CertificateExpired"
+
+	// DefaultCertificateRenewBefore è quanto prima della scadenza il certificato viene segnalato come in scadenza.
+	DefaultCertificateRenewBefore = 30 * 24 * time.Hour
+)
+
+// reconcileApprovedDevice gestisce un dispositivo approvato: evade le richieste di rinnovo
+// e tiene traccia della scadenza del certificato.
+func (r *DeviceRegistrationReconciler) reconcileApprovedDevice(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
+	if dr.Status.DuplicateOf != "" {
+		// Un duplicato non rinnova nulla: riporta il certificato corrente della registrazione originale,
+		// altrimenti scadrebbe alla data del certificato copiato al momento dell'adozione.
+		if err := r.syncDuplicateCertificate(ctx, dr); err != nil {
+			logger.Error(err, "Impossibile allineare il certificato del duplicato a quello della registrazione originale")
+			return ctrl.Result{}, err
+		}
+		return r.trackCertificateExpiry(ctx, dr, logger)
+	}
+	token := dr.Annotations[RenewalRequestAnnotation]
+	if token != "" && token != dr.Status.LastRenewalRequest {
+		return r.renewCertificate(ctx, dr, token, logger)
+	}
+	return r.trackCertificateExpiry(ctx, dr, logger)
+}
+
+// syncDuplicateCertificate copia nello status di un duplicato il certificato corrente della registrazione
+// originale, che può essere stato rinnovato dopo l'adozione. Se l'originale non esiste più non cambia nulla.
+func (r *DeviceRegistrationReconciler) syncDuplicateCertificate(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) error {
+	var original devicesv1alpha1.DeviceRegistration
+	if err := r.Get(ctx, types.NamespacedName{Name: dr.Status.DuplicateOf, Namespace: dr.Namespace}, &original); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if original.Status.DeviceUUID != dr.Status.DeviceUUID || original.Status.CertificateSerialNumber == "" ||
+		original.Status.CertificateSerialNumber == dr.Status.CertificateSerialNumber {
+		return nil
+	}
+	dr.Status.Certificate = original.Status.Certificate
+	dr.Status.CertificateSerialNumber = original.Status.CertificateSerialNumber
+	dr.Status.CertificateNotAfter = original.Status.CertificateNotAfter
+	return r.updateStatus(ctx, dr)
+}
+
+// renewCertificate emette un nuovo certificato per la stessa chiave e lo stesso DeviceUUID.
+func (r *DeviceRegistrationReconciler) renewCertificate(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, token string, logger logr.Logger) (ctrl.Result, error) {
+	logger.Info("Rinnovo del certificato del dispositivo in corso...", "renewalRequest", token)
+
+	keyInfo, err := parsePublicKey(dr.Spec.PublicKey)
+	if err != nil {
+		// La chiave era valida al momento dell'approvazione: se non lo è più, lo spec è stato alterato.
+		logger.Error(err, "Impossibile rinnovare il certificato: chiave pubblica non valida")
+		return ctrl.Result{}, nil
+	}
+	previous := dr.DeepCopy()
+	if err := r.issueCertificate(ctx, dr, keyInfo.Key); err != nil {
+		logger.Error(err, "Impossibile emettere il certificato rinnovato")
+		return ctrl.Result{}, err
+	}
+	// Il certificato sostituito non deve restare valido: le revoche successive (deattivazione, quarantena,
+	// cancellazione) riguardano solo il certificato corrente. La revoca viene salvata prima dello status:
+	// se il salvataggio fallisce, il rinnovo viene ripetuto e la revoca è idempotente.
+	if r.Revocation != nil {
+		if err := r.Revocation.RecordRevocation(ctx, previous, RevocationReasonSuperseded); err != nil {
+			logger.Error(err, "Impossibile revocare il certificato sostituito", "serialNumber", previous.Status.CertificateSerialNumber)
+			return ctrl.Result{}, err
+		}
+	}
+	dr.Status.LastRenewalRequest = token
+	dr.Status.Message = "Device certificate renewed."
+	meta.SetStatusCondition(&dr.Status.Conditions, expiringSoonCondition(dr, false))
+
+	if err := r.updateStatus(ctx, dr); err != nil {
+		logger.Error(err, "Fallimento nell'aggiornare lo stato dopo il rinnovo")
+		return ctrl.Result{}, err
+	}
+	logger.Info("Certificato rinnovato con successo", "serialNumber", dr.Status.CertificateSerialNumber)
+	r.recordEvent(dr, corev1.EventTypeNormal, EventReasonCertificateRenewed, "Certificate renewed, new serial number %s.", dr.Status.CertificateSerialNumber)
+	return ctrl.Result{RequeueAfter: r.untilRenewalWindow(dr, time.Now())}, nil
+}
+
+// trackCertificateExpiry segnala con la condizione ExpiringSoon i certificati in scadenza,
+// porta nella fase Expired i dispositivi con il certificato scaduto e pianifica il controllo successivo.
+func (r *DeviceRegistrationReconciler) trackCertificateExpiry(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, logger logr.Logger) (ctrl.Result, error) {
+	if dr.Status.CertificateNotAfter == nil {
+		return ctrl.Result{}, nil
+	}
+
+	now := time.Now()
+	notAfter := dr.Status.CertificateNotAfter.Time
+	if !now.Before(notAfter) {
+		logger.Info("Il certificato del dispositivo è scaduto", "notAfter", notAfter)
+		message := fmt.Sprintf("Device certificate expired at %s without being renewed.", notAfter.Format(time.RFC3339))
+		if _, err := r.transition(ctx, dr, lifecycle.Expire, ReasonCertificateExpired, message); err != nil {
+			logger.Error(err, "Fallimento nell'aggiornare lo stato a Expired")
+			return ctrl.Result{}, err
+		}
+		r.recordEvent(dr, corev1.EventTypeWarning, EventReasonCertificateExpired, "%s", dr.Status.Message)
+		return ctrl.Result{}, nil
+	}
+
+	expiring := !now.Before(notAfter.Add(-r.renewBefore()))
+	if meta.SetStatusCondition(&dr.Status.Conditions, expiringSoonCondition(dr, expiring)) {
+		if expiring {
+			logger.Info("Il certificato del dispositivo è in scadenza", "notAfter", notAfter)
+		}
+		if err := r.updateStatus(ctx, dr); err != nil {
+			logger.Error(err, "Fallimento nell'aggiornare la condizione ExpiringSoon")
+			return ctrl.Result{}, err
+		}
+	}
+
+	if expiring {
+		return ctrl.Result{RequeueAfter: notAfter.Sub(now)}, nil
+	}
+	return ctrl.Result{RequeueAfter: r.untilRenewalWindow(dr, now)}, nil
+}
+
+// untilRenewalWindow restituisce il tempo che manca all'inizio della finestra di rinnovo.
+func (r *DeviceRegistrationReconciler) untilRenewalWindow(dr *devicesv1alpha1.DeviceRegistration, now time.Time) time.Duration {
+	if dr.Status.CertificateNotAfter == nil {
+		return 0
+	}
+	wait := dr.Status.CertificateNotAfter.Add(-r.renewBefore()).Sub(now)
+	if wait <= 0 {
+		return time.Second
+	}
+	return wait
+}
+
+func (r *DeviceRegistrationReconciler) renewBefore() time.Duration {
+	if r.CertificateRenewBefore > 0 {
+		return r.CertificateRenewBefore
+	}
+	return DefaultCertificateRenewBefore
+}
+
+// expiringSoonCondition costruisce la condizione ExpiringSoon per lo stato del certificato.
+func expiringSoonCondition(dr *devicesv1alpha1.DeviceRegistration, expiring bool) metav1.Condition {
+	if expiring {
+		return metav1.Condition{
+			Type:               ConditionExpiringSoon,
+			Status:             metav1.ConditionTrue,
+			Reason:             "CertificateExpiringSoon",
+			Message:            fmt.Sprintf("Device certificate expires at %s and must be renewed.", dr.Status.CertificateNotAfter.Format(time.RFC3339)),
+			ObservedGeneration: dr.Generation,
+		}
+	}
+	return metav1.Condition{
+		Type:               ConditionExpiringSoon,
+		Status:             metav1.ConditionFalse,
+		Reason:             "CertificateValid",
+		Message:            "Device certificate is not in its renewal window.",
+		ObservedGeneration: dr.Generation,
+	}
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestRenewalRevokesSupersededCertificate(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := lifecycleTestClient(scheme)
+	ca := &CertificateAuthority{Client: c, Reader: c, SecretName: "ca", Namespace: "system", Validity: time.Hour}
+	issued, err := ca.IssueDeviceCertificate(ctx, publicKey, "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := metav1.NewTime(issued.NotAfter)
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "device",
+			Namespace:   "devices",
+			Annotations: map[string]string{RenewalRequestAnnotation: "renewal-1"},
+		},
+		Spec: devicesv1alpha1.DeviceRegistrationSpec{PublicKey: base64.StdEncoding.EncodeToString(publicKey)},
+	}
+	if err := c.Create(ctx, dr); err != nil {
+		t.Fatal(err)
+	}
+	// Il fake client non salva lo status alla creazione.
+	dr.Status.Phase = PhaseApproved
+	dr.Status.DeviceUUID = "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a"
+	dr.Status.Certificate = issued.ChainPEM
+	dr.Status.CertificateSerialNumber = issued.SerialNumber
+	dr.Status.CertificateNotAfter = &notAfter
+	if err := c.Status().Update(ctx, dr); err != nil {
+		t.Fatal(err)
+	}
+	publisher := &RevocationPublisher{Client: c, Reader: c, CA: ca, ConfigMapName: "crl", Namespace: "system"}
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), CA: ca, Revocation: publisher}
+
+	key := types.NamespacedName{Name: "device", Namespace: "devices"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.LastRenewalRequest != "renewal-1" {
+		t.Fatalf("lastRenewalRequest = %q, want renewal-1", got.Status.LastRenewalRequest)
+	}
+	if got.Status.CertificateSerialNumber == "" || got.Status.CertificateSerialNumber == issued.SerialNumber {
+		t.Fatalf("serial number = %q, want a new certificate", got.Status.CertificateSerialNumber)
+	}
+
+	// Il certificato sostituito è revocato subito; una deattivazione successiva riguarda solo quello nuovo.
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "crl", Namespace: "system"}, cm); err != nil {
+		t.Fatal(err)
+	}
+	var revoked []RevokedCertificate
+	if err := json.Unmarshal([]byte(cm.Data[CRLRevokedKey]), &revoked); err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber != issued.SerialNumber || revoked[0].Reason != RevocationReasonSuperseded {
+		t.Fatalf("revoked = %+v, want the superseded certificate", revoked)
+	}
+
+	// Lo stesso token non provoca un secondo rinnovo.
+	renewed := got.Status.CertificateSerialNumber
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.CertificateSerialNumber != renewed {
+		t.Fatalf("serial number = %q after a repeated token, want %q", got.Status.CertificateSerialNumber, renewed)
+	}
+}
+
+func TestDuplicateFollowsRenewedCertificate(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(publicKey)
+	original := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "original", Namespace: "devices"},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: encoded},
+	}
+	duplicate := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "duplicate", Namespace: "devices"},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: encoded},
+	}
+	c := lifecycleTestClient(scheme, original, duplicate)
+
+	// L'originale ha rinnovato il certificato; il duplicato ha ancora quello copiato all'adozione, ormai scaduto.
+	renewedNotAfter := metav1.NewTime(time.Now().Add(24 * time.Hour))
+	original.Status = devicesv1alpha1.DeviceRegistrationStatus{
+		Phase:                   PhaseApproved,
+		DeviceUUID:              "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+		CertificateSerialNumber: "b2",
+		CertificateNotAfter:     &renewedNotAfter,
+	}
+	if err := c.Status().Update(ctx, original); err != nil {
+		t.Fatal(err)
+	}
+	staleNotAfter := metav1.NewTime(time.Now().Add(-time.Minute))
+	duplicate.Status = devicesv1alpha1.DeviceRegistrationStatus{
+		Phase:                   PhaseApproved,
+		DeviceUUID:              "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+		DuplicateOf:             "original",
+		CertificateSerialNumber: "a1",
+		CertificateNotAfter:     &staleNotAfter,
+	}
+	if err := c.Status().Update(ctx, duplicate); err != nil {
+		t.Fatal(err)
+	}
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard()}
+
+	key := types.NamespacedName{Name: "duplicate", Namespace: "devices"}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: key}); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, key, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseApproved {
+		t.Fatalf("phase = %q, want %q: the duplicate expired at the date of the superseded certificate", got.Status.Phase, PhaseApproved)
+	}
+	if got.Status.CertificateSerialNumber != "b2" || got.Status.CertificateNotAfter.Unix() != renewedNotAfter.Unix() {
+		t.Fatalf("certificate = %s until %v, want the renewed certificate of the original", got.Status.CertificateSerialNumber, got.Status.CertificateNotAfter)
+	}
+}
+
+func TestCertificateExpiryTracking(t *testing.T) {
+	ctx := context.Background()
+	scheme := lifecycleTestScheme(t)
+	dr := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "device", Namespace: "devices"},
+		Spec:       devicesv1alpha1.DeviceRegistrationSpec{PublicKey: "key"},
+	}
+	c := lifecycleTestClient(scheme, dr)
+	notAfter := metav1.NewTime(time.Now().Add(24 * time.Hour))
+	dr.Status = devicesv1alpha1.DeviceRegistrationStatus{
+		Phase:                   PhaseApproved,
+		DeviceUUID:              "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+		CertificateSerialNumber: "a1",
+		CertificateNotAfter:     &notAfter,
+	}
+	if err := c.Status().Update(ctx, dr); err != nil {
+		t.Fatal(err)
+	}
+	r := &DeviceRegistrationReconciler{Client: c, Scheme: scheme, Log: logr.Discard(), CertificateRenewBefore: 48 * time.Hour}
+
+	// Il certificato è nella finestra di rinnovo: la registrazione resta Approved fino alla scadenza.
+	result, err := r.trackCertificateExpiry(ctx, dr, logr.Discard())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(dr.Status.Conditions, ConditionExpiringSoon) || dr.Status.Phase != PhaseApproved {
+		t.Fatalf("phase = %q, conditions = %+v, want Approved and ExpiringSoon", dr.Status.Phase, dr.Status.Conditions)
+	}
+	if result.RequeueAfter <= 23*time.Hour || result.RequeueAfter > 24*time.Hour {
+		t.Fatalf("requeue after %v, want the expiry of the certificate", result.RequeueAfter)
+	}
+
+	// Scaduto senza rinnovo, il dispositivo passa in Expired.
+	expired := metav1.NewTime(time.Now().Add(-time.Minute))
+	dr.Status.CertificateNotAfter = &expired
+	if _, err := r.trackCertificateExpiry(ctx, dr, logr.Discard()); err != nil {
+		t.Fatal(err)
+	}
+	var got devicesv1alpha1.DeviceRegistration
+	if err := c.Get(ctx, types.NamespacedName{Name: "device", Namespace: "devices"}, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Status.Phase != PhaseExpired || got.Status.Reason != ReasonCertificateExpired {
+		t.Fatalf("phase = %q, reason = %q, want %s with reason %s", got.Status.Phase, got.Status.Reason, PhaseExpired, ReasonCertificateExpired)
+	}
+}
@@ -0,0 +1,316 @@
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+const (
+	// DefaultCRLConfigMapName è il nome predefinito del ConfigMap in cui viene pubblicata la CRL.
+	DefaultCRLConfigMapName = "device-operator-crl"
+	// DefaultCRLValidity è l'intervallo tra ThisUpdate e NextUpdate della CRL.
+	// La CRL viene ripubblicata a metà di questo intervallo anche se nulla è cambiato.
+	DefaultCRLValidity = 24 * time.Hour
+
+	// Chiavi del ConfigMap della CRL.
+	CRLPEMKey     = "crl.pem"
+	CRLRevokedKey = "revoked.json"
+	CRLNumberKey  = "crlNumber"
+	// CRLCACertKey contiene il certificato della CA che firma la CRL e i certificati dei dispositivi.
+	CRLCACertKey      = "ca.crt"
+	crlRetryOnFailure = 30 * time.Second
+
+	// Motivi di revoca riportati in revoked.json. Deactivated e Suspended sono sospensioni
+	// ricavate dalla fase delle registrazioni; gli altri sono revoche definitive.
+	// Superseded revoca il certificato sostituito da un rinnovo.
+	RevocationReasonDeactivated = "Deactivated"
+	RevocationReasonSuspended   = "Suspended"
+	RevocationReasonDeleted     = "Deleted"
+	RevocationReasonQuarantined = "Quarantined"
+	RevocationReasonRetired     = "Retired"
+	RevocationReasonSuperseded  = "Superseded"
+)
+
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=create;update
+
+// RevokedCertificate descrive un certificato revocato in revoked.json, accanto alla CRL firmata.
+// Il gateway usa questo elenco per rispondere a GET /status/{uuid} anche per i dispositivi cancellati.
+type RevokedCertificate struct {
+	SerialNumber string    `json:"serialNumber"`
+	DeviceUUID   string    `json:"deviceUUID"`
+	RevokedAt    time.Time `json:"revokedAt"`
+	NotAfter     time.Time `json:"notAfter"`
+	Reason       string    `json:"reason"`
+}
+
+// RevocationPublisher mantiene la CRL dei certificati dei dispositivi deattivati, sospesi,
+// in quarantena, dismessi o cancellati, firmata dalla CA dell'operatore e pubblicata nel ConfigMap
+// ConfigMapName/Namespace. I dispositivi deattivati o sospesi vengono ricavati ogni volta dalle
+// DeviceRegistration; le revoche definitive esistono solo in revoked.json e restano nella CRL
+// fino alla scadenza del certificato, anche se il dispositivo riceve in seguito un nuovo certificato.
+type RevocationPublisher struct {
+	// Client elenca le registrazioni dalla cache e scrive il ConfigMap.
+	Client client.Client
+	// Reader legge il ConfigMap direttamente dall'API server, per non perdere revoche appena scritte.
+	Reader client.Reader
+	CA     *CertificateAuthority
+
+	ConfigMapName string
+	Namespace     string
+	// Validity è la durata di ogni CRL pubblicata. Se zero viene usato DefaultCRLValidity.
+	Validity time.Duration
+
+	// mu serializza le pubblicazioni, che leggono e riscrivono lo stesso ConfigMap.
+	mu          sync.Mutex
+	triggerOnce sync.Once
+	trigger     chan struct{}
+}
+
+// Start pubblica la CRL all'avvio e poi la ripubblica quando richiesto con Trigger
+// o prima che la versione corrente scada. Implementa manager.Runnable.
+func (p *RevocationPublisher) Start(ctx context.Context) error {
+	logger := logf.FromContext(ctx).WithName("revocation")
+	for {
+		wait := p.validity() / 2
+		if err := p.Publish(ctx); err != nil {
+			logger.Error(err, "Impossibile pubblicare la CRL, nuovo tentativo a breve")
+			wait = crlRetryOnFailure
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-p.triggerChan():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Trigger chiede una nuova pubblicazione della CRL senza attenderla.
+func (p *RevocationPublisher) Trigger() {
+	select {
+	case p.triggerChan() <- struct{}{}:
+	default:
+		// Una pubblicazione è già in attesa e includerà anche questa modifica.
+	}
+}
+
+func (p *RevocationPublisher) triggerChan() chan struct{} {
+	p.triggerOnce.Do(func() { p.trigger = make(chan struct{}, 1) })
+	return p.trigger
+}
+
+// RecordDeletion aggiunge alla CRL il certificato di una registrazione che sta per essere cancellata.
+// Ritorna solo dopo che la revoca è stata salvata nel ConfigMap.
+func (p *RevocationPublisher) RecordDeletion(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) error {
+	return p.RecordRevocation(ctx, dr, RevocationReasonDeleted)
+}
+
+// RecordRevocation revoca in modo definitivo il certificato corrente della registrazione con il motivo indicato
+// (Deleted, Quarantined, Retired o Superseded). Un certificato già revocato in modo definitivo mantiene il motivo originale.
+// Ritorna solo dopo che la revoca è stata salvata nel ConfigMap.
+func (p *RevocationPublisher) RecordRevocation(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration, reason string) error {
+	if dr.Status.CertificateSerialNumber == "" || dr.Status.CertificateNotAfter == nil {
+		return nil
+	}
+	return p.publish(ctx, RevokedCertificate{
+		SerialNumber: dr.Status.CertificateSerialNumber,
+		DeviceUUID:   dr.Status.DeviceUUID,
+		RevokedAt:    time.Now().UTC().Truncate(time.Second),
+		NotAfter:     dr.Status.CertificateNotAfter.UTC(),
+		Reason:       reason,
+	})
+}
+
+// Publish ricalcola e pubblica la CRL.
+func (p *RevocationPublisher) Publish(ctx context.Context) error {
+	return p.publish(ctx)
+}
+
+func (p *RevocationPublisher) publish(ctx context.Context, permanent ...RevokedCertificate) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	cm := &corev1.ConfigMap{}
+	err := p.Reader.Get(ctx, types.NamespacedName{Name: p.ConfigMapName, Namespace: p.Namespace}, cm)
+	exists := err == nil
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("impossibile leggere il ConfigMap della CRL: %w", err)
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	revoked, err := p.revokedCertificates(ctx, cm, permanent, now)
+	if err != nil {
+		return err
+	}
+
+	number := big.NewInt(1)
+	if previous, ok := new(big.Int).SetString(cm.Data[CRLNumberKey], 10); ok {
+		number.Add(previous, big.NewInt(1))
+	}
+	entries := make([]x509.RevocationListEntry, 0, len(revoked))
+	for _, rc := range revoked {
+		entry, err := revocationListEntry(rc)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	der, err := p.CA.SignRevocationList(ctx, entries, number, now, now.Add(p.validity()))
+	if err != nil {
+		return err
+	}
+	revokedJSON, err := json.MarshalIndent(revoked, "", "  ")
+	if err != nil {
+		return err
+	}
+	caPEM, err := p.CA.CertificatePEM(ctx)
+	if err != nil {
+		return err
+	}
+
+	cm.Name = p.ConfigMapName
+	cm.Namespace = p.Namespace
+	cm.Data = map[string]string{
+		CRLPEMKey:     string(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})),
+		CRLRevokedKey: string(revokedJSON),
+		CRLNumberKey:  number.String(),
+		CRLCACertKey:  string(caPEM),
+	}
+	if exists {
+		err = p.Client.Update(ctx, cm)
+	} else {
+		err = p.Client.Create(ctx, cm)
+	}
+	if err != nil {
+		return fmt.Errorf("impossibile salvare il ConfigMap della CRL: %w", err)
+	}
+	return nil
+}
+
+// revokedCertificates unisce i dispositivi attualmente deattivati o sospesi, le revoche definitive già pubblicate
+// ancora valide e quelle nuove. I certificati scaduti non hanno bisogno di essere revocati e vengono scartati.
+func (p *RevocationPublisher) revokedCertificates(ctx context.Context, cm *corev1.ConfigMap, permanent []RevokedCertificate, now time.Time) ([]RevokedCertificate, error) {
+	bySerial := map[string]RevokedCertificate{}
+
+	if data := cm.Data[CRLRevokedKey]; data != "" {
+		var published []RevokedCertificate
+		if err := json.Unmarshal([]byte(data), &published); err != nil {
+			return nil, fmt.Errorf("contenuto di %s non valido nel ConfigMap della CRL: %w", CRLRevokedKey, err)
+		}
+		for _, rc := range published {
+			if isPermanentRevocation(rc.Reason) {
+				bySerial[rc.SerialNumber] = rc
+			}
+		}
+	}
+	for _, rc := range permanent {
+		if _, alreadyRevoked := bySerial[rc.SerialNumber]; !alreadyRevoked {
+			bySerial[rc.SerialNumber] = rc
+		}
+	}
+
+	var registrations devicesv1alpha1.DeviceRegistrationList
+	if err := p.Client.List(ctx, &registrations); err != nil {
+		return nil, fmt.Errorf("impossibile elencare le registrazioni: %w", err)
+	}
+	for i := range registrations.Items {
+		dr := &registrations.Items[i]
+		var reason string
+		switch dr.Status.Phase {
+		case PhaseDeactivated:
+			reason = RevocationReasonDeactivated
+		case PhaseSuspended:
+			reason = RevocationReasonSuspended
+		default:
+			continue
+		}
+		if dr.Status.DuplicateOf != "" || dr.Status.CertificateSerialNumber == "" || dr.Status.CertificateNotAfter == nil {
+			continue
+		}
+		if _, alreadyRevoked := bySerial[dr.Status.CertificateSerialNumber]; alreadyRevoked {
+			continue
+		}
+		revokedAt := now
+		if dr.Status.CertificateRevokedAt != nil {
+			revokedAt = dr.Status.CertificateRevokedAt.UTC()
+		}
+		bySerial[dr.Status.CertificateSerialNumber] = RevokedCertificate{
+			SerialNumber: dr.Status.CertificateSerialNumber,
+			DeviceUUID:   dr.Status.DeviceUUID,
+			RevokedAt:    revokedAt,
+			NotAfter:     dr.Status.CertificateNotAfter.UTC(),
+			Reason:       reason,
+		}
+	}
+
+	revoked := make([]RevokedCertificate, 0, len(bySerial))
+	for _, rc := range bySerial {
+		if rc.NotAfter.After(now) {
+			revoked = append(revoked, rc)
+		}
+	}
+	sort.Slice(revoked, func(i, j int) bool { return revoked[i].SerialNumber < revoked[j].SerialNumber })
+	return revoked, nil
+}
+
+func (p *RevocationPublisher) validity() time.Duration {
+	if p.Validity > 0 {
+		return p.Validity
+	}
+	return DefaultCRLValidity
+}
+
+// isPermanentRevocation indica se il motivo è quello di una revoca definitiva, conservata in revoked.json
+// finché il certificato non scade.
+func isPermanentRevocation(reason string) bool {
+	switch reason {
+	case RevocationReasonDeleted, RevocationReasonQuarantined, RevocationReasonRetired, RevocationReasonSuperseded:
+		return true
+	}
+	return false
+}
+
+// revocationListEntry converte una revoca nella voce della CRL. Un dispositivo deattivato o sospeso può
+// tornare attivo, quindi la sua revoca è una sospensione (certificateHold); le altre revoche sono definitive.
+func revocationListEntry(rc RevokedCertificate) (x509.RevocationListEntry, error) {
+	serial, ok := new(big.Int).SetString(rc.SerialNumber, 16)
+	if !ok {
+		return x509.RevocationListEntry{}, fmt.Errorf("numero di serie non valido: %q", rc.SerialNumber)
+	}
+	reasonCode := 6 // certificateHold
+	switch rc.Reason {
+	case RevocationReasonDeleted, RevocationReasonRetired:
+		reasonCode = 5 // cessationOfOperation
+	case RevocationReasonQuarantined:
+		reasonCode = 1 // keyCompromise
+	case RevocationReasonSuperseded:
+		reasonCode = 4 // superseded
+	}
+	return x509.RevocationListEntry{
+		SerialNumber:   serial,
+		RevocationTime: rc.RevokedAt,
+		ReasonCode:     reasonCode,
+	}, nil
+}
+
+// publishRevocations chiede la ripubblicazione della CRL dopo un cambio di fase del dispositivo.
+func (r *DeviceRegistrationReconciler) publishRevocations() {
+	if r.Revocation != nil {
+		r.Revocation.Trigger()
+	}
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+func TestRevocationPublisherSignsDeactivatedAndDeletedDevices(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := devicesv1alpha1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	notAfter := metav1.NewTime(time.Now().Add(time.Hour))
+	deactivated := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "deactivated", Namespace: "devices"},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:                   PhaseDeactivated,
+			DeviceUUID:              "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a",
+			CertificateSerialNumber: "a1",
+			CertificateNotAfter:     &notAfter,
+		},
+	}
+	approved := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "approved", Namespace: "devices"},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:                   PhaseApproved,
+			DeviceUUID:              "0b6f0c1c-6a55-4f0e-b8a4-5a1f1e2d3c4b",
+			CertificateSerialNumber: "b2",
+			CertificateNotAfter:     &notAfter,
+		},
+	}
+	deleted := &devicesv1alpha1.DeviceRegistration{
+		ObjectMeta: metav1.ObjectMeta{Name: "deleted", Namespace: "devices"},
+		Status: devicesv1alpha1.DeviceRegistrationStatus{
+			Phase:                   PhaseApproved,
+			DeviceUUID:              "9d7e3c2a-1b4f-4e6d-8a9b-0c1d2e3f4a5b",
+			CertificateSerialNumber: "c3",
+			CertificateNotAfter:     &notAfter,
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(deactivated, approved).Build()
+	ca := &CertificateAuthority{Client: c, Reader: c, SecretName: "ca", Namespace: "system"}
+	publisher := &RevocationPublisher{Client: c, Reader: c, CA: ca, ConfigMapName: "crl", Namespace: "system"}
+
+	if err := publisher.RecordDeletion(ctx, deleted); err != nil {
+		t.Fatal(err)
+	}
+	// Una seconda pubblicazione deve mantenere la cancellazione, che non ha più una registrazione.
+	if err := publisher.Publish(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := c.Get(ctx, types.NamespacedName{Name: "crl", Namespace: "system"}, cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data[CRLNumberKey] != "2" {
+		t.Fatalf("expected CRL number 2, got %q", cm.Data[CRLNumberKey])
+	}
+	block, _ := pem.Decode([]byte(cm.Data[CRLPEMKey]))
+	if block == nil {
+		t.Fatal("crl.pem does not contain a PEM block")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crl.CheckSignatureFrom(ca.cert); err != nil {
+		t.Fatalf("CRL is not signed by the CA: %v", err)
+	}
+	// Il gateway verifica i certificati presentati per il rinnovo con la CA pubblicata accanto alla CRL.
+	if cm.Data[CRLCACertKey] != string(ca.certPEM) {
+		t.Fatalf("ca.crt = %q, want the CA certificate", cm.Data[CRLCACertKey])
+	}
+
+	reasons := map[string]int{}
+	for _, entry := range crl.RevokedCertificateEntries {
+		reasons[formatSerialNumber(entry.SerialNumber)] = entry.ReasonCode
+	}
+	if len(reasons) != 2 || reasons["a1"] != 6 || reasons["c3"] != 5 {
+		t.Fatalf("unexpected CRL entries (serial -> reason): %v", reasons)
+	}
+}
@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+
+	devicesv1alpha1 "github.com/antonio/device-operator/api/v1alpha1"
+)
+
+const (
+	// TombstoneConfigMapPrefix precede l'impronta della chiave pubblica nel nome del ConfigMap che conserva
+	// la lapide di un dispositivo cancellato. Ogni lapide ha il suo ConfigMap, nel namespace delle registrazioni,
+	// così il numero di dispositivi cancellati non incontra il limite di dimensione di un singolo oggetto.
+	TombstoneConfigMapPrefix = "device-tombstone-"
+
+	// TombstoneLabel contraddistingue i ConfigMap delle lapidi, per elencarli con kubectl get -l.
+	TombstoneLabel = "devices.example.com/tombstone"
+
+	// TombstoneDataKey è la chiave del ConfigMap che contiene la lapide in JSON.
+	TombstoneDataKey = "tombstone"
+
+	// SkipTombstoneAnnotation, impostata a "true" da un amministratore su una registrazione in cancellazione,
+	// permette di completarla senza lapide quando la lapide non può essere scritta.
+	SkipTombstoneAnnotation = "devices.example.com/skip-tombstone"
+
+	// ReasonKeyPreviouslyDeleted è il motivo della condizione AwaitingApproval quando la chiave
+	// appartiene a un dispositivo cancellato.
+	ReasonKeyPreviouslyDeleted = "KeyPreviouslyDeleted"
+)
+
+// Tombstone ricorda un dispositivo cancellato. Finché esiste, una nuova richiesta con la stessa chiave
+// non viene approvata automaticamente ma attende la decisione di un amministratore.
+// Per permettere di nuovo l'approvazione automatica basta cancellare il ConfigMap della lapide.
+type Tombstone struct {
+	Name           string    `json:"name"`
+	DeviceUUID     string    `json:"deviceUUID"`
+	KeyFingerprint string    `json:"keyFingerprint"`
+	Phase          string    `json:"phase"`
+	SerialNumber   string    `json:"serialNumber,omitempty"`
+	DeletedAt      time.Time `json:"deletedAt"`
+}
+
+// tombstoneConfigMapName restituisce il nome del ConfigMap con la lapide della chiave indicata.
+func tombstoneConfigMapName(fingerprint string) string {
+	return TombstoneConfigMapPrefix + fingerprint
+}
+
+// writeTombstone registra la lapide della registrazione in cancellazione.
+// Una lapide già presente per la stessa chiave viene sostituita.
+func (r *DeviceRegistrationReconciler) writeTombstone(ctx context.Context, dr *devicesv1alpha1.DeviceRegistration) error {
+	if dr.Status.KeyFingerprint == "" {
+		return nil
+	}
+	data, err := json.Marshal(Tombstone{
+		Name:           dr.Name,
+		DeviceUUID:     dr.Status.DeviceUUID,
+		KeyFingerprint: dr.Status.KeyFingerprint,
+		Phase:          dr.Status.Phase,
+		SerialNumber:   dr.Status.CertificateSerialNumber,
+		DeletedAt:      time.Now().UTC().Truncate(time.Second),
+	})
+	if err != nil {
+		return err
+	}
+
+	name := tombstoneConfigMapName(dr.Status.KeyFingerprint)
+	labels := map[string]string{
+		TombstoneLabel:      "true",
+		KeyFingerprintLabel: keyFingerprintLabelValue(dr.Status.KeyFingerprint),
+	}
+	cm := &corev1.ConfigMap{}
+	err = r.Get(ctx, types.NamespacedName{Name: name, Namespace: dr.Namespace}, cm)
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{}
+		cm.Name = name
+		cm.Namespace = dr.Namespace
+		cm.Labels = labels
+		cm.Data = map[string]string{TombstoneDataKey: string(data)}
+		return r.Create(ctx, cm)
+	}
+	if err != nil {
+		return fmt.Errorf("impossibile leggere il ConfigMap della lapide: %w", err)
+	}
+	if cm.Labels == nil {
+		cm.Labels = map[string]string{}
+	}
+	for key, value := range labels {
+		cm.Labels[key] = value
+	}
+	cm.Data = map[string]string{TombstoneDataKey: string(data)}
+	return r.Update(ctx, cm)
+}
+
+// findTombstone restituisce la lapide di un dispositivo cancellato con la stessa chiave, se esiste.
+func (r *DeviceRegistrationReconciler) findTombstone(ctx context.Context, namespace, fingerprint string) (*Tombstone, error) {
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, types.NamespacedName{Name: tombstoneConfigMapName(fingerprint), Namespace: namespace}, cm); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("impossibile leggere il ConfigMap della lapide: %w", err)
+	}
+	var tombstone Tombstone
+	if err := json.Unmarshal([]byte(cm.Data[TombstoneDataKey]), &tombstone); err != nil {
+		return nil, fmt.Errorf("lapide non valida per la chiave %s: %w", fingerprint, err)
+	}
+	return &tombstone, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// challengeTTL è il tempo a disposizione del dispositivo per firmare il nonce e inviare /enroll.
+	challengeTTL = 2 * time.Minute
+	// maxPendingChallenges limita la memoria occupata dai nonce emessi e non ancora usati.
+	maxPendingChallenges = 10000
+	// nonceSize è la lunghezza in byte del nonce casuale.
+	nonceSize = 32
+)
+
+var (
+	errChallengeUnknown  = errors.New("nonce sconosciuto, già usato o scaduto")
+	errTooManyChallenges = errors.New("troppe challenge in sospeso, riprovare più tardi")
+)
+
+// ChallengeResponse è ciò che il Gateway restituisce a POST /enroll/challenge.
+// Il dispositivo deve firmare la stringa Nonce (così come ricevuta) con la propria chiave privata.
+type ChallengeResponse struct {
+	Nonce     string `json:"nonce"`
+	ExpiresAt string `json:"expiresAt"` // Formato RFC3339
+}
+
+// challengeStore conserva in memoria i nonce emessi finché non vengono usati o scadono.
+// Ogni nonce è monouso: viene rimosso al primo tentativo di consumo, riuscito o meno.
+type challengeStore struct {
+	mu      sync.Mutex
+	pending map[string]time.Time
+	ttl     time.Duration
+	now     func() time.Time
+}
+
+func newChallengeStore(ttl time.Duration) *challengeStore {
+	return &challengeStore{
+		pending: make(map[string]time.Time),
+		ttl:     ttl,
+		now:     time.Now,
+	}
+}
+
+// issue genera un nuovo nonce e ne restituisce la scadenza.
+func (s *challengeStore) issue() (string, time.Time, error) {
+	buf := make([]byte, nonceSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	// Prima di rifiutare per eccesso di challenge, eliminiamo quelle scadute.
+	if len(s.pending) >= maxPendingChallenges {
+		for n, expiry := range s.pending {
+			if now.After(expiry) {
+				delete(s.pending, n)
+			}
+		}
+		if len(s.pending) >= maxPendingChallenges {
+			return "", time.Time{}, errTooManyChallenges
+		}
+	}
+
+	expiresAt := now.Add(s.ttl)
+	s.pending[nonce] = expiresAt
+	return nonce, expiresAt, nil
+}
+
+// consume verifica che il nonce sia stato emesso e non sia scaduto, invalidandolo.
+func (s *challengeStore) consume(nonce string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expiry, ok := s.pending[nonce]
+	if !ok {
+		return errChallengeUnknown
+	}
+	delete(s.pending, nonce)
+	if s.now().After(expiry) {
+		return errChallengeUnknown
+	}
+	return nil
+}
+
+// serveChallenge gestisce POST /enroll/challenge, primo passo del protocollo di enrollment.
+func (h *gatewayHandler) serveChallenge(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Ricevuta richiesta: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "Metodo non consentito. Usare POST.", false)
+		return
+	}
+	if h.rejectWhileDraining(w, r) {
+		return
+	}
+
+	// Le challenge consumano lo stesso bucket per client di POST /enroll: senza limite un solo client
+	// potrebbe esaurire maxPendingChallenges e bloccare enrollment e rinnovi di tutti gli altri.
+	client, err := clientIP(r, h.limits.config.TrustedProxies)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Impossibile determinare l'indirizzo del client.", false)
+		return
+	}
+	if retryAfter, err := h.limits.allowClient(client); err != nil || retryAfter > 0 {
+		log.Printf("Richiesta di challenge da %s rifiutata: limite per client superato.", client)
+		writeTooManyRequests(w, r, retryAfter, "Troppe richieste di challenge da questo indirizzo. Riprovare più tardi.")
+		return
+	}
+
+	nonce, expiresAt, err := h.challenges.issue()
+	if err != nil {
+		log.Printf("ERRORE: Impossibile generare la challenge: %v", err)
+		if errors.Is(err, errTooManyChallenges) {
+			writeError(w, r, http.StatusServiceUnavailable, errorCodeUnavailable, err.Error(), true)
+			return
+		}
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la generazione della challenge.", true)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ChallengeResponse{
+		Nonce:     nonce,
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+	})
+}
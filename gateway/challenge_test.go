@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChallengeStoreIsSingleUse(t *testing.T) {
+	store := newChallengeStore(time.Minute)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	nonce, _, err := store.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.consume(nonce); err != nil {
+		t.Fatalf("first consume failed: %v", err)
+	}
+	if err := store.consume(nonce); err == nil {
+		t.Fatal("nonce was accepted twice")
+	}
+
+	expired, _, err := store.issue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(2 * time.Minute)
+	if err := store.consume(expired); err == nil {
+		t.Fatal("expired nonce was accepted")
+	}
+}
+
+func TestServeChallengeIsRateLimitedPerClient(t *testing.T) {
+	h := &gatewayHandler{
+		challenges: newChallengeStore(time.Minute),
+		limits:     newEnrollmentLimiter(rateLimitConfig{PerIPRate: 1, PerIPBurst: 2, GlobalRate: 1, GlobalBurst: 1}),
+		lifecycle:  newLifecycle(),
+	}
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/enroll/challenge", nil)
+		r.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.serveChallenge(rec, r)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := request("203.0.113.7:4000"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: status = %d, want 200", i, rec.Code)
+		}
+	}
+	rec := request("203.0.113.7:4000")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("status = %d, Retry-After = %q, want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if rec := request("203.0.113.8:4000"); rec.Code != http.StatusOK {
+		t.Fatalf("other client: status = %d, want 200", rec.Code)
+	}
+}
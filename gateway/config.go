@@ -0,0 +1,305 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+// gatewayConfig raccoglie la configurazione del gateway. I valori si leggono, in ordine di precedenza
+// crescente, dai valori predefiniti, dal file YAML indicato con --config, dalle variabili d'ambiente
+// e dai flag della riga di comando.
+type gatewayConfig struct {
+	// ListenAddress è l'indirizzo su cui il gateway accetta le richieste.
+	ListenAddress string `json:"listenAddress"`
+	// HealthAddress è l'indirizzo, sempre in chiaro, degli endpoint /healthz e /readyz usati dalle sonde di Kubernetes.
+	HealthAddress string `json:"healthAddress"`
+	// ReadTimeout, WriteTimeout e IdleTimeout sono i timeout del server HTTP. WriteTimeout deve
+	// superare sia RegistrationTimeout sia l'attesa massima di GET /enroll/{ticket}.
+	ReadTimeout  metav1.Duration `json:"readTimeout"`
+	WriteTimeout metav1.Duration `json:"writeTimeout"`
+	IdleTimeout  metav1.Duration `json:"idleTimeout"`
+	// ShutdownTimeout è il tempo concesso alle richieste in corso alla ricezione di SIGTERM.
+	ShutdownTimeout metav1.Duration `json:"shutdownTimeout"`
+	// Namespace è il namespace in cui il gateway crea le DeviceRegistration.
+	Namespace string `json:"namespace"`
+	// Kubeconfig permette di eseguire il gateway fuori dal cluster; se vuoto si usa la configurazione del Pod.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Registration descrive la risorsa creata per ogni richiesta di enrollment.
+	Registration registrationResourceConfig `json:"registration"`
+	// RegistrationTimeout è il tempo massimo per cui il gateway attende l'operatore mantenendo aperta la connessione.
+	RegistrationTimeout metav1.Duration `json:"registrationTimeout"`
+	// CRLConfigMapName è il ConfigMap in cui l'operatore pubblica la CRL.
+	CRLConfigMapName string `json:"crlConfigMapName"`
+	// RateLimits sono i limiti applicati alla creazione delle DeviceRegistration.
+	RateLimits rateLimitSettings `json:"rateLimits"`
+	// TLS descrive i file del Secret montato; senza certificato il gateway serve in chiaro.
+	TLS tlsSettings `json:"tls"`
+}
+
+// registrationResourceConfig identifica la Custom Resource gestita dall'operatore.
+// I valori devono corrispondere esattamente a quelli nella CRD.
+type registrationResourceConfig struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	// NamePrefix precede il suffisso casuale nel nome delle DeviceRegistration create.
+	NamePrefix string `json:"namePrefix"`
+}
+
+// rateLimitSettings sono i limiti su POST /enroll, espressi al minuto.
+type rateLimitSettings struct {
+	PerIPPerMinute  int `json:"perIPPerMinute"`
+	PerIPBurst      int `json:"perIPBurst"`
+	GlobalPerMinute int `json:"globalPerMinute"`
+	GlobalBurst     int `json:"globalBurst"`
+	// MaxPending è il numero massimo di registrazioni in attesa nel namespace oltre il quale
+	// il gateway non ne crea di nuove.
+	MaxPending int `json:"maxPending"`
+	// TrustedProxies sono gli indirizzi o le reti CIDR dei proxy di cui ci fidiamo per l'header X-Forwarded-For.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+}
+
+// defaultGatewayConfig restituisce la configurazione usata quando nulla viene specificato.
+func defaultGatewayConfig() gatewayConfig {
+	return gatewayConfig{
+		ListenAddress:   ":8080",
+		HealthAddress:   ":8081",
+		ReadTimeout:     metav1.Duration{Duration: 30 * time.Second},
+		WriteTimeout:    metav1.Duration{Duration: 150 * time.Second},
+		IdleTimeout:     metav1.Duration{Duration: 2 * time.Minute},
+		ShutdownTimeout: metav1.Duration{Duration: 30 * time.Second},
+		Namespace:       "default",
+		Registration: registrationResourceConfig{
+			Group:      deviceRegistrationGVR.Group,
+			Version:    deviceRegistrationGVR.Version,
+			Resource:   deviceRegistrationGVR.Resource,
+			NamePrefix: "dev-reg-",
+		},
+		RegistrationTimeout: metav1.Duration{Duration: 2 * time.Minute},
+		CRLConfigMapName:    defaultCRLConfigMapName,
+		RateLimits: rateLimitSettings{
+			PerIPPerMinute:  defaultEnrollRatePerIP,
+			PerIPBurst:      defaultEnrollBurstPerIP,
+			GlobalPerMinute: defaultEnrollGlobalRate,
+			GlobalBurst:     defaultEnrollGlobalBurst,
+			MaxPending:      defaultMaxPendingEnrollments,
+		},
+	}
+}
+
+// gatewayEnv associa le variabili d'ambiente ai flag corrispondenti.
+var gatewayEnv = map[string]string{
+	"GATEWAY_LISTEN_ADDRESS":    "listen-address",
+	"POD_NAMESPACE":             "namespace",
+	"REGISTRATION_GROUP":        "registration-group",
+	"REGISTRATION_VERSION":      "registration-version",
+	"REGISTRATION_RESOURCE":     "registration-resource",
+	"REGISTRATION_NAME_PREFIX":  "registration-name-prefix",
+	"REGISTRATION_TIMEOUT":      "registration-timeout",
+	"CRL_CONFIGMAP_NAME":        "crl-configmap-name",
+	"ENROLL_RATE_PER_IP":        "enroll-rate-per-ip",
+	"ENROLL_BURST_PER_IP":       "enroll-burst-per-ip",
+	"ENROLL_GLOBAL_RATE":        "enroll-global-rate",
+	"ENROLL_GLOBAL_BURST":       "enroll-global-burst",
+	"MAX_PENDING_REGISTRATIONS": "max-pending-registrations",
+	"TRUSTED_PROXIES":           "trusted-proxies",
+	"TLS_CERT_FILE":             "tls-cert-file",
+	"TLS_KEY_FILE":              "tls-key-file",
+	"TLS_CLIENT_CA_FILE":        "tls-client-ca-file",
+	"TLS_REQUIRE_CLIENT_CERT":   "tls-require-client-cert",
+}
+
+// stringListValue è un flag che accetta un elenco di valori separati da virgole.
+type stringListValue []string
+
+func (v *stringListValue) String() string { return strings.Join(*v, ",") }
+
+func (v *stringListValue) Set(value string) error {
+	*v = nil
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			*v = append(*v, entry)
+		}
+	}
+	return nil
+}
+
+// newGatewayFlagSet registra i flag del gateway, ciascuno legato a un campo di config.
+func newGatewayFlagSet(config *gatewayConfig, configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("gateway", flag.ContinueOnError)
+	fs.StringVar(configFile, "config", "", "File YAML con la configurazione del gateway.")
+	fs.StringVar(&config.ListenAddress, "listen-address", config.ListenAddress, "Indirizzo su cui il gateway accetta le richieste.")
+	fs.StringVar(&config.HealthAddress, "health-address", config.HealthAddress, "Indirizzo degli endpoint /healthz e /readyz.")
+	fs.DurationVar(&config.ReadTimeout.Duration, "read-timeout", config.ReadTimeout.Duration, "Tempo massimo per leggere una richiesta.")
+	fs.DurationVar(&config.WriteTimeout.Duration, "write-timeout", config.WriteTimeout.Duration, "Tempo massimo per elaborare una richiesta e scrivere la risposta.")
+	fs.DurationVar(&config.IdleTimeout.Duration, "idle-timeout", config.IdleTimeout.Duration, "Tempo massimo di inattività di una connessione keep-alive.")
+	fs.DurationVar(&config.ShutdownTimeout.Duration, "shutdown-timeout", config.ShutdownTimeout.Duration, "Tempo concesso alle richieste in corso alla ricezione di SIGTERM.")
+	fs.StringVar(&config.Namespace, "namespace", config.Namespace, "Namespace in cui creare le DeviceRegistration.")
+	fs.StringVar(&config.Kubeconfig, "kubeconfig", config.Kubeconfig, "Kubeconfig per eseguire il gateway fuori dal cluster.")
+	fs.StringVar(&config.Registration.Group, "registration-group", config.Registration.Group, "Gruppo API delle DeviceRegistration.")
+	fs.StringVar(&config.Registration.Version, "registration-version", config.Registration.Version, "Versione API delle DeviceRegistration.")
+	fs.StringVar(&config.Registration.Resource, "registration-resource", config.Registration.Resource, "Nome plurale della risorsa DeviceRegistration.")
+	fs.StringVar(&config.Registration.NamePrefix, "registration-name-prefix", config.Registration.NamePrefix, "Prefisso del nome delle DeviceRegistration create.")
+	fs.DurationVar(&config.RegistrationTimeout.Duration, "registration-timeout", config.RegistrationTimeout.Duration, "Attesa massima della decisione dell'operatore a connessione aperta.")
+	fs.StringVar(&config.CRLConfigMapName, "crl-configmap-name", config.CRLConfigMapName, "ConfigMap in cui l'operatore pubblica la CRL.")
+	fs.IntVar(&config.RateLimits.PerIPPerMinute, "enroll-rate-per-ip", config.RateLimits.PerIPPerMinute, "Richieste POST /enroll al minuto per indirizzo IP.")
+	fs.IntVar(&config.RateLimits.PerIPBurst, "enroll-burst-per-ip", config.RateLimits.PerIPBurst, "Raffica massima di richieste per indirizzo IP.")
+	fs.IntVar(&config.RateLimits.GlobalPerMinute, "enroll-global-rate", config.RateLimits.GlobalPerMinute, "Registrazioni create al minuto da tutti i client.")
+	fs.IntVar(&config.RateLimits.GlobalBurst, "enroll-global-burst", config.RateLimits.GlobalBurst, "Raffica massima di registrazioni create.")
+	fs.IntVar(&config.RateLimits.MaxPending, "max-pending-registrations", config.RateLimits.MaxPending, "Registrazioni in attesa oltre le quali il gateway non ne crea di nuove.")
+	fs.Var((*stringListValue)(&config.RateLimits.TrustedProxies), "trusted-proxies", "Indirizzi o reti CIDR dei proxy fidati, separati da virgole.")
+	fs.StringVar(&config.TLS.CertFile, "tls-cert-file", config.TLS.CertFile, "Certificato TLS del gateway (PEM).")
+	fs.StringVar(&config.TLS.KeyFile, "tls-key-file", config.TLS.KeyFile, "Chiave privata TLS del gateway (PEM).")
+	fs.StringVar(&config.TLS.ClientCAFile, "tls-client-ca-file", config.TLS.ClientCAFile, "Bundle delle CA con cui verificare i certificati client.")
+	fs.BoolVar(&config.TLS.RequireClientCert, "tls-require-client-cert", config.TLS.RequireClientCert, "Rifiuta le connessioni senza certificato client valido.")
+	return fs
+}
+
+// loadGatewayConfig costruisce e valida la configurazione a partire dagli argomenti della riga di comando.
+func loadGatewayConfig(args []string) (gatewayConfig, error) {
+	config := defaultGatewayConfig()
+	var configFile string
+	fs := newGatewayFlagSet(&config, &configFile)
+	if err := fs.Parse(args); err != nil {
+		return config, err
+	}
+	// Ricordiamo i flag passati esplicitamente: vanno applicati per ultimi.
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+	if configFile == "" {
+		configFile = os.Getenv("GATEWAY_CONFIG")
+	}
+
+	// Ripartiamo dai valori predefiniti e applichiamo, nell'ordine, file, variabili d'ambiente e flag.
+	// I flag restano legati ai campi di config, quindi li riusiamo per interpretare anche le variabili d'ambiente.
+	config = defaultGatewayConfig()
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return config, fmt.Errorf("impossibile leggere il file di configurazione: %w", err)
+		}
+		if err := yaml.UnmarshalStrict(data, &config); err != nil {
+			return config, fmt.Errorf("file di configurazione %s non valido: %w", configFile, err)
+		}
+	}
+	for env, name := range gatewayEnv {
+		if value := os.Getenv(env); value != "" {
+			if err := fs.Set(name, value); err != nil {
+				return config, fmt.Errorf("variabile d'ambiente %s non valida: %w", env, err)
+			}
+		}
+	}
+	for name, value := range explicit {
+		if name == "config" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return config, err
+		}
+	}
+	return config, config.validate()
+}
+
+// validate controlla la coerenza della configurazione all'avvio, riportando tutti gli errori insieme.
+func (c *gatewayConfig) validate() error {
+	var errs []error
+	if c.ListenAddress == "" {
+		errs = append(errs, errors.New("listenAddress non può essere vuoto"))
+	}
+	if c.HealthAddress == "" || c.HealthAddress == c.ListenAddress {
+		errs = append(errs, errors.New("healthAddress deve essere impostato e diverso da listenAddress"))
+	}
+	for name, value := range map[string]time.Duration{
+		"readTimeout":     c.ReadTimeout.Duration,
+		"idleTimeout":     c.IdleTimeout.Duration,
+		"shutdownTimeout": c.ShutdownTimeout.Duration,
+	} {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s deve essere positivo", name))
+		}
+	}
+	if c.WriteTimeout.Duration <= c.RegistrationTimeout.Duration || c.WriteTimeout.Duration <= maxEnrollmentLongPoll {
+		errs = append(errs, fmt.Errorf("writeTimeout (%s) deve superare registrationTimeout (%s) e l'attesa massima di GET /enroll/{ticket} (%s)",
+			c.WriteTimeout.Duration, c.RegistrationTimeout.Duration, maxEnrollmentLongPoll))
+	}
+	if msgs := validation.IsDNS1123Label(c.Namespace); len(msgs) > 0 {
+		errs = append(errs, fmt.Errorf("namespace %q non valido: %s", c.Namespace, strings.Join(msgs, ", ")))
+	}
+	if c.Registration.Group == "" || c.Registration.Version == "" || c.Registration.Resource == "" {
+		errs = append(errs, errors.New("registration.group, registration.version e registration.resource sono obbligatori"))
+	}
+	// Al prefisso si aggiungono 8 caratteri casuali: il nome deve restare un sottodominio DNS valido.
+	if msgs := validation.IsDNS1123Subdomain(c.Registration.NamePrefix + "00000000"); len(msgs) > 0 {
+		errs = append(errs, fmt.Errorf("registration.namePrefix %q non valido: %s", c.Registration.NamePrefix, strings.Join(msgs, ", ")))
+	}
+	if c.RegistrationTimeout.Duration <= 0 {
+		errs = append(errs, errors.New("registrationTimeout deve essere positivo"))
+	}
+	if c.CRLConfigMapName == "" {
+		errs = append(errs, errors.New("crlConfigMapName non può essere vuoto"))
+	}
+	for name, value := range map[string]int{
+		"rateLimits.perIPPerMinute":  c.RateLimits.PerIPPerMinute,
+		"rateLimits.perIPBurst":      c.RateLimits.PerIPBurst,
+		"rateLimits.globalPerMinute": c.RateLimits.GlobalPerMinute,
+		"rateLimits.globalBurst":     c.RateLimits.GlobalBurst,
+		"rateLimits.maxPending":      c.RateLimits.MaxPending,
+	} {
+		if value <= 0 {
+			errs = append(errs, fmt.Errorf("%s deve essere un intero positivo", name))
+		}
+	}
+	if _, err := parseTrustedProxies(c.RateLimits.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.TLS.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// registrationGVR restituisce lo "schema" della Custom Resource (GVR: Group, Version, Resource).
+func (c *gatewayConfig) registrationGVR() schema.GroupVersionResource {
+	return schema.GroupVersionResource{
+		Group:    c.Registration.Group,
+		Version:  c.Registration.Version,
+		Resource: c.Registration.Resource,
+	}
+}
+
+// restConfig restituisce la configurazione per l'API di Kubernetes: quella del kubeconfig, se indicato,
+// altrimenti quella del Pod in cui il gateway è in esecuzione. Fuori dal cluster, senza --kubeconfig,
+// si usano $KUBECONFIG o ~/.kube/config come fa kubectl.
+func (c *gatewayConfig) restConfig() (*rest.Config, error) {
+	if c.Kubeconfig != "" {
+		config, err := clientcmd.BuildConfigFromFlags("", c.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("impossibile caricare il kubeconfig %s: %w", c.Kubeconfig, err)
+		}
+		return config, nil
+	}
+	// rest.InClusterConfig() è la magia che permette a un'applicazione
+	// di trovare e autenticarsi all'API di Kubernetes quando è in esecuzione
+	// all'interno di un Pod nel cluster.
+	config, err := rest.InClusterConfig()
+	if err == nil {
+		return config, nil
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	config, kubeconfigErr := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if kubeconfigErr != nil {
+		return nil, fmt.Errorf("impossibile ottenere la configurazione del cluster: %w. Esegui il gateway in un cluster Kubernetes oppure indica un kubeconfig con --kubeconfig", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadGatewayConfigPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "gateway.yaml")
+	if err := os.WriteFile(file, []byte(`
+listenAddress: ":9000"
+namespace: from-file
+registrationTimeout: 5m
+writeTimeout: 6m
+rateLimits:
+  perIPPerMinute: 10
+  trustedProxies: ["10.0.0.0/8"]
+`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("POD_NAMESPACE", "from-env")
+	t.Setenv("ENROLL_RATE_PER_IP", "20")
+
+	config, err := loadGatewayConfig([]string{"--config", file, "--enroll-rate-per-ip", "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddress != ":9000" || config.RegistrationTimeout.Duration != 5*time.Minute {
+		t.Fatalf("values from the file were not applied: %+v", config)
+	}
+	if config.Namespace != "from-env" {
+		t.Fatalf("namespace = %q, environment variables must override the file", config.Namespace)
+	}
+	if config.RateLimits.PerIPPerMinute != 30 {
+		t.Fatalf("perIPPerMinute = %d, flags must override the environment", config.RateLimits.PerIPPerMinute)
+	}
+	if len(config.RateLimits.TrustedProxies) != 1 || config.RateLimits.GlobalBurst != defaultEnrollGlobalBurst {
+		t.Fatalf("values not set anywhere must keep their defaults: %+v", config.RateLimits)
+	}
+}
+
+func TestGatewayConfigValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*gatewayConfig)
+	}{
+		{name: "invalid namespace", mutate: func(c *gatewayConfig) { c.Namespace = "Not_Valid" }},
+		{name: "invalid name prefix", mutate: func(c *gatewayConfig) { c.Registration.NamePrefix = "Dev_" }},
+		{name: "missing resource", mutate: func(c *gatewayConfig) { c.Registration.Resource = "" }},
+		{name: "non-positive timeout", mutate: func(c *gatewayConfig) { c.RegistrationTimeout.Duration = 0 }},
+		{name: "write timeout shorter than the wait", mutate: func(c *gatewayConfig) { c.WriteTimeout.Duration = c.RegistrationTimeout.Duration }},
+		{name: "health on the API address", mutate: func(c *gatewayConfig) { c.HealthAddress = c.ListenAddress }},
+		{name: "non-positive rate", mutate: func(c *gatewayConfig) { c.RateLimits.GlobalPerMinute = 0 }},
+		{name: "invalid trusted proxy", mutate: func(c *gatewayConfig) { c.RateLimits.TrustedProxies = []string{"nope"} }},
+		{name: "certificate without key", mutate: func(c *gatewayConfig) { c.TLS.CertFile = "tls.crt" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := defaultGatewayConfig()
+			tt.mutate(&config)
+			if err := config.validate(); err == nil {
+				t.Fatal("validate() accepted an invalid configuration")
+			}
+		})
+	}
+
+	config := defaultGatewayConfig()
+	if err := config.validate(); err != nil {
+		t.Fatalf("the default configuration must be valid: %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const (
+	// enrollmentTicketAnnotation conserva l'hash SHA-256 del segreto del ticket: il segreto in chiaro
+	// è noto solo al dispositivo.
+	enrollmentTicketAnnotation = "devices.example.com/enrollment-ticket-sha256"
+	// enrollmentTicketTTL è il tempo oltre il quale una registrazione ancora in attesa viene
+	// considerata scaduta: il dispositivo deve ripetere l'enrollment.
+	enrollmentTicketTTL = 24 * time.Hour
+	// maxEnrollmentLongPoll limita l'attesa richiesta con il parametro wait di GET /enroll/{ticket}.
+	maxEnrollmentLongPoll = 60 * time.Second
+	// enrollmentRetryAfter è l'intervallo, in secondi, suggerito al dispositivo tra due interrogazioni.
+	enrollmentRetryAfter = 5
+	// ticketSecretSize è la lunghezza in byte del segreto casuale del ticket.
+	ticketSecretSize = 32
+)
+
+// Esiti di un enrollment comunicati al dispositivo nel campo status della risposta.
+const (
+	enrollmentStatusPending  = "Pending"
+	enrollmentStatusApproved = "Approved"
+	enrollmentStatusRejected = "Rejected"
+	enrollmentStatusExpired  = "Expired"
+)
+
+// newTicketSecret genera il segreto di un ticket e il suo hash da salvare sulla DeviceRegistration.
+func newTicketSecret() (secret, hash string, err error) {
+	buf := make([]byte, ticketSecretSize)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(buf)
+	return secret, ticketSecretHash(secret), nil
+}
+
+func ticketSecretHash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// enrollmentTicket compone il ticket restituito al dispositivo: il nome della DeviceRegistration
+// e il segreto, separati da un punto.
+func enrollmentTicket(name, secret string) string {
+	return name + "." + secret
+}
+
+// parseEnrollmentTicket separa un ticket nel nome della DeviceRegistration e nel segreto.
+func parseEnrollmentTicket(ticket string) (name, secret string, ok bool) {
+	name, secret, ok = strings.Cut(ticket, ".")
+	return name, secret, ok && name != "" && secret != ""
+}
+
+// validTicketSecret confronta, in tempo costante, il segreto presentato con l'hash salvato sulla registrazione.
+func validTicketSecret(res *unstructured.Unstructured, secret string) bool {
+	expected := res.GetAnnotations()[enrollmentTicketAnnotation]
+	return expected != "" && subtle.ConstantTimeCompare([]byte(expected), []byte(ticketSecretHash(secret))) == 1
+}
+
+// prefersAsync indica se il dispositivo ha chiesto di non attendere la decisione dell'operatore,
+// con il parametro async=true o con l'header "Prefer: respond-async" (RFC 7240).
+func prefersAsync(r *http.Request) bool {
+	if r.URL.Query().Get("async") == "true" {
+		return true
+	}
+	for _, value := range r.Header.Values("Prefer") {
+		for _, preference := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(preference), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// enrollmentOutcome traduce lo stato di una DeviceRegistration nell'esito comunicato al dispositivo
+// e nel relativo status code: 200 Approved, 202 Pending, 410 Expired e 403 per le registrazioni rifiutate
+// o per i dispositivi deattivati, sospesi, in quarantena o dismessi.
+func enrollmentOutcome(res *unstructured.Unstructured, now time.Time) (EnrollmentResponse, int) {
+	phase, _, _ := unstructured.NestedString(res.Object, "status", "phase")
+	reason, _, _ := unstructured.NestedString(res.Object, "status", "reason")
+	message, _, _ := unstructured.NestedString(res.Object, "status", "message")
+	deviceUUID, _, _ := unstructured.NestedString(res.Object, "status", "deviceUUID")
+
+	switch phase {
+	case "Approved":
+		// L'operatore imposta la fase e l'UUID nello stesso aggiornamento, ma non ci fidiamo di una fase senza UUID.
+		if deviceUUID != "" {
+			certificate, _, _ := unstructured.NestedString(res.Object, "status", "certificate")
+			return EnrollmentResponse{
+				Status:      enrollmentStatusApproved,
+				DeviceUUID:  deviceUUID,
+				Certificate: certificate,
+				Message:     "Dispositivo registrato con successo.",
+			}, http.StatusOK
+		}
+	case "Rejected":
+		response := EnrollmentResponse{
+			Status:  enrollmentStatusRejected,
+			Message: fmt.Sprintf("Registrazione rifiutata: %s", message),
+		}
+		response.Error = rejectionError(reason, response.Message)
+		return response, http.StatusForbidden
+	case "Deactivated":
+		response := EnrollmentResponse{
+			Status:     enrollmentStatusRejected,
+			DeviceUUID: deviceUUID,
+			Message:    "Il dispositivo è stato disattivato da un amministratore.",
+		}
+		response.Error = &ErrorDetail{Code: errorCodeDeactivated, Message: response.Message, Reason: reason}
+		return response, http.StatusForbidden
+	case "Suspended":
+		response := EnrollmentResponse{
+			Status:     enrollmentStatusRejected,
+			DeviceUUID: deviceUUID,
+			Message:    "Il dispositivo è sospeso temporaneamente da un amministratore.",
+		}
+		// La sospensione termina da sola: riprovare più tardi può avere successo.
+		response.Error = &ErrorDetail{Code: errorCodeSuspended, Message: response.Message, Reason: reason, Retryable: true}
+		return response, http.StatusForbidden
+	case "Quarantined":
+		response := EnrollmentResponse{
+			Status:     enrollmentStatusRejected,
+			DeviceUUID: deviceUUID,
+			Message:    "Il dispositivo è in quarantena: il suo certificato è stato revocato.",
+		}
+		response.Error = &ErrorDetail{Code: errorCodeQuarantined, Message: response.Message, Reason: reason}
+		return response, http.StatusForbidden
+	case "Retired":
+		response := EnrollmentResponse{
+			Status:     enrollmentStatusRejected,
+			DeviceUUID: deviceUUID,
+			Message:    "Il dispositivo è stato dismesso e non può più essere registrato.",
+		}
+		response.Error = &ErrorDetail{Code: errorCodeRetired, Message: response.Message, Reason: reason}
+		return response, http.StatusForbidden
+	case "Expired":
+		response := EnrollmentResponse{
+			Status:     enrollmentStatusExpired,
+			DeviceUUID: deviceUUID,
+			Message:    "Il certificato del dispositivo è scaduto senza essere rinnovato. Ripetere l'enrollment.",
+		}
+		response.Error = &ErrorDetail{Code: errorCodeExpired, Message: response.Message, Reason: reason, Retryable: true}
+		return response, http.StatusGone
+	}
+
+	if created := res.GetCreationTimestamp(); !created.IsZero() && now.Sub(created.Time) > enrollmentTicketTTL {
+		response := EnrollmentResponse{
+			Status:  enrollmentStatusExpired,
+			Message: "La richiesta non è stata elaborata in tempo. Ripetere l'enrollment.",
+		}
+		response.Error = &ErrorDetail{Code: errorCodeTimeout, Message: response.Message, Retryable: true}
+		return response, http.StatusGone
+	}
+	response := EnrollmentResponse{
+		Status:  enrollmentStatusPending,
+		Message: "Registrazione in attesa di elaborazione da parte dell'operatore.",
+	}
+	if reason == "AwaitingApproval" {
+		response.Message = "Registrazione in attesa di approvazione da parte di un amministratore."
+	}
+	return response, http.StatusAccepted
+}
+
+// writeEnrollmentResponse invia l'esito al dispositivo. Finché la richiesta è in attesa indica
+// dove e dopo quanto tempo interrogare di nuovo il gateway.
+func writeEnrollmentResponse(w http.ResponseWriter, r *http.Request, response EnrollmentResponse, code int) {
+	if response.Error != nil {
+		response.Error.RequestID = requestID(r)
+	}
+	if code == http.StatusAccepted {
+		w.Header().Set("Location", "/enroll/"+response.Ticket)
+		w.Header().Set("Retry-After", strconv.Itoa(enrollmentRetryAfter))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(response)
+}
+
+// serveEnrollmentStatus gestisce GET /enroll/{ticket}: restituisce l'esito di un enrollment avviato
+// in precedenza. Con il parametro wait (in secondi) attende una decisione fino a maxEnrollmentLongPoll.
+func (h *gatewayHandler) serveEnrollmentStatus(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Ricevuta richiesta: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "Metodo non consentito. Usare GET.", false)
+		return
+	}
+
+	var wait time.Duration
+	if value := r.URL.Query().Get("wait"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Il parametro 'wait' deve essere un numero di secondi.", false)
+			return
+		}
+		wait = min(time.Duration(seconds)*time.Second, maxEnrollmentLongPoll)
+	}
+
+	ticket := r.PathValue("ticket")
+	name, secret, ok := parseEnrollmentTicket(ticket)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errorCodeNotFound, "Ticket sconosciuto.", false)
+		return
+	}
+	res, found, err := h.registrations.get(h.namespace, name)
+	if err != nil {
+		log.Printf("ERRORE: Impossibile leggere la registrazione '%s': %v", name, err)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la ricerca della registrazione.", true)
+		return
+	}
+	// Un ticket inesistente e uno con il segreto sbagliato ricevono la stessa risposta.
+	if !found || !validTicketSecret(res, secret) {
+		writeError(w, r, http.StatusNotFound, errorCodeNotFound, "Ticket sconosciuto.", false)
+		return
+	}
+
+	if wait > 0 {
+		if res, err = h.waitForEnrollment(r.Context(), name, wait); err != nil {
+			writeWaitError(w, r, name, err)
+			return
+		}
+	}
+	response, code := enrollmentOutcome(res, time.Now())
+	response.Ticket = ticket
+	writeEnrollmentResponse(w, r, response, code)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestEnrollmentTicket(t *testing.T) {
+	secret, hash, err := newTicketSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, parsed, ok := parseEnrollmentTicket(enrollmentTicket("dev-reg-1a2b3c4d", secret))
+	if !ok || name != "dev-reg-1a2b3c4d" || parsed != secret {
+		t.Fatalf("parseEnrollmentTicket() = %q, %q, %v", name, parsed, ok)
+	}
+
+	res := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	res.SetAnnotations(map[string]string{enrollmentTicketAnnotation: hash})
+	if !validTicketSecret(res, secret) {
+		t.Fatal("the secret issued with the ticket must be accepted")
+	}
+	if validTicketSecret(res, secret+"x") {
+		t.Fatal("a different secret must be rejected")
+	}
+
+	for _, ticket := range []string{"", "dev-reg-1a2b3c4d", ".secret", "dev-reg-1a2b3c4d."} {
+		if _, _, ok := parseEnrollmentTicket(ticket); ok {
+			t.Fatalf("malformed ticket %q accepted", ticket)
+		}
+	}
+}
+
+func TestEnrollmentOutcome(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		status    map[string]interface{}
+		age       time.Duration
+		outcome   string
+		code      int
+		errorCode string
+	}{
+		{name: "not processed yet", outcome: enrollmentStatusPending, code: http.StatusAccepted},
+		{name: "awaiting approval", status: map[string]interface{}{"phase": "Pending", "reason": "AwaitingApproval"}, outcome: enrollmentStatusPending, code: http.StatusAccepted},
+		{name: "approved", status: map[string]interface{}{"phase": "Approved", "deviceUUID": "uuid"}, outcome: enrollmentStatusApproved, code: http.StatusOK},
+		{name: "approved without UUID", status: map[string]interface{}{"phase": "Approved"}, outcome: enrollmentStatusPending, code: http.StatusAccepted},
+		{name: "rejected", status: map[string]interface{}{"phase": "Rejected", "reason": "PairingDisabled", "message": "pairing disabled"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodePairingClosed},
+		{name: "rejected key", status: map[string]interface{}{"phase": "Rejected", "reason": "WeakPublicKey"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodeInvalidKey},
+		{name: "rejected duplicate", status: map[string]interface{}{"phase": "Rejected", "reason": "DuplicateKey"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodeDuplicate},
+		{name: "rejected by an administrator", status: map[string]interface{}{"phase": "Rejected", "reason": "RejectedByAdministrator"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodeRejected},
+		{name: "deactivated", status: map[string]interface{}{"phase": "Deactivated", "deviceUUID": "uuid"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodeDeactivated},
+		{name: "suspended", status: map[string]interface{}{"phase": "Suspended", "deviceUUID": "uuid"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodeSuspended},
+		{name: "quarantined", status: map[string]interface{}{"phase": "Quarantined", "deviceUUID": "uuid"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodeQuarantined},
+		{name: "retired", status: map[string]interface{}{"phase": "Retired"}, outcome: enrollmentStatusRejected, code: http.StatusForbidden, errorCode: errorCodeRetired},
+		{name: "certificate expired", status: map[string]interface{}{"phase": "Expired"}, outcome: enrollmentStatusExpired, code: http.StatusGone, errorCode: errorCodeExpired},
+		{name: "pending for too long", status: map[string]interface{}{"phase": "Pending"}, age: enrollmentTicketTTL + time.Minute, outcome: enrollmentStatusExpired, code: http.StatusGone, errorCode: errorCodeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &unstructured.Unstructured{Object: map[string]interface{}{}}
+			res.SetCreationTimestamp(metav1.NewTime(now.Add(-tt.age)))
+			if tt.status != nil {
+				res.Object["status"] = tt.status
+			}
+			response, code := enrollmentOutcome(res, now)
+			if response.Status != tt.outcome || code != tt.code {
+				t.Fatalf("enrollmentOutcome() = %s %d, want %s %d", response.Status, code, tt.outcome, tt.code)
+			}
+			errorCode := ""
+			if response.Error != nil {
+				errorCode = response.Error.Code
+			}
+			if errorCode != tt.errorCode {
+				t.Fatalf("error code = %q, want %q", errorCode, tt.errorCode)
+			}
+		})
+	}
+}
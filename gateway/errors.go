@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Codici di errore restituiti nel campo error.code. Sono stabili: il dispositivo può usarli
+// per decidere cosa fare, mentre il messaggio serve solo a chi legge i log.
+const (
+	errorCodeInvalidRequest   = "INVALID_REQUEST"
+	errorCodeMethodNotAllowed = "METHOD_NOT_ALLOWED"
+	errorCodeUnauthorized     = "UNAUTHORIZED"
+	errorCodeNotFound         = "NOT_FOUND"
+	errorCodeInvalidKey       = "INVALID_KEY"
+	errorCodePairingClosed    = "PAIRING_CLOSED"
+	errorCodeDuplicate        = "DUPLICATE"
+	errorCodeRejected         = "REJECTED"
+	errorCodeDeactivated      = "DEACTIVATED"
+	errorCodeSuspended        = "SUSPENDED"
+	errorCodeQuarantined      = "QUARANTINED"
+	errorCodeRetired          = "RETIRED"
+	errorCodeExpired          = "EXPIRED"
+	errorCodeTimeout          = "TIMEOUT"
+	errorCodeRateLimited      = "RATE_LIMITED"
+	errorCodeUnavailable      = "UNAVAILABLE"
+	errorCodeInternal         = "INTERNAL"
+)
+
+const (
+	// requestIDHeader porta l'identificativo della richiesta: se il client (o un proxy) lo invia
+	// viene riusato, altrimenti il gateway ne genera uno. Viene sempre restituito nella risposta.
+	requestIDHeader = "X-Request-ID"
+	// maxRequestIDLength limita la lunghezza di un identificativo ricevuto dal client.
+	maxRequestIDLength = 128
+)
+
+// ErrorDetail descrive un errore in modo leggibile da un programma.
+// Reason riporta, per le registrazioni rifiutate, il codice scritto dall'operatore in status.reason.
+// Retryable indica se ripetere la richiesta più tardi (o ripetere l'enrollment) può avere successo.
+type ErrorDetail struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Reason    string `json:"reason,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	Retryable bool   `json:"retryable"`
+}
+
+// ErrorResponse è il corpo di tutte le risposte di errore del gateway.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type requestIDKey struct{}
+
+// withRequestID assegna a ogni richiesta un identificativo, lo restituisce nell'header X-Request-ID
+// e lo rende disponibile ai gestori per le risposte di errore.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID accetta solo identificativi brevi e stampabili, per non copiare nei log
+// e nelle risposte valori arbitrari inviati dal client.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	return !strings.ContainsFunc(id, func(c rune) bool { return c <= ' ' || c > '~' })
+}
+
+// requestID restituisce l'identificativo assegnato da withRequestID, vuoto se la richiesta non ne ha.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// writeError risponde con un ErrorResponse in JSON al posto del testo libero di http.Error.
+func writeError(w http.ResponseWriter, r *http.Request, code int, errorCode, message string, retryable bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetail{
+		Code:      errorCode,
+		Message:   message,
+		RequestID: requestID(r),
+		Retryable: retryable,
+	}})
+}
+
+// rejectionError traduce il codice scritto dall'operatore in status.reason nel codice di errore
+// restituito al dispositivo.
+func rejectionError(reason, message string) *ErrorDetail {
+	detail := &ErrorDetail{Code: errorCodeRejected, Message: message, Reason: reason}
+	switch reason {
+	case "PairingDisabled":
+		// Il pairing può essere riaperto: l'enrollment può riuscire più tardi.
+		detail.Code = errorCodePairingClosed
+		detail.Retryable = true
+	case "InvalidPublicKey", "WeakPublicKey", "KeyNotAllowed":
+		detail.Code = errorCodeInvalidKey
+	case "DuplicateKey":
+		detail.Code = errorCodeDuplicate
+	}
+	return detail
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorResponsesCarryRequestID(t *testing.T) {
+	handler := withRequestID(&gatewayHandler{})
+
+	tests := []struct {
+		name     string
+		incoming string
+		reused   bool
+	}{
+		{name: "generated", incoming: ""},
+		{name: "reused from the client", incoming: "edge-42", reused: true},
+		{name: "invalid value replaced", incoming: "bad id\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/enroll", nil)
+			if tt.incoming != "" {
+				r.Header.Set(requestIDHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("GET /enroll = %d, want 405", rec.Code)
+			}
+			var body ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatalf("error body is not JSON: %v", err)
+			}
+			id := rec.Header().Get(requestIDHeader)
+			if id == "" || body.Error.RequestID != id {
+				t.Fatalf("requestId = %q, header = %q: both must be set and equal", body.Error.RequestID, id)
+			}
+			if (id == tt.incoming) != tt.reused {
+				t.Fatalf("request id %q reused = %v, want %v", id, id == tt.incoming, tt.reused)
+			}
+			if body.Error.Code != errorCodeMethodNotAllowed || body.Error.Retryable {
+				t.Fatalf("error = %+v, want a non retryable %s", body.Error, errorCodeMethodNotAllowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// readinessCheckTimeout limita la verifica della raggiungibilità dell'API server in /readyz.
+	readinessCheckTimeout = 3 * time.Second
+	// shutdownFlushTimeout è il tempo concesso, dopo aver liberato le richieste in attesa,
+	// per inviare le risposte e chiudere le connessioni.
+	shutdownFlushTimeout = 5 * time.Second
+)
+
+// lifecycle tiene traccia dell'arresto del gateway: prima smette di accettare nuovi enrollment,
+// poi, allo scadere del tempo concesso, libera le richieste ancora in attesa dell'operatore.
+type lifecycle struct {
+	draining    atomic.Bool
+	releaseOnce sync.Once
+	// released viene chiuso quando le richieste in attesa devono rispondere subito al dispositivo.
+	released chan struct{}
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{released: make(chan struct{})}
+}
+
+// startDraining segna l'inizio dell'arresto: /readyz fallisce e i nuovi enrollment vengono rifiutati.
+func (l *lifecycle) startDraining() {
+	l.draining.Store(true)
+}
+
+// isDraining indica se l'arresto è iniziato. Un gestore senza lifecycle (nei test) non si arresta mai.
+func (l *lifecycle) isDraining() bool {
+	return l != nil && l.draining.Load()
+}
+
+// releaseWaiters sveglia le richieste ancora in attesa: risponderanno con il ticket.
+func (l *lifecycle) releaseWaiters() {
+	l.releaseOnce.Do(func() { close(l.released) })
+}
+
+// releasedChan restituisce il canale chiuso da releaseWaiters; nil (mai pronto) senza lifecycle.
+func (l *lifecycle) releasedChan() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.released
+}
+
+// rejectWhileDraining risponde 503 alle richieste che non vanno più accettate durante l'arresto.
+// Restituisce true se la richiesta è stata rifiutata.
+func (h *gatewayHandler) rejectWhileDraining(w http.ResponseWriter, r *http.Request) bool {
+	if !h.lifecycle.isDraining() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	w.Header().Set("Retry-After", strconv.Itoa(enrollmentRetryAfter))
+	writeError(w, r, http.StatusServiceUnavailable, errorCodeUnavailable, "Il gateway è in fase di arresto. Riprovare tra qualche secondo.", true)
+	return true
+}
+
+// serveHealthz gestisce GET /healthz (liveness): il processo è vivo e risponde alle richieste.
+func (h *gatewayHandler) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz gestisce GET /readyz (readiness): il gateway è pronto se non è in arresto,
+// la cache delle DeviceRegistration è sincronizzata e l'API server risponde.
+func (h *gatewayHandler) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := h.checkReady(r.Context()); err != nil {
+		log.Printf("Readiness fallita: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *gatewayHandler) checkReady(ctx context.Context) error {
+	if h.lifecycle.isDraining() {
+		return fmt.Errorf("il gateway è in fase di arresto")
+	}
+	if !h.registrations.informer.HasSynced() {
+		return fmt.Errorf("la cache delle DeviceRegistration non è ancora sincronizzata")
+	}
+	// Una lista di un solo elemento verifica sia la connessione sia i permessi RBAC del gateway.
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+	if _, err := h.kubeClient.Resource(h.gvr).Namespace(h.namespace).List(ctx, metav1.ListOptions{Limit: 1}); err != nil {
+		return fmt.Errorf("API server non raggiungibile: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestReadinessAndDraining(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deviceRegistrationGVR: "DeviceRegistrationList"})
+	h := &gatewayHandler{
+		kubeClient:          client,
+		namespace:           "devices",
+		registrations:       newRegistrationWatcher(client, "devices", deviceRegistrationGVR),
+		gvr:                 deviceRegistrationGVR,
+		namePrefix:          "dev-reg-",
+		registrationTimeout: time.Minute,
+		lifecycle:           newLifecycle(),
+	}
+	readyz := func() int {
+		rec := httptest.NewRecorder()
+		h.serveReadyz(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz before the cache sync = %d, want 503", code)
+	}
+	if err := h.registrations.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if code := readyz(); code != http.StatusOK {
+		t.Fatalf("readyz after the cache sync = %d, want 200", code)
+	}
+
+	name, err := h.createDeviceRegistrationResource(ctx, "key", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.lifecycle.startDraining()
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz while draining = %d, want 503", code)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/enroll", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("new enrollment while draining = %d, want 503 with Retry-After", rec.Code)
+	}
+
+	// Una richiesta ancora in attesa viene liberata e risponde come allo scadere del timeout.
+	time.AfterFunc(100*time.Millisecond, h.lifecycle.releaseWaiters)
+	res, err := h.waitForEnrollment(ctx, name, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response, code := enrollmentOutcome(res, time.Now()); code != http.StatusAccepted {
+		t.Fatalf("released wait = %d %+v, want 202", code, response)
+	}
+}
@@ -3,11 +3,15 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	// Librerie necessarie
@@ -15,44 +19,76 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/dynamic"
-	"k8s.io/client-go/rest"
 )
 
 // Definiamo le strutture dei dati JSON per le richieste e le risposte.
 
 // EnrollmentRequest è ciò che il dispositivo invia al Gateway.
-// Contiene solo la sua chiave pubblica.
+// Oltre alla chiave pubblica contiene la prova di possesso della chiave privata:
+// il nonce ottenuto da POST /enroll/challenge e la sua firma codificata in base64.
+// Metadata, facoltativo, descrive il dispositivo e viene copiato nella spec della registrazione.
 type EnrollmentRequest struct {
-	PublicKey string `json:"publicKey"`
+	PublicKey string          `json:"publicKey"`
+	Nonce     string          `json:"nonce"`
+	Signature string          `json:"signature"`
+	Metadata  *DeviceMetadata `json:"metadata,omitempty"`
 }
 
-// EnrollmentResponse è ciò che il Gateway restituisce al dispositivo se la registrazione ha successo.
-// Contiene l'UUID assegnato dall'operatore.
+// EnrollmentResponse è ciò che il Gateway restituisce al dispositivo, sia a POST /enroll sia a GET /enroll/{ticket}.
+// Status riporta l'esito (Pending, Approved, Rejected, Expired); se la registrazione è approvata contiene
+// l'UUID assegnato dall'operatore e la catena di certificati (PEM: dispositivo, poi CA)
+// con cui il dispositivo potrà autenticarsi. Con Ticket il dispositivo può interrogare l'esito in seguito.
+// Se la registrazione è rifiutata o scaduta, Error riporta il codice dell'errore come nelle altre risposte di errore.
 type EnrollmentResponse struct {
-	DeviceUUID string `json:"deviceUUID"`
-	Message    string `json:"message"`
+	Status      string       `json:"status"`
+	Ticket      string       `json:"ticket,omitempty"`
+	DeviceUUID  string       `json:"deviceUUID,omitempty"`
+	Certificate string       `json:"certificate,omitempty"`
+	Message     string       `json:"message"`
+	Error       *ErrorDetail `json:"error,omitempty"`
 }
 
+// deviceRegistrationGVR è lo "schema" predefinito della nostra risorsa Custom (GVR: Group, Version, Resource).
+// Si può cambiare con la configurazione del gateway, ma deve corrispondere esattamente alla CRD.
+var deviceRegistrationGVR = schema.GroupVersionResource{
+	Group:    "devices.example.com",
+	Version:  "v1alpha1",
+	Resource: "deviceregistrations",
+}
+
+// errRegistrationDeleted indica che la registrazione attesa è stata cancellata prima di una decisione.
+var errRegistrationDeleted = errors.New("la registrazione è stata cancellata")
+
 // gatewayHandler contiene il client Kubernetes e altre informazioni necessarie.
 type gatewayHandler struct {
 	kubeClient dynamic.Interface // Un client per interagire con le risorse Kubernetes
 	namespace  string            // Il namespace in cui operare
+	challenges *challengeStore   // I nonce emessi e non ancora usati per la prova di possesso
+	// registrations è la cache condivisa delle DeviceRegistration, alimentata da un unico informer.
+	registrations *registrationWatcher
+	// limits protegge l'API server dalla creazione incontrollata di DeviceRegistration.
+	limits *enrollmentLimiter
+
+	gvr                 schema.GroupVersionResource // La risorsa DeviceRegistration
+	namePrefix          string                      // Il prefisso dei nomi delle risorse create
+	registrationTimeout time.Duration               // L'attesa massima dell'operatore a connessione aperta
+	crlConfigMapName    string                      // Il ConfigMap in cui l'operatore pubblica la CRL
+	lifecycle           *lifecycle                  // Lo stato di arresto del gateway
 }
 
 // newGatewayHandler è una funzione "costruttore" che crea e inizializza il nostro gestore.
-func newGatewayHandler() (*gatewayHandler, error) {
+func newGatewayHandler(cfg gatewayConfig) (*gatewayHandler, error) {
 	log.Println("Inizializzazione del client Kubernetes...")
 
-	// rest.InClusterConfig() è la magia che permette a un'applicazione
-	// di trovare e autenticarsi all'API di Kubernetes quando è in esecuzione
-	// all'interno di un Pod nel cluster.
-	config, err := rest.InClusterConfig()
+	config, err := cfg.restConfig()
 	if err != nil {
-		return nil, fmt.Errorf("impossibile ottenere la configurazione del cluster: %w. Assicurati di eseguire questo codice all'interno di un cluster Kubernetes", err)
+		return nil, err
 	}
 
+	// Misuriamo latenza ed errori di tutte le chiamate all'API di Kubernetes.
+	config.Wrap(func(rt http.RoundTripper) http.RoundTripper { return &instrumentedTransport{next: rt} })
+
 	// Creiamo un client "dinamico". Questo tipo di client è perfetto per lavorare
 	// con le Custom Resources (CRD) perché non richiede di importare il loro codice Go.
 	// Può lavorare con qualsiasi risorsa, basta conoscerne il nome e la struttura.
@@ -61,96 +97,197 @@ func newGatewayHandler() (*gatewayHandler, error) {
 		return nil, fmt.Errorf("impossibile creare il client dinamico: %w", err)
 	}
 	log.Println("Client Kubernetes creato con successo.")
+	log.Printf("Opero nel namespace: '%s'\n", cfg.Namespace)
 
-	// Per sapere in quale namespace creare le risorse, leggiamo una variabile d'ambiente
-	// che verrà iniettata nel Pod dal file deployment.yaml.
-	namespace := os.Getenv("POD_NAMESPACE")
-	if namespace == "" {
-		namespace = "default" // Se la variabile non è impostata, usiamo 'default' come fallback.
-		log.Printf("Variabile d'ambiente POD_NAMESPACE non trovata. Uso il namespace di fallback: '%s'\n", namespace)
-	} else {
-		log.Printf("Opero nel namespace: '%s'\n", namespace)
+	limits, err := newRateLimitConfig(cfg.RateLimits)
+	if err != nil {
+		return nil, err
 	}
+	log.Printf("Limiti di enrollment: %d richieste per IP e %d registrazioni al minuto, al massimo %d registrazioni in attesa.",
+		cfg.RateLimits.PerIPPerMinute, cfg.RateLimits.GlobalPerMinute, cfg.RateLimits.MaxPending)
 
+	gvr := cfg.registrationGVR()
 	return &gatewayHandler{
-		kubeClient: dynamicClient,
-		namespace:  namespace,
+		kubeClient:          dynamicClient,
+		namespace:           cfg.Namespace,
+		challenges:          newChallengeStore(challengeTTL),
+		registrations:       newRegistrationWatcher(dynamicClient, cfg.Namespace, gvr),
+		limits:              newEnrollmentLimiter(limits),
+		gvr:                 gvr,
+		namePrefix:          cfg.Registration.NamePrefix,
+		registrationTimeout: cfg.RegistrationTimeout.Duration,
+		crlConfigMapName:    cfg.CRLConfigMapName,
+		lifecycle:           newLifecycle(),
 	}, nil
 }
 
 // ServeHTTP è il metodo che viene chiamato per ogni richiesta HTTP in arrivo all'endpoint /enroll.
 func (h *gatewayHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	received := time.Now()
 	log.Printf("Ricevuta richiesta: %s %s", r.Method, r.URL.Path)
-	
+
 	// Accettiamo solo richieste POST.
 	if r.Method != http.MethodPost {
-		http.Error(w, "Metodo non consentito. Usare POST.", http.StatusMethodNotAllowed)
+		writeError(w, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "Metodo non consentito. Usare POST.", false)
+		return
+	}
+	if h.rejectWhileDraining(w, r) {
+		return
+	}
+
+	// Limitiamo le richieste di ogni client prima di qualsiasi altra elaborazione.
+	client, err := clientIP(r, h.limits.config.TrustedProxies)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Impossibile determinare l'indirizzo del client.", false)
+		return
+	}
+	if retryAfter, err := h.limits.allowClient(client); err != nil || retryAfter > 0 {
+		log.Printf("Richiesta di enrollment da %s rifiutata: limite per client superato.", client)
+		writeTooManyRequests(w, r, retryAfter, "Troppe richieste di enrollment da questo indirizzo. Riprovare più tardi.")
 		return
 	}
 
 	// Decodifichiamo il corpo JSON della richiesta nella nostra struct EnrollmentRequest.
 	var req EnrollmentRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Corpo della richiesta JSON non valido.", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Corpo della richiesta JSON non valido.", false)
 		return
 	}
 
 	// Validiamo che la chiave pubblica sia stata fornita.
 	if req.PublicKey == "" {
-		http.Error(w, "Il campo 'publicKey' è obbligatorio.", http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Il campo 'publicKey' è obbligatorio.", false)
+		return
+	}
+	if req.Nonce == "" || req.Signature == "" {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest,
+			"I campi 'nonce' e 'signature' sono obbligatori. Richiedere prima una challenge con POST /enroll/challenge.", false)
+		return
+	}
+	if req.Metadata != nil {
+		if err := req.Metadata.normalize(); err != nil {
+			writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, fmt.Sprintf("Metadati non validi: %v.", err), false)
+			return
+		}
+	}
+
+	// Verifichiamo la prova di possesso prima di creare qualsiasi risorsa nel cluster:
+	// il nonce deve essere stato emesso da noi e firmato con la chiave privata del dispositivo.
+	publicKey, err := parsePublicKey(req.PublicKey)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidKey, fmt.Sprintf("Chiave pubblica non valida: %v", err), false)
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Il campo 'signature' deve essere codificato in base64.", false)
+		return
+	}
+	if err := h.challenges.consume(req.Nonce); err != nil {
+		// Con una nuova challenge la richiesta può riuscire.
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("Challenge non valida: %v", err), true)
+		return
+	}
+	if err := verifyProofOfPossession(publicKey, []byte(req.Nonce), signature); err != nil {
+		log.Printf("Prova di possesso fallita per la chiave pubblica %.20s...: %v", req.PublicKey, err)
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("Prova di possesso fallita: %v", err), false)
 		return
 	}
 	log.Printf("Richiesta di enrollment valida ricevuta per la chiave pubblica: %.20s...", req.PublicKey)
 
+	// Prima di scrivere in etcd applichiamo il tetto alle registrazioni in attesa e il limite globale.
+	pending, err := h.countPendingRegistrations(time.Now())
+	if err != nil {
+		log.Printf("ERRORE: Impossibile contare le registrazioni in attesa: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la creazione della richiesta.", true)
+		return
+	}
+	if pending >= h.limits.config.MaxPending {
+		log.Printf("Richiesta di enrollment da %s rifiutata: %d registrazioni già in attesa.", client, pending)
+		writeTooManyRequests(w, r, time.Minute, "Troppe registrazioni in attesa di elaborazione. Riprovare più tardi.")
+		return
+	}
+	if retryAfter := h.limits.allowCreation(); retryAfter > 0 {
+		log.Printf("Richiesta di enrollment da %s rifiutata: limite globale superato.", client)
+		writeTooManyRequests(w, r, retryAfter, "Il gateway sta ricevendo troppe richieste di enrollment. Riprovare più tardi.")
+		return
+	}
+
+	// Il ticket permette al dispositivo di conoscere l'esito anche dopo aver chiuso la connessione.
+	secret, secretHash, err := newTicketSecret()
+	if err != nil {
+		log.Printf("ERRORE: Impossibile generare il ticket: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la creazione della richiesta.", true)
+		return
+	}
+
+	// Se il dispositivo si è autenticato con un certificato client verificato, ne registriamo l'identità.
+	annotations := map[string]string{enrollmentTicketAnnotation: secretHash}
+	for key, value := range clientCertificateAnnotations(r) {
+		annotations[key] = value
+	}
+
 	// Creiamo la risorsa DeviceRegistration nel cluster Kubernetes.
-	drName, err := h.createDeviceRegistrationResource(r.Context(), req.PublicKey)
+	drName, err := h.createDeviceRegistrationResource(r.Context(), req.PublicKey, req.Metadata, annotations)
 	if err != nil {
 		log.Printf("ERRORE: Impossibile creare la risorsa DeviceRegistration: %v", err)
-		http.Error(w, "Errore interno del server durante la creazione della richiesta.", http.StatusInternalServerError)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la creazione della richiesta.", true)
+		return
+	}
+	ticket := enrollmentTicket(drName, secret)
+
+	// In modalità asincrona rispondiamo subito: il dispositivo interrogherà GET /enroll/{ticket}.
+	if prefersAsync(r) {
+		log.Printf("Risorsa DeviceRegistration '%s' creata. Ticket restituito al dispositivo.", drName)
+		writeEnrollmentResponse(w, r, EnrollmentResponse{
+			Status:  enrollmentStatusPending,
+			Ticket:  ticket,
+			Message: "Richiesta di registrazione ricevuta. Interrogare l'esito con il ticket.",
+		}, http.StatusAccepted)
 		return
 	}
 
 	log.Printf("Risorsa DeviceRegistration '%s' creata. In attesa di elaborazione da parte dell'operatore...", drName)
 
 	// Ora inizia la parte cruciale: aspettiamo che l'operatore faccia il suo lavoro.
-	// Facciamo "polling", cioè controlliamo lo stato della risorsa a intervalli regolari.
-	uuid, err := h.waitForApproval(r.Context(), drName)
+	// L'informer del gateway ci sveglia a ogni modifica della risorsa.
+	res, err := h.waitForEnrollment(r.Context(), drName, h.registrationTimeout)
 	if err != nil {
-		// Se c'è un errore (es. timeout o registrazione rifiutata), lo registriamo e rispondiamo con un errore.
-		log.Printf("ERRORE: La registrazione per '%s' è fallita: %v", drName, err)
-		http.Error(w, fmt.Sprintf("Registrazione fallita: %v", err), http.StatusForbidden) // 403 Forbidden è un buon codice per un rifiuto.
+		writeWaitError(w, r, drName, err)
 		return
 	}
 
-	log.Printf("SUCCESSO: Registrazione per '%s' approvata. UUID assegnato: %s", drName, uuid)
-
-	// Se tutto è andato bene, inviamo la risposta di successo al dispositivo.
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(EnrollmentResponse{
-		DeviceUUID: uuid,
-		Message:    "Dispositivo registrato con successo.",
-	})
+	// Se l'operatore non ha ancora deciso (es. approvazione manuale) rispondiamo 202 con il ticket:
+	// un timeout non è un rifiuto.
+	response, code := enrollmentOutcome(res, time.Now())
+	response.Ticket = ticket
+	switch response.Status {
+	case enrollmentStatusApproved:
+		log.Printf("SUCCESSO: Registrazione per '%s' approvata. UUID assegnato: %s", drName, response.DeviceUUID)
+		observeApproval(outcomeApproved, received)
+	case enrollmentStatusRejected:
+		log.Printf("La registrazione per '%s' è stata rifiutata: %s", drName, response.Message)
+		observeApproval(outcomeRejected, received)
+	case enrollmentStatusPending:
+		log.Printf("La registrazione '%s' è ancora in attesa. Ticket restituito al dispositivo.", drName)
+	default:
+		log.Printf("La registrazione per '%s' si è conclusa con esito %s: %s", drName, response.Status, response.Message)
+	}
+	writeEnrollmentResponse(w, r, response, code)
 }
 
 // createDeviceRegistrationResource crea l'oggetto CRD nel cluster.
-func (h *gatewayHandler) createDeviceRegistrationResource(ctx context.Context, publicKey string) (string, error) {
-	// Definiamo lo "schema" della nostra risorsa Custom (GVR: Group, Version, Resource).
-	// Questi valori devono corrispondere esattamente a quelli nella tua CRD.
-	deviceRegistrationGVR := schema.GroupVersionResource{
-		Group:    "devices.example.com",
-		Version:  "v1alpha1",
-		Resource: "deviceregistrations",
-	}
-
+// metadata, già validato, può essere nil; annotations riporta l'hash del segreto del ticket
+// e, con mTLS, l'identità del certificato client.
+func (h *gatewayHandler) createDeviceRegistrationResource(ctx context.Context, publicKey string, metadata *DeviceMetadata, annotations map[string]string) (string, error) {
 	// Per evitare conflitti di nomi, generiamo un nome univoco per ogni richiesta di registrazione.
-	resourceName := "dev-reg-" + uuid.New().String()[:8]
+	resourceName := h.namePrefix + uuid.New().String()[:8]
 
 	// Costruiamo l'oggetto risorsa usando una mappa "unstructured".
 	// Questo ci permette di creare qualsiasi risorsa senza bisogno del suo tipo Go specifico.
 	drObject := &unstructured.Unstructured{
 		Object: map[string]interface{}{
-			"apiVersion": "devices.example.com/v1alpha1",
+			"apiVersion": h.gvr.GroupVersion().String(),
 			"kind":       "DeviceRegistration",
 			"metadata": map[string]interface{}{
 				"name":      resourceName,
@@ -162,82 +299,222 @@ func (h *gatewayHandler) createDeviceRegistrationResource(ctx context.Context, p
 		},
 	}
 
+	drObject.SetAnnotations(annotations)
+	if metadata != nil && !metadata.isEmpty() {
+		if err := unstructured.SetNestedMap(drObject.Object, metadata.object(), "spec", "metadata"); err != nil {
+			return "", err
+		}
+	}
+
 	// Usiamo il client dinamico per creare la risorsa nel cluster.
-	_, err := h.kubeClient.Resource(deviceRegistrationGVR).Namespace(h.namespace).Create(ctx, drObject, metav1.CreateOptions{})
+	_, err := h.kubeClient.Resource(h.gvr).Namespace(h.namespace).Create(ctx, drObject, metav1.CreateOptions{})
 	if err != nil {
 		return "", err
 	}
 	return resourceName, nil
 }
 
-// waitForApproval controlla periodicamente lo stato della CR finché non è approvata o rifiutata.
-func (h *gatewayHandler) waitForApproval(ctx context.Context, name string) (string, error) {
-	var deviceUUID string
+// waitForEnrollment attende, al massimo per timeout, che l'operatore decida sulla registrazione
+// e ne restituisce lo stato più recente. Allo scadere del timeout la registrazione è ancora in attesa:
+// non è un errore.
+func (h *gatewayHandler) waitForEnrollment(ctx context.Context, name string, timeout time.Duration) (*unstructured.Unstructured, error) {
+	err := h.waitForRegistration(ctx, name, timeout, func(status map[string]interface{}) (bool, error) {
+		// Controlliamo la 'phase' all'interno dello status.
+		switch phase, _ := status["phase"].(string); phase {
+		case "", "Pending":
+			// La fase è vuota o 'Pending': continuiamo ad attendere.
+			return false, nil
+		case "Approved":
+			// L'UUID viene scritto insieme alla fase Approved; senza UUID continuiamo ad attendere.
+			uuid, _ := status["deviceUUID"].(string)
+			return uuid != "", nil
+		default:
+			return true, nil
+		}
+	})
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		return nil, err
+	}
+	res, found, err := h.registrations.get(h.namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: '%s'", errRegistrationDeleted, name)
+	}
+	return res, nil
+}
+
+// writeWaitError risponde a una richiesta la cui attesa della registrazione si è interrotta con err.
+// Solo una registrazione cancellata è un esito definitivo per il dispositivo; se il client ha chiuso
+// la connessione non c'è nessuno a cui rispondere.
+func writeWaitError(w http.ResponseWriter, r *http.Request, name string, err error) {
+	switch {
+	case errors.Is(err, errRegistrationDeleted):
+		log.Printf("La registrazione '%s' è stata cancellata durante l'attesa.", name)
+		writeError(w, r, http.StatusGone, errorCodeNotFound, "La richiesta di registrazione è stata cancellata. Ripetere l'enrollment.", false)
+	case errors.Is(err, context.Canceled):
+		log.Printf("Il client ha chiuso la connessione durante l'attesa della registrazione '%s' (499).", name)
+	default:
+		log.Printf("ERRORE: Attesa della registrazione '%s' interrotta: %v", name, err)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante l'attesa della registrazione.", true)
+	}
+}
 
-	// Definiamo un timeout. Se l'operatore non processa la richiesta entro 2 minuti, la richiesta fallisce.
-	// Questo evita che il gateway resti in attesa all'infinito.
-	timeoutCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+// waitForRegistration attende, sulla cache dell'informer, che done restituisca true o un errore
+// valutandolo sullo status della CR a ogni sua modifica.
+func (h *gatewayHandler) waitForRegistration(ctx context.Context, name string, timeout time.Duration, done func(status map[string]interface{}) (bool, error)) error {
+	// Definiamo un timeout, così il gateway non resta in attesa all'infinito.
+	timeoutCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	gvr := schema.GroupVersionResource{Group: "devices.example.com", Version: "v1alpha1", Resource: "deviceregistrations"}
+	// Ci iscriviamo prima di leggere la cache, così non perdiamo una modifica che arriva nel frattempo.
+	updates, unsubscribe := h.registrations.subscribe(name)
+	defer unsubscribe()
+	waitingRequests.Inc()
+	defer waitingRequests.Dec()
 
-	// wait.PollImmediateUntilWithContext è una funzione di utilità di Kubernetes che esegue una funzione
-	// a intervalli regolari (ogni 2 secondi) fino a quando non restituisce 'true' o un errore, o fino al timeout.
-	err := wait.PollImmediateUntilWithContext(timeoutCtx, 2*time.Second, func(ctx context.Context) (bool, error) {
-		// Ad ogni tentativo, otteniamo la versione più recente della nostra risorsa.
-		res, err := h.kubeClient.Resource(gvr).Namespace(h.namespace).Get(ctx, name, metav1.GetOptions{})
+	seen := false
+	for {
+		res, found, err := h.registrations.get(h.namespace, name)
 		if err != nil {
-			return false, err // Errore nel recuperare la risorsa, il polling si fermerà e restituirà questo errore.
+			return err
 		}
-
-		// Estraiamo il campo 'status' dalla risorsa.
-		status, found, err := unstructured.NestedMap(res.Object, "status")
-		if err != nil || !found {
-			log.Printf("In attesa che l'operatore imposti lo stato per '%s'...", name)
-			return false, nil // Lo status non è ancora pronto, continua il polling.
-		}
-
-		// Controlliamo la 'phase' all'interno dello status.
-		phase, _ := status["phase"].(string)
-		switch phase {
-		case "Approved":
-			uuid, ok := status["deviceUUID"].(string)
-			if ok && uuid != "" {
-				deviceUUID = uuid
-				return true, nil // Fatto! La fase è Approved e abbiamo l'UUID. Smettiamo di fare polling.
+		switch {
+		case found:
+			seen = true
+			// Estraiamo il campo 'status' dalla risorsa.
+			if status, ok, err := unstructured.NestedMap(res.Object, "status"); err == nil && ok {
+				if finished, err := done(status); err != nil || finished {
+					return err
+				}
+			} else {
+				log.Printf("In attesa che l'operatore imposti lo stato per '%s'...", name)
 			}
-		case "Rejected":
-			// Se la fase è Rejected, è un errore terminale.
-			message, _ := status["message"].(string)
-			return false, fmt.Errorf("registrazione rifiutata: %s", message) // Smettiamo di fare polling e restituiamo un errore.
+		case seen:
+			return fmt.Errorf("%w: '%s'", errRegistrationDeleted, name)
 		}
 
-		// Se la fase non è né Approved né Rejected (es. è vuota o 'Pending'), continuiamo il polling.
-		return false, nil
-	})
-
-	if err != nil {
-		return "", err // Se il polling è fallito (per timeout o perché è stato rifiutato), restituiamo l'errore.
+		select {
+		case <-timeoutCtx.Done():
+			return fmt.Errorf("nessuna risposta dall'operatore per '%s': %w", name, timeoutCtx.Err())
+		case <-h.lifecycle.releasedChan():
+			// Il gateway si sta arrestando: rispondiamo come allo scadere del timeout.
+			return fmt.Errorf("il gateway è in fase di arresto: %w", context.DeadlineExceeded)
+		case <-updates:
+		}
 	}
-
-	return deviceUUID, nil
 }
 
-
 // La funzione main è il punto di ingresso della nostra applicazione.
 func main() {
+	// Leggiamo la configurazione da flag, variabili d'ambiente ed eventuale file YAML.
+	cfg, err := loadGatewayConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("ERRORE FATALE: Configurazione non valida: %v", err)
+	}
+
 	// Creiamo il nostro gestore di richieste. Se fallisce, il programma si ferma.
-	handler, err := newGatewayHandler()
+	handler, err := newGatewayHandler(cfg)
 	if err != nil {
 		log.Fatalf("ERRORE FATALE: Impossibile inizializzare il gateway: %v", err)
 	}
 
-	// Registriamo il nostro gestore per l'endpoint "/enroll".
-	http.Handle("/enroll", handler)
+	// ctx viene cancellato alla ricezione di SIGTERM (rolling update, scale down) o di Ctrl+C.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	// Un solo informer osserva le DeviceRegistration per tutte le richieste in corso.
+	// Finché la cache non è sincronizzata /readyz fallisce e Kubernetes non ci invia traffico.
+	go func() {
+		if err := handler.registrations.start(ctx); err != nil && ctx.Err() == nil {
+			log.Fatalf("ERRORE FATALE: %v", err)
+		}
+	}()
+
+	// Registriamo i nostri gestori: prima la challenge, poi l'enrollment vero e proprio.
+	http.HandleFunc("/enroll/challenge", handler.serveChallenge)
+	http.Handle("/enroll", instrumentEnrollment(handler))
+	// Con il ticket restituito da /enroll il dispositivo interroga l'esito della registrazione.
+	http.HandleFunc("/enroll/{ticket}", handler.serveEnrollmentStatus)
+	// I dispositivi già registrati rinnovano qui il certificato prima della scadenza.
+	http.HandleFunc("/renew", handler.serveRenewal)
+	// I servizi che si fidano dei certificati dei dispositivi verificano qui le revoche.
+	http.HandleFunc("GET /crl", handler.serveCRL)
+	http.HandleFunc("GET /status/{uuid}", handler.serveDeviceStatus)
+
+	// Le sonde di Kubernetes usano una porta separata e in chiaro: con l'mTLS obbligatorio
+	// il kubelet non potrebbe presentare un certificato client.
+	healthMux := http.NewServeMux()
+	healthMux.HandleFunc("GET /healthz", handler.serveHealthz)
+	healthMux.HandleFunc("GET /readyz", handler.serveReadyz)
+	// Le metriche per Prometheus stanno sulla stessa porta interna.
+	healthMux.Handle("GET /metrics", metricsHandler())
+	healthServer := &http.Server{
+		Addr:              cfg.HealthAddress,
+		Handler:           healthMux,
+		ReadHeaderTimeout: cfg.ReadTimeout.Duration,
+	}
+
+	// Ogni richiesta riceve un X-Request-ID, riportato anche nelle risposte di errore.
+	server := &http.Server{
+		Addr:              cfg.ListenAddress,
+		Handler:           withRequestID(http.DefaultServeMux),
+		ReadHeaderTimeout: cfg.ReadTimeout.Duration,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		log.Printf("Endpoint di salute in ascolto su %s...", cfg.HealthAddress)
+		serveErr <- healthServer.ListenAndServe()
+	}()
+
+	if cfg.TLS.CertFile == "" {
+		// Senza un certificato configurato serviamo in chiaro, come negli ambienti di sviluppo.
+		log.Println("ATTENZIONE: TLS non configurato, le richieste viaggiano in chiaro.")
+		go func() {
+			log.Printf("Gateway in ascolto su %s...", cfg.ListenAddress)
+			serveErr <- server.ListenAndServe()
+		}()
+	} else {
+		// Il certificato viene ricaricato quando il Secret montato viene ruotato.
+		reloader, err := newTLSReloader(cfg.TLS)
+		if err != nil {
+			log.Fatalf("ERRORE FATALE: %v", err)
+		}
+		go reloader.watch(ctx)
+		server.TLSConfig = reloader.tlsConfig()
+		if cfg.TLS.ClientCAFile != "" {
+			log.Printf("Verifica dei certificati client attiva (obbligatoria: %t).", cfg.TLS.RequireClientCert)
+		}
+		go func() {
+			log.Printf("Gateway in ascolto con TLS su %s...", cfg.ListenAddress)
+			serveErr <- server.ListenAndServeTLS("", "")
+		}()
+	}
 
-	// Avviamo il server web sulla porta 8080.
-	log.Println("Gateway in ascolto sulla porta :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	select {
+	case err := <-serveErr:
 		log.Fatalf("ERRORE FATALE: Impossibile avviare il server HTTP: %v", err)
+	case <-ctx.Done():
+	}
+
+	// Arresto ordinato: rifiutiamo i nuovi enrollment e lasciamo alle richieste in attesa dell'operatore
+	// fino a ShutdownTimeout; poi le liberiamo, così rispondono con il ticket invece di essere troncate.
+	log.Printf("Segnale di arresto ricevuto. Attendo le richieste in corso per al massimo %s...", cfg.ShutdownTimeout.Duration)
+	handler.lifecycle.startDraining()
+	release := time.AfterFunc(cfg.ShutdownTimeout.Duration, handler.lifecycle.releaseWaiters)
+	defer release.Stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration+shutdownFlushTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("ERRORE: Arresto del server non completato: %v", err)
+	}
+	if err := healthServer.Shutdown(shutdownCtx); err != nil {
+		log.Printf("ERRORE: Arresto degli endpoint di salute non completato: %v", err)
 	}
-}
\ No newline at end of file
+	log.Println("Gateway arrestato.")
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limiti sui metadati che un dispositivo può dichiarare all'enrollment. Corrispondono a quelli
+// della CRD DeviceRegistration: una richiesta che li supera viene rifiutata dal gateway con
+// INVALID_REQUEST prima di arrivare all'API server.
+const (
+	maxModelLength           = 128
+	maxSerialNumberLength    = 64
+	maxFirmwareVersionLength = 64
+	maxMetadataLabels        = 16
+	maxMetadataLabelKey      = 63
+	maxMetadataLabelValue    = 256
+)
+
+// metadataLabelKeyPattern è la forma di un nome di label Kubernetes senza prefisso.
+var metadataLabelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+
+// DeviceMetadata descrive il dispositivo: modello hardware, numero di serie, versione del firmware,
+// indirizzo MAC e label libere. Tutti i campi sono facoltativi.
+type DeviceMetadata struct {
+	Model           string            `json:"model,omitempty"`
+	SerialNumber    string            `json:"serialNumber,omitempty"`
+	FirmwareVersion string            `json:"firmwareVersion,omitempty"`
+	MACAddress      string            `json:"macAddress,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+}
+
+// normalize valida i metadati e li riporta in forma canonica: spazi iniziali e finali rimossi
+// e indirizzo MAC in esadecimale minuscolo separato da due punti.
+func (m *DeviceMetadata) normalize() error {
+	fields := []struct {
+		name  string
+		value *string
+		max   int
+	}{
+		{"model", &m.Model, maxModelLength},
+		{"serialNumber", &m.SerialNumber, maxSerialNumberLength},
+		{"firmwareVersion", &m.FirmwareVersion, maxFirmwareVersionLength},
+	}
+	for _, f := range fields {
+		*f.value = strings.TrimSpace(*f.value)
+		if err := validMetadataText(*f.value, f.max); err != nil {
+			return fmt.Errorf("il campo '%s' %v", f.name, err)
+		}
+	}
+
+	if m.MACAddress = strings.TrimSpace(m.MACAddress); m.MACAddress != "" {
+		mac, err := net.ParseMAC(m.MACAddress)
+		if err != nil || len(mac) != 6 {
+			return fmt.Errorf("il campo 'macAddress' non è un indirizzo MAC a 48 bit valido")
+		}
+		m.MACAddress = mac.String()
+	}
+
+	if len(m.Labels) > maxMetadataLabels {
+		return fmt.Errorf("sono ammesse al massimo %d label", maxMetadataLabels)
+	}
+	for key, value := range m.Labels {
+		if len(key) > maxMetadataLabelKey || !metadataLabelKeyPattern.MatchString(key) {
+			return fmt.Errorf("la chiave di label %q non è valida: al massimo %d caratteri alfanumerici, '-', '_' o '.'", key, maxMetadataLabelKey)
+		}
+		if err := validMetadataText(value, maxMetadataLabelValue); err != nil {
+			return fmt.Errorf("il valore della label %q %v", key, err)
+		}
+	}
+	return nil
+}
+
+// isEmpty indica se il dispositivo non ha dichiarato alcun metadato.
+func (m *DeviceMetadata) isEmpty() bool {
+	return m.Model == "" && m.SerialNumber == "" && m.FirmwareVersion == "" && m.MACAddress == "" && len(m.Labels) == 0
+}
+
+// object restituisce i metadati nella forma usata dagli oggetti unstructured, omettendo i campi vuoti.
+func (m *DeviceMetadata) object() map[string]interface{} {
+	object := map[string]interface{}{}
+	for key, value := range map[string]string{
+		"model":           m.Model,
+		"serialNumber":    m.SerialNumber,
+		"firmwareVersion": m.FirmwareVersion,
+		"macAddress":      m.MACAddress,
+	} {
+		if value != "" {
+			object[key] = value
+		}
+	}
+	if len(m.Labels) > 0 {
+		labels := make(map[string]interface{}, len(m.Labels))
+		for key, value := range m.Labels {
+			labels[key] = value
+		}
+		object["labels"] = labels
+	}
+	return object
+}
+
+// validMetadataText verifica che un valore dichiarato dal dispositivo sia testo UTF-8 stampabile
+// di lunghezza limitata. L'errore completa una frase che inizia con il nome del campo.
+func validMetadataText(value string, max int) error {
+	if !utf8.ValidString(value) {
+		return fmt.Errorf("non è testo UTF-8 valido")
+	}
+	if len(value) > max {
+		return fmt.Errorf("supera la lunghezza massima di %d byte", max)
+	}
+	for _, r := range value {
+		if !unicode.IsPrint(r) {
+			return fmt.Errorf("contiene caratteri non stampabili")
+		}
+	}
+	return nil
+}
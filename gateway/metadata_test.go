@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestDeviceMetadataNormalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata DeviceMetadata
+		want     DeviceMetadata
+		wantErr  string
+	}{
+		{
+			name: "canonical form",
+			metadata: DeviceMetadata{
+				Model:           " th-sensor-v2 ",
+				FirmwareVersion: "1.4.2",
+				MACAddress:      "AA-BB-CC-00-11-22",
+				Labels:          map[string]string{"site": "plant-3"},
+			},
+			want: DeviceMetadata{
+				Model:           "th-sensor-v2",
+				FirmwareVersion: "1.4.2",
+				MACAddress:      "aa:bb:cc:00:11:22",
+				Labels:          map[string]string{"site": "plant-3"},
+			},
+		},
+		{name: "model too long", metadata: DeviceMetadata{Model: strings.Repeat("m", maxModelLength+1)}, wantErr: "'model'"},
+		{name: "control characters", metadata: DeviceMetadata{SerialNumber: "SN\n42"}, wantErr: "non stampabili"},
+		{name: "EUI-64 MAC address", metadata: DeviceMetadata{MACAddress: "02:00:5e:10:00:00:00:01"}, wantErr: "'macAddress'"},
+		{name: "invalid label key", metadata: DeviceMetadata{Labels: map[string]string{"room/1": "a"}}, wantErr: "room/1"},
+		{name: "label value too long", metadata: DeviceMetadata{Labels: map[string]string{"note": strings.Repeat("x", maxMetadataLabelValue+1)}}, wantErr: "note"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.metadata.normalize()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("normalize() error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.metadata.Model != tt.want.Model || tt.metadata.FirmwareVersion != tt.want.FirmwareVersion ||
+				tt.metadata.MACAddress != tt.want.MACAddress || tt.metadata.Labels["site"] != tt.want.Labels["site"] {
+				t.Fatalf("normalize() = %+v, want %+v", tt.metadata, tt.want)
+			}
+		})
+	}
+
+	labels := map[string]string{}
+	for i := 0; i <= maxMetadataLabels; i++ {
+		labels[strings.Repeat("k", i+1)] = "v"
+	}
+	if err := (&DeviceMetadata{Labels: labels}).normalize(); err == nil {
+		t.Fatalf("%d labels accepted, want at most %d", len(labels), maxMetadataLabels)
+	}
+}
+
+func TestCreateRegistrationWithMetadata(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deviceRegistrationGVR: "DeviceRegistrationList"})
+	h := &gatewayHandler{kubeClient: client, namespace: "devices", gvr: deviceRegistrationGVR, namePrefix: "dev-reg-"}
+
+	metadata := &DeviceMetadata{Model: "th-sensor-v2", MACAddress: "aa:bb:cc:00:11:22", Labels: map[string]string{"site": "plant-3"}}
+	name, err := h.createDeviceRegistrationResource(context.Background(), "key", metadata, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := client.Resource(deviceRegistrationGVR).Namespace("devices").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	model, _, _ := unstructured.NestedString(res.Object, "spec", "metadata", "model")
+	mac, _, _ := unstructured.NestedString(res.Object, "spec", "metadata", "macAddress")
+	site, _, _ := unstructured.NestedString(res.Object, "spec", "metadata", "labels", "site")
+	if model != "th-sensor-v2" || mac != "aa:bb:cc:00:11:22" || site != "plant-3" {
+		t.Fatalf("spec.metadata = %v", res.Object["spec"])
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(res.Object, "spec", "metadata", "serialNumber"); found {
+		t.Fatal("empty fields must be omitted from spec.metadata")
+	}
+
+	// Senza metadati la spec contiene solo la chiave pubblica.
+	name, err = h.createDeviceRegistrationResource(context.Background(), "key", &DeviceMetadata{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err = client.Resource(deviceRegistrationGVR).Namespace("devices").Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := unstructured.NestedFieldNoCopy(res.Object, "spec", "metadata"); found {
+		t.Fatalf("spec = %v, want no metadata", res.Object["spec"])
+	}
+}
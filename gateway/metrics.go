@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Esiti delle richieste POST /enroll riportati nella metrica device_gateway_enrollment_requests_total.
+const (
+	outcomeApproved      = "approved"
+	outcomeRejected      = "rejected"
+	outcomeExpired       = "expired"
+	outcomeTimeout       = "timeout"
+	outcomeAccepted      = "accepted"
+	outcomeBadRequest    = "bad_request"
+	outcomeUnauthorized  = "unauthorized"
+	outcomeRateLimited   = "rate_limited"
+	outcomeUnavailable   = "unavailable"
+	outcomeInternalError = "internal_error"
+	outcomeCanceled      = "canceled"
+)
+
+var (
+	// metricsRegistry contiene solo le metriche del gateway e quelle del runtime Go.
+	metricsRegistry = prometheus.NewRegistry()
+
+	enrollmentRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "device_gateway_enrollment_requests_total",
+		Help: "Richieste POST /enroll per esito.",
+	}, []string{"outcome"})
+
+	approvalDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "device_gateway_approval_duration_seconds",
+		Help:    "Tempo tra la ricezione di POST /enroll e la decisione dell'operatore, per le richieste decise a connessione aperta.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"outcome"})
+
+	waitingRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "device_gateway_waiting_requests",
+		Help: "Richieste in attesa di un aggiornamento di una DeviceRegistration da parte dell'operatore.",
+	})
+
+	kubernetesRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "device_gateway_kubernetes_request_duration_seconds",
+		Help:    "Durata delle chiamate all'API di Kubernetes, esclusi i watch.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	kubernetesRequestErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "device_gateway_kubernetes_request_errors_total",
+		Help: "Chiamate all'API di Kubernetes fallite per errore di rete o con risposta 5xx.",
+	}, []string{"method"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		enrollmentRequests,
+		approvalDuration,
+		waitingRequests,
+		kubernetesRequestDuration,
+		kubernetesRequestErrors,
+	)
+}
+
+// metricsHandler serve GET /metrics nel formato di Prometheus.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// statusRecorder ricorda lo status code scritto da un gestore.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// instrumentEnrollment conta le richieste POST /enroll per esito, ricavato dallo status code della risposta.
+func instrumentEnrollment(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		enrollmentRequests.WithLabelValues(enrollmentOutcomeLabel(rec.code, prefersAsync(r))).Inc()
+	})
+}
+
+func enrollmentOutcomeLabel(code int, async bool) string {
+	switch code {
+	case 0:
+		// Nessuna risposta: il client ha chiuso la connessione durante l'attesa.
+		return outcomeCanceled
+	case http.StatusOK:
+		return outcomeApproved
+	case http.StatusAccepted:
+		// In modalità asincrona il 202 è la risposta prevista, non un timeout.
+		if async {
+			return outcomeAccepted
+		}
+		return outcomeTimeout
+	case http.StatusForbidden:
+		return outcomeRejected
+	case http.StatusGone:
+		return outcomeExpired
+	case http.StatusUnauthorized:
+		return outcomeUnauthorized
+	case http.StatusTooManyRequests:
+		return outcomeRateLimited
+	case http.StatusServiceUnavailable:
+		return outcomeUnavailable
+	}
+	if code >= 400 && code < 500 {
+		return outcomeBadRequest
+	}
+	return outcomeInternalError
+}
+
+// observeApproval registra il tempo impiegato dall'operatore per decidere una richiesta.
+func observeApproval(outcome string, started time.Time) {
+	approvalDuration.WithLabelValues(outcome).Observe(time.Since(started).Seconds())
+}
+
+// instrumentedTransport misura le chiamate all'API di Kubernetes fatte dal client del gateway.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	// I watch dell'informer restano aperti per minuti: la loro durata non è una latenza.
+	if req.URL.Query().Get("watch") == "true" {
+		return resp, err
+	}
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	kubernetesRequestDuration.WithLabelValues(req.Method, code).Observe(time.Since(started).Seconds())
+	if err != nil || resp.StatusCode >= 500 {
+		kubernetesRequestErrors.WithLabelValues(req.Method).Inc()
+	}
+	return resp, err
+}
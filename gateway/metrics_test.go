@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentEnrollmentCountsOutcomes(t *testing.T) {
+	tests := []struct {
+		code    int
+		target  string
+		outcome string
+	}{
+		{code: http.StatusOK, target: "/enroll", outcome: outcomeApproved},
+		{code: http.StatusAccepted, target: "/enroll", outcome: outcomeTimeout},
+		{code: http.StatusAccepted, target: "/enroll?async=true", outcome: outcomeAccepted},
+		{code: http.StatusForbidden, target: "/enroll", outcome: outcomeRejected},
+		{code: http.StatusBadRequest, target: "/enroll", outcome: outcomeBadRequest},
+		{code: http.StatusTooManyRequests, target: "/enroll", outcome: outcomeRateLimited},
+		{code: http.StatusInternalServerError, target: "/enroll", outcome: outcomeInternalError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outcome, func(t *testing.T) {
+			before := testutil.ToFloat64(enrollmentRequests.WithLabelValues(tt.outcome))
+			handler := instrumentEnrollment(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.code)
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, tt.target, nil))
+			if got := testutil.ToFloat64(enrollmentRequests.WithLabelValues(tt.outcome)) - before; got != 1 {
+				t.Fatalf("outcome %s incremented by %v, want 1", tt.outcome, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parsePublicKey decodifica la chiave pubblica inviata dal dispositivo.
+// Accetta gli stessi formati dell'operatore (PEM PKIX/PKCS#1, OpenSSH authorized_keys,
+// Ed25519 grezza in base64 o hex); la verifica della robustezza resta compito dell'operatore.
+func parsePublicKey(raw string) (crypto.PublicKey, error) {
+	data := strings.TrimSpace(raw)
+	if data == "" {
+		return nil, errors.New("chiave pubblica vuota")
+	}
+
+	if strings.HasPrefix(data, "-----BEGIN") {
+		block, rest := pem.Decode([]byte(data))
+		if block == nil {
+			return nil, errors.New("blocco PEM malformato")
+		}
+		if len(strings.TrimSpace(string(rest))) > 0 {
+			return nil, errors.New("dati inattesi dopo il blocco PEM")
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			return x509.ParsePKCS1PublicKey(block.Bytes)
+		default:
+			return nil, fmt.Errorf("tipo di blocco PEM non supportato: %q", block.Type)
+		}
+	}
+
+	if strings.ContainsAny(data, " \t") {
+		sshKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(data))
+		if err != nil {
+			return nil, fmt.Errorf("chiave OpenSSH non valida: %w", err)
+		}
+		cryptoKey, ok := sshKey.(ssh.CryptoPublicKey)
+		if !ok {
+			return nil, fmt.Errorf("tipo di chiave OpenSSH non supportato: %q", sshKey.Type())
+		}
+		return cryptoKey.CryptoPublicKey(), nil
+	}
+
+	if raw, err := base64.StdEncoding.DecodeString(data); err == nil && len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+	if raw, err := base64.RawURLEncoding.DecodeString(data); err == nil && len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+	if raw, err := hex.DecodeString(data); err == nil && len(raw) == ed25519.PublicKeySize {
+		return ed25519.PublicKey(raw), nil
+	}
+
+	return nil, errors.New("formato della chiave pubblica non riconosciuto")
+}
+
+// verifyProofOfPossession verifica che signature sia una firma valida di message
+// prodotta con la chiave privata corrispondente a key. Gli schemi supportati sono:
+//   - RSA: RSA-PSS con SHA-256;
+//   - ECDSA P-256: ECDSA con SHA-256, firma ASN.1 DER oppure r||s di 64 byte;
+//   - Ed25519: firma Ed25519 pura sul messaggio.
+func verifyProofOfPossession(key crypto.PublicKey, message, signature []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		digest := sha256.Sum256(message)
+		if err := rsa.VerifyPSS(k, crypto.SHA256, digest[:], signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}); err != nil {
+			return errors.New("firma RSA-PSS non valida")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return fmt.Errorf("curva ECDSA %s non supportata, usare P-256", k.Curve.Params().Name)
+		}
+		digest := sha256.Sum256(message)
+		if len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(k, digest[:], r, s) {
+				return nil
+			}
+		}
+		if !ecdsa.VerifyASN1(k, digest[:], signature) {
+			return errors.New("firma ECDSA non valida")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, message, signature) {
+			return errors.New("firma Ed25519 non valida")
+		}
+		return nil
+	default:
+		return fmt.Errorf("tipo di chiave %T non supportato per la prova di possesso", key)
+	}
+}
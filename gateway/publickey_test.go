@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+)
+
+func TestVerifyProofOfPossession(t *testing.T) {
+	message := []byte("nonce-di-prova")
+	digest := sha256.Sum256(message)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSig, err := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA256, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSig, err := ecdsa.SignASN1(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecRawSig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSig := ed25519.Sign(edPriv, message)
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     crypto.PublicKey
+		sig     []byte
+		wantErr bool
+	}{
+		{name: "RSA-PSS", key: &rsaKey.PublicKey, sig: rsaSig},
+		{name: "ECDSA P-256 DER", key: &ecKey.PublicKey, sig: ecSig},
+		{name: "ECDSA P-256 raw", key: &ecKey.PublicKey, sig: ecRawSig},
+		{name: "Ed25519", key: edPub, sig: edSig},
+		{name: "wrong key", key: &ecKey.PublicKey, sig: edSig, wantErr: true},
+		{name: "tampered Ed25519", key: edPub, sig: append([]byte{edSig[0] ^ 0xff}, edSig[1:]...), wantErr: true},
+		{name: "ECDSA P-384 not supported", key: &p384Key.PublicKey, sig: ecSig, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyProofOfPossession(tt.key, message, tt.sig)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr=%v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestParsePublicKeyPEM(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(edPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	key, err := parsePublicKey(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !edPub.Equal(key) {
+		t.Fatal("parsed key does not match")
+	}
+	if _, err := parsePublicKey(encoded + "trailing-data"); err == nil {
+		t.Fatal("expected an error for data after the PEM block")
+	}
+	if _, err := parsePublicKey("ssh-rsa FAKE-KEY"); err == nil {
+		t.Fatal("expected an error for a fake key")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	// Valori predefiniti dei limiti su POST /enroll.
+	defaultEnrollRatePerIP       = 6 // richieste al minuto per indirizzo IP
+	defaultEnrollBurstPerIP      = 3
+	defaultEnrollGlobalRate      = 120 // registrazioni create al minuto
+	defaultEnrollGlobalBurst     = 20
+	defaultMaxPendingEnrollments = 100
+
+	// maxTrackedClients limita la memoria occupata dai limiti per indirizzo IP.
+	maxTrackedClients = 10000
+)
+
+var errTooManyClients = errors.New("troppi client distinti, riprovare più tardi")
+
+// rateLimitConfig raccoglie i limiti applicati alla creazione delle DeviceRegistration,
+// nella forma usata dai token bucket.
+type rateLimitConfig struct {
+	PerIPRate      rate.Limit
+	PerIPBurst     int
+	GlobalRate     rate.Limit
+	GlobalBurst    int
+	MaxPending     int
+	TrustedProxies []netip.Prefix
+}
+
+// newRateLimitConfig converte i limiti della configurazione, già validati, da valori al minuto a valori al secondo.
+func newRateLimitConfig(settings rateLimitSettings) (rateLimitConfig, error) {
+	trustedProxies, err := parseTrustedProxies(settings.TrustedProxies)
+	if err != nil {
+		return rateLimitConfig{}, err
+	}
+	return rateLimitConfig{
+		PerIPRate:      rate.Limit(float64(settings.PerIPPerMinute) / 60),
+		PerIPBurst:     settings.PerIPBurst,
+		GlobalRate:     rate.Limit(float64(settings.GlobalPerMinute) / 60),
+		GlobalBurst:    settings.GlobalBurst,
+		MaxPending:     settings.MaxPending,
+		TrustedProxies: trustedProxies,
+	}, nil
+}
+
+// parseTrustedProxies interpreta un elenco di indirizzi o reti CIDR.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("proxy fidato non valido %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("proxy fidato non valido %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// enrollmentLimiter applica i limiti di POST /enroll: un token bucket per indirizzo IP
+// e uno globale per le registrazioni create.
+type enrollmentLimiter struct {
+	config rateLimitConfig
+	global *rate.Limiter
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*rate.Limiter
+	now     func() time.Time
+}
+
+func newEnrollmentLimiter(config rateLimitConfig) *enrollmentLimiter {
+	return &enrollmentLimiter{
+		config:  config,
+		global:  rate.NewLimiter(config.GlobalRate, config.GlobalBurst),
+		clients: make(map[netip.Addr]*rate.Limiter),
+		now:     time.Now,
+	}
+}
+
+// allowClient consuma un token del client; se non ce ne sono restituisce dopo quanto riprovare.
+func (l *enrollmentLimiter) allowClient(client netip.Addr) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	limiter, ok := l.clients[client]
+	if !ok {
+		// Prima di rifiutare per eccesso di client, eliminiamo quelli con il bucket di nuovo pieno:
+		// ricrearli da zero è equivalente.
+		if len(l.clients) >= maxTrackedClients {
+			for addr, lim := range l.clients {
+				if lim.TokensAt(now) >= float64(l.config.PerIPBurst) {
+					delete(l.clients, addr)
+				}
+			}
+			if len(l.clients) >= maxTrackedClients {
+				return time.Minute, errTooManyClients
+			}
+		}
+		limiter = rate.NewLimiter(l.config.PerIPRate, l.config.PerIPBurst)
+		l.clients[client] = limiter
+	}
+	return reserve(limiter, now), nil
+}
+
+// allowCreation consuma un token del limite globale sulle registrazioni create.
+func (l *enrollmentLimiter) allowCreation() time.Duration {
+	return reserve(l.global, l.now())
+}
+
+// reserve consuma un token se disponibile subito, altrimenti restituisce l'attesa necessaria senza consumarlo.
+func reserve(limiter *rate.Limiter, now time.Time) time.Duration {
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return time.Minute
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+// clientIP determina l'indirizzo del client. L'header X-Forwarded-For viene considerato solo se la
+// connessione arriva da un proxy fidato: lo si legge da destra saltando i proxy fidati, perché
+// le voci più a sinistra possono essere scritte dal client stesso.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("indirizzo remoto non valido %q: %w", r.RemoteAddr, err)
+	}
+	remote = remote.Unmap()
+	if !isTrustedProxy(remote, trustedProxies) {
+		return remote, nil
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Una voce non valida interrompe la catena: ci fermiamo all'ultimo indirizzo affidabile.
+			break
+		}
+		addr = addr.Unmap()
+		if !isTrustedProxy(addr, trustedProxies) {
+			return addr, nil
+		}
+		remote = addr
+	}
+	return remote, nil
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// countPendingRegistrations conta, sulla cache dell'informer, le registrazioni del namespace
+// non ancora decise dall'operatore. Quelle in attesa da più di enrollmentTicketTTL non contano:
+// il loro ticket è scaduto e l'operatore le cancella, quindi non devono bloccare nuovi enrollment.
+func (h *gatewayHandler) countPendingRegistrations(now time.Time) (int, error) {
+	items, err := h.registrations.list(h.namespace, labels.Everything())
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, item := range items {
+		if phase, _, _ := unstructured.NestedString(item.Object, "status", "phase"); phase != "" && phase != "Pending" {
+			continue
+		}
+		if created := item.GetCreationTimestamp(); !created.IsZero() && now.Sub(created.Time) > enrollmentTicketTTL {
+			continue
+		}
+		pending++
+	}
+	return pending, nil
+}
+
+// writeTooManyRequests risponde 429 indicando dopo quanti secondi riprovare.
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, r, http.StatusTooManyRequests, errorCodeRateLimited, message, true)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		want         string
+	}{
+		{name: "direct client", remoteAddr: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "untrusted peer cannot spoof", remoteAddr: "203.0.113.7:4000", forwardedFor: "198.51.100.1", want: "203.0.113.7"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:4000", forwardedFor: "198.51.100.1", want: "198.51.100.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.1.2.3:4000", forwardedFor: "198.51.100.9, 198.51.100.1, 192.168.1.1", want: "198.51.100.1"},
+		{name: "only trusted hops", remoteAddr: "10.1.2.3:4000", forwardedFor: "10.9.9.9", want: "10.9.9.9"},
+		{name: "malformed entry", remoteAddr: "10.1.2.3:4000", forwardedFor: "garbage", want: "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/enroll", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			got, err := clientIP(r, trusted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != netip.MustParseAddr(tt.want) {
+				t.Fatalf("clientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnrollmentLimiterPerClient(t *testing.T) {
+	limiter := newEnrollmentLimiter(rateLimitConfig{PerIPRate: 1, PerIPBurst: 2, GlobalRate: 1, GlobalBurst: 1})
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+	client := netip.MustParseAddr("203.0.113.7")
+
+	for i := 0; i < 2; i++ {
+		if retryAfter, err := limiter.allowClient(client); err != nil || retryAfter != 0 {
+			t.Fatalf("request %d within the burst was limited (%v, %v)", i, retryAfter, err)
+		}
+	}
+	if retryAfter, _ := limiter.allowClient(client); retryAfter <= 0 {
+		t.Fatal("a request beyond the burst must be limited")
+	}
+	if retryAfter, _ := limiter.allowClient(netip.MustParseAddr("203.0.113.8")); retryAfter != 0 {
+		t.Fatal("other clients must not share the bucket")
+	}
+
+	now = now.Add(time.Second)
+	if retryAfter, _ := limiter.allowClient(client); retryAfter != 0 {
+		t.Fatal("the bucket must refill over time")
+	}
+
+	if limiter.allowCreation() != 0 || limiter.allowCreation() <= 0 {
+		t.Fatal("the global limit must allow exactly its burst")
+	}
+}
+
+func TestCountPendingRegistrationsSkipsExpiredTickets(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	registration := func(name, phase string, age time.Duration) runtime.Object {
+		res := &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": deviceRegistrationGVR.GroupVersion().String(),
+			"kind":       "DeviceRegistration",
+			"metadata":   map[string]interface{}{"name": name, "namespace": "devices"},
+		}}
+		res.SetCreationTimestamp(metav1.NewTime(now.Add(-age)))
+		if phase != "" {
+			_ = unstructured.SetNestedField(res.Object, phase, "status", "phase")
+		}
+		return res
+	}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deviceRegistrationGVR: "DeviceRegistrationList"},
+		registration("new", "", time.Minute),
+		registration("pending", "Pending", time.Hour),
+		registration("approved", "Approved", time.Hour),
+		registration("stale", "Pending", enrollmentTicketTTL+time.Minute),
+	)
+	h := &gatewayHandler{namespace: "devices", registrations: newRegistrationWatcher(client, "devices", deviceRegistrationGVR)}
+	if err := h.registrations.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := h.countPendingRegistrations(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 2 {
+		t.Fatalf("countPendingRegistrations() = %d, want 2 (the stale request has an expired ticket)", pending)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// renewalRequestAnnotation è l'annotazione con cui il gateway chiede all'operatore un nuovo certificato.
+	renewalRequestAnnotation = "devices.example.com/renewal-request"
+	// deviceUUIDLabel è la label con cui l'operatore marca la registrazione originale di un dispositivo.
+	deviceUUIDLabel = "devices.example.com/device-uuid"
+)
+
+// RenewalRequest è ciò che il dispositivo invia a POST /renew.
+// Il dispositivo si autentica con il certificato corrente e con la firma di un nonce
+// ottenuto da POST /enroll/challenge, prodotta con la chiave privata del certificato.
+type RenewalRequest struct {
+	Certificate string `json:"certificate"`
+	Nonce       string `json:"nonce"`
+	Signature   string `json:"signature"`
+}
+
+// RenewalResponse contiene il nuovo certificato (PEM: dispositivo, poi CA) e la sua scadenza.
+type RenewalResponse struct {
+	DeviceUUID  string `json:"deviceUUID"`
+	Certificate string `json:"certificate"`
+	NotAfter    string `json:"notAfter,omitempty"` // Formato RFC3339
+	Message     string `json:"message"`
+}
+
+// serveRenewal gestisce POST /renew: verifica la credenziale corrente del dispositivo e chiede
+// all'operatore di emettere un nuovo certificato prima della scadenza.
+func (h *gatewayHandler) serveRenewal(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Ricevuta richiesta: %s %s", r.Method, r.URL.Path)
+
+	if r.Method != http.MethodPost {
+		writeError(w, r, http.StatusMethodNotAllowed, errorCodeMethodNotAllowed, "Metodo non consentito. Usare POST.", false)
+		return
+	}
+	if h.rejectWhileDraining(w, r) {
+		return
+	}
+
+	var req RenewalRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Corpo della richiesta JSON non valido.", false)
+		return
+	}
+	if req.Certificate == "" || req.Nonce == "" || req.Signature == "" {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "I campi 'certificate', 'nonce' e 'signature' sono obbligatori.", false)
+		return
+	}
+
+	cert, err := parseLeafCertificate(req.Certificate)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, fmt.Sprintf("Certificato non valido: %v", err), false)
+		return
+	}
+	signature, err := base64.StdEncoding.DecodeString(req.Signature)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Il campo 'signature' deve essere codificato in base64.", false)
+		return
+	}
+
+	// La credenziale corrente deve essere ancora valida: un certificato scaduto non può essere rinnovato.
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Il certificato non è valido in questo momento.", false)
+		return
+	}
+	if err := h.challenges.consume(req.Nonce); err != nil {
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("Challenge non valida: %v", err), true)
+		return
+	}
+	if err := verifyProofOfPossession(cert.PublicKey, []byte(req.Nonce), signature); err != nil {
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, fmt.Sprintf("Prova di possesso fallita: %v", err), false)
+		return
+	}
+
+	// Il certificato deve essere stato emesso dalla CA dell'operatore, pubblicata accanto alla CRL.
+	roots, err := h.deviceCertificatePool(r.Context())
+	if err != nil {
+		log.Printf("ERRORE: Impossibile leggere la CA dei dispositivi: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errorCodeUnavailable, "La CA dei dispositivi non è disponibile.", true)
+		return
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Il certificato non è stato emesso dalla CA dei dispositivi.", false)
+		return
+	}
+
+	// Il certificato deve essere esattamente quello attualmente registrato per il dispositivo,
+	// per la chiave pubblica con cui il dispositivo si è registrato.
+	deviceUUID := cert.Subject.CommonName
+	registration, err := h.findDeviceRegistration(r.Context(), deviceUUID)
+	if err != nil {
+		log.Printf("ERRORE: Impossibile cercare la registrazione del dispositivo %s: %v", deviceUUID, err)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la ricerca del dispositivo.", true)
+		return
+	}
+	if registration == nil {
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Dispositivo sconosciuto.", false)
+		return
+	}
+	phase, _, _ := unstructured.NestedString(registration.Object, "status", "phase")
+	serial, _, _ := unstructured.NestedString(registration.Object, "status", "certificateSerialNumber")
+	if serial != fmt.Sprintf("%x", cert.SerialNumber) || !registeredKeyMatches(registration, cert.PublicKey) {
+		writeError(w, r, http.StatusUnauthorized, errorCodeUnauthorized, "Il certificato non corrisponde alla credenziale corrente del dispositivo.", false)
+		return
+	}
+	if phase != "Approved" {
+		writeError(w, r, http.StatusForbidden, renewalPhaseErrorCode(phase),
+			fmt.Sprintf("Il dispositivo è nella fase %s e non può rinnovare il certificato.", phase), false)
+		return
+	}
+
+	renewed, err := h.requestRenewal(r.Context(), registration.GetName())
+	if err != nil {
+		log.Printf("ERRORE: Rinnovo del certificato per '%s' fallito: %v", registration.GetName(), err)
+		errorCode := errorCodeUnavailable
+		if errors.Is(err, context.DeadlineExceeded) {
+			errorCode = errorCodeTimeout
+		}
+		writeError(w, r, http.StatusServiceUnavailable, errorCode, fmt.Sprintf("Rinnovo fallito: %v", err), true)
+		return
+	}
+
+	log.Printf("SUCCESSO: Certificato del dispositivo %s rinnovato.", deviceUUID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(renewed)
+}
+
+// renewalPhaseErrorCode restituisce il codice di errore per un dispositivo che non può rinnovare il certificato.
+func renewalPhaseErrorCode(phase string) string {
+	switch phase {
+	case "Deactivated":
+		return errorCodeDeactivated
+	case "Suspended":
+		return errorCodeSuspended
+	case "Quarantined":
+		return errorCodeQuarantined
+	case "Retired":
+		return errorCodeRetired
+	case "Expired":
+		return errorCodeExpired
+	}
+	return errorCodeRejected
+}
+
+// deviceCertificatePool restituisce la CA con cui l'operatore firma i certificati dei dispositivi.
+func (h *gatewayHandler) deviceCertificatePool(ctx context.Context) (*x509.CertPool, error) {
+	data, err := h.readCRLConfigMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	caPEM := data[crlCACertKey]
+	if caPEM == "" {
+		return nil, errors.New("certificato della CA non ancora pubblicato")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(caPEM)) {
+		return nil, errors.New("certificato della CA non valido")
+	}
+	return pool, nil
+}
+
+// registeredKeyMatches indica se key è la chiave pubblica con cui il dispositivo si è registrato.
+func registeredKeyMatches(registration *unstructured.Unstructured, key crypto.PublicKey) bool {
+	raw, _, _ := unstructured.NestedString(registration.Object, "spec", "publicKey")
+	registered, err := parsePublicKey(raw)
+	if err != nil {
+		return false
+	}
+	comparable, ok := registered.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && comparable.Equal(key)
+}
+
+// findDeviceRegistration cerca la registrazione originale di un dispositivo tramite la label con il suo UUID.
+func (h *gatewayHandler) findDeviceRegistration(ctx context.Context, deviceUUID string) (*unstructured.Unstructured, error) {
+	if _, err := uuid.Parse(deviceUUID); err != nil {
+		return nil, nil
+	}
+	// La ricerca avviene sulla cache dell'informer: gli oggetti restituiti non vanno modificati.
+	items, err := h.registrations.list(h.namespace, labels.SelectorFromSet(labels.Set{deviceUUIDLabel: deviceUUID}))
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		duplicateOf, _, _ := unstructured.NestedString(item.Object, "status", "duplicateOf")
+		if duplicateOf == "" {
+			return item, nil
+		}
+	}
+	return nil, nil
+}
+
+// requestRenewal annota la registrazione con un token univoco e attende che l'operatore
+// lo riporti in status.lastRenewalRequest insieme al nuovo certificato.
+func (h *gatewayHandler) requestRenewal(ctx context.Context, name string) (*RenewalResponse, error) {
+	token := uuid.New().String()
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{renewalRequestAnnotation: token},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.kubeClient.Resource(h.gvr).Namespace(h.namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return nil, fmt.Errorf("impossibile richiedere il rinnovo: %w", err)
+	}
+
+	var renewed *RenewalResponse
+	err = h.waitForRegistration(ctx, name, h.registrationTimeout, func(status map[string]interface{}) (bool, error) {
+		if lastRequest, _ := status["lastRenewalRequest"].(string); lastRequest != token {
+			return false, nil
+		}
+		deviceUUID, _ := status["deviceUUID"].(string)
+		certificate, _ := status["certificate"].(string)
+		notAfter, _ := status["certificateNotAfter"].(string)
+		renewed = &RenewalResponse{
+			DeviceUUID:  deviceUUID,
+			Certificate: certificate,
+			NotAfter:    notAfter,
+			Message:     "Certificato rinnovato con successo.",
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return renewed, nil
+}
+
+// parseLeafCertificate decodifica il primo certificato di una catena PEM.
+func parseLeafCertificate(chain string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(chain))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("blocco PEM CERTIFICATE non trovato")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// testDeviceCA è una CA di prova che firma i certificati dei dispositivi come l'operatore.
+type testDeviceCA struct {
+	cert *x509.Certificate
+	key  ed25519.PrivateKey
+	pem  string
+}
+
+func newTestDeviceCA(t *testing.T) *testDeviceCA {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "device-operator-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, publicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testDeviceCA{cert: cert, key: privateKey, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// deviceCertificate restituisce in PEM un certificato client per deviceUUID e publicKey, firmato dalla CA
+// oppure, se ca è nil, autofirmato con signer.
+func deviceCertificate(t *testing.T, ca *testDeviceCA, deviceUUID string, serial int64, publicKey ed25519.PublicKey, signer ed25519.PrivateKey) string {
+	t.Helper()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: deviceUUID},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := template, signer
+	if ca != nil {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, publicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestServeRenewal(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const deviceUUID = "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a"
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerPublicKey, attackerPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestDeviceCA(t)
+	certificate := deviceCertificate(t, ca, deviceUUID, 0xa1, publicKey, nil)
+
+	registration := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": deviceRegistrationGVR.GroupVersion().String(),
+		"kind":       "DeviceRegistration",
+		"metadata": map[string]interface{}{
+			"name":      "dev-reg-1a2b3c4d",
+			"namespace": "devices",
+			"labels":    map[string]interface{}{deviceUUIDLabel: deviceUUID},
+		},
+		"spec": map[string]interface{}{
+			"publicKey": base64.StdEncoding.EncodeToString(publicKey),
+		},
+		"status": map[string]interface{}{
+			"phase":                   "Approved",
+			"deviceUUID":              deviceUUID,
+			"certificateSerialNumber": "a1",
+		},
+	}}
+	crl := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": defaultCRLConfigMapName, "namespace": "devices"},
+		"data":       map[string]interface{}{crlCACertKey: ca.pem},
+	}}
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deviceRegistrationGVR: "DeviceRegistrationList", configMapGVR: "ConfigMapList"},
+		registration, crl)
+	h := &gatewayHandler{
+		kubeClient:          client,
+		namespace:           "devices",
+		challenges:          newChallengeStore(time.Minute),
+		registrations:       newRegistrationWatcher(client, "devices", deviceRegistrationGVR),
+		gvr:                 deviceRegistrationGVR,
+		registrationTimeout: 5 * time.Second,
+		crlConfigMapName:    defaultCRLConfigMapName,
+		lifecycle:           newLifecycle(),
+	}
+	if err := h.registrations.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	renew := func(certificate string, key ed25519.PrivateKey) *httptest.ResponseRecorder {
+		nonce, _, err := h.challenges.issue()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := json.Marshal(RenewalRequest{
+			Certificate: certificate,
+			Nonce:       nonce,
+			Signature:   base64.StdEncoding.EncodeToString(ed25519.Sign(key, []byte(nonce))),
+		})
+		rec := httptest.NewRecorder()
+		h.serveRenewal(rec, httptest.NewRequest(http.MethodPost, "/renew", bytes.NewReader(body)))
+		return rec
+	}
+	expectUnauthorized := func(name string, rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if rec.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: renewal = %d %s, want 401", name, rec.Code, rec.Body)
+		}
+		var errorResponse ErrorResponse
+		if err := json.NewDecoder(rec.Body).Decode(&errorResponse); err != nil {
+			t.Fatal(err)
+		}
+		if errorResponse.Error.Code != errorCodeUnauthorized {
+			t.Fatalf("%s: error code = %q, want %q", name, errorResponse.Error.Code, errorCodeUnauthorized)
+		}
+	}
+
+	// Chi conosce UUID e numero di serie del dispositivo non può rinnovare con un certificato che si è firmato da sé,
+	// né con un certificato della CA emesso per un'altra chiave.
+	expectUnauthorized("self-signed certificate",
+		renew(deviceCertificate(t, nil, deviceUUID, 0xa1, attackerPublicKey, attackerPrivateKey), attackerPrivateKey))
+	expectUnauthorized("certificate for another key",
+		renew(deviceCertificate(t, ca, deviceUUID, 0xa1, attackerPublicKey, nil), attackerPrivateKey))
+
+	// L'operatore emette il nuovo certificato quando trova l'annotazione con il token di rinnovo.
+	go func() {
+		for ctx.Err() == nil {
+			res, err := client.Resource(deviceRegistrationGVR).Namespace("devices").Get(ctx, "dev-reg-1a2b3c4d", metav1.GetOptions{})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if token := res.GetAnnotations()[renewalRequestAnnotation]; token != "" {
+				_ = unstructured.SetNestedField(res.Object, token, "status", "lastRenewalRequest")
+				_ = unstructured.SetNestedField(res.Object, "b2", "status", "certificateSerialNumber")
+				_ = unstructured.SetNestedField(res.Object, "renewed-certificate", "status", "certificate")
+				if _, err := client.Resource(deviceRegistrationGVR).Namespace("devices").Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	rec := renew(certificate, privateKey)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("renewal = %d %s, want 200", rec.Code, rec.Body)
+	}
+	var response RenewalResponse
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.DeviceUUID != deviceUUID || response.Certificate != "renewed-certificate" {
+		t.Fatalf("renewal response = %+v, want the renewed certificate", response)
+	}
+
+	// Il certificato sostituito non è più la credenziale corrente e non può rinnovare di nuovo.
+	if err := waitForSerialNumber(ctx, h, "b2"); err != nil {
+		t.Fatal(err)
+	}
+	expectUnauthorized("superseded certificate", renew(certificate, privateKey))
+}
+
+// waitForSerialNumber attende che la cache del gateway veda il numero di serie indicato.
+func waitForSerialNumber(ctx context.Context, h *gatewayHandler, serial string) error {
+	for ctx.Err() == nil {
+		if res, found, err := h.registrations.get("devices", "dev-reg-1a2b3c4d"); err == nil && found {
+			if current, _, _ := unstructured.NestedString(res.Object, "status", "certificateSerialNumber"); current == serial {
+				return nil
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return fmt.Errorf("serial number %s never reached the cache", serial)
+}
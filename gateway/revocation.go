@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// defaultCRLConfigMapName deve corrispondere al flag --crl-configmap-name dell'operatore.
+	defaultCRLConfigMapName = "device-operator-crl"
+
+	// Chiavi del ConfigMap pubblicato dall'operatore.
+	crlPEMKey     = "crl.pem"
+	crlRevokedKey = "revoked.json"
+	crlCACertKey  = "ca.crt"
+
+	// revocationReasonSuperseded è il motivo con cui l'operatore revoca il certificato sostituito da un rinnovo.
+	revocationReasonSuperseded = "Superseded"
+)
+
+// configMapGVR permette di leggere il ConfigMap della CRL con lo stesso client dinamico usato per le CR.
+var configMapGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// Stati restituiti da GET /status/{uuid}, sul modello delle risposte OCSP.
+const (
+	certificateStatusGood    = "good"
+	certificateStatusRevoked = "revoked"
+	certificateStatusExpired = "expired"
+	certificateStatusUnknown = "unknown"
+)
+
+// revokedCertificate rispecchia le voci di revoked.json scritte dall'operatore.
+type revokedCertificate struct {
+	SerialNumber string    `json:"serialNumber"`
+	DeviceUUID   string    `json:"deviceUUID"`
+	RevokedAt    time.Time `json:"revokedAt"`
+	NotAfter     time.Time `json:"notAfter"`
+	Reason       string    `json:"reason"`
+}
+
+// DeviceStatusResponse è la risposta di GET /status/{uuid}.
+type DeviceStatusResponse struct {
+	DeviceUUID       string `json:"deviceUUID"`
+	Status           string `json:"status"`
+	Phase            string `json:"phase,omitempty"`
+	SerialNumber     string `json:"serialNumber,omitempty"`
+	NotAfter         string `json:"notAfter,omitempty"`  // Formato RFC3339
+	RevokedAt        string `json:"revokedAt,omitempty"` // Formato RFC3339
+	RevocationReason string `json:"revocationReason,omitempty"`
+}
+
+// serveCRL gestisce GET /crl: restituisce l'ultima CRL firmata dall'operatore, in PEM
+// oppure in DER con ?format=der.
+func (h *gatewayHandler) serveCRL(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Ricevuta richiesta: %s %s", r.Method, r.URL.Path)
+
+	data, err := h.readCRLConfigMap(r.Context())
+	if err != nil {
+		log.Printf("ERRORE: Impossibile leggere la CRL: %v", err)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la lettura della CRL.", true)
+		return
+	}
+	crlPEM := data[crlPEMKey]
+	if crlPEM == "" {
+		writeError(w, r, http.StatusServiceUnavailable, errorCodeUnavailable, "La CRL non è ancora stata pubblicata.", true)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "pem":
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Write([]byte(crlPEM))
+	case "der":
+		block, _ := pem.Decode([]byte(crlPEM))
+		if block == nil {
+			log.Printf("ERRORE: Il ConfigMap della CRL non contiene un blocco PEM valido")
+			writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la lettura della CRL.", true)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(block.Bytes)
+	default:
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "Formato non supportato. Usare format=pem o format=der.", false)
+	}
+}
+
+// serveDeviceStatus gestisce GET /status/{uuid}: indica se il certificato corrente del dispositivo
+// è valido, revocato (dispositivo deattivato o cancellato) o scaduto.
+func (h *gatewayHandler) serveDeviceStatus(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Ricevuta richiesta: %s %s", r.Method, r.URL.Path)
+
+	deviceUUID := strings.ToLower(r.PathValue("uuid"))
+	if _, err := uuid.Parse(deviceUUID); err != nil {
+		writeError(w, r, http.StatusBadRequest, errorCodeInvalidRequest, "UUID del dispositivo non valido.", false)
+		return
+	}
+
+	response, err := h.deviceStatus(r.Context(), deviceUUID)
+	if err != nil {
+		log.Printf("ERRORE: Impossibile determinare lo stato del dispositivo %s: %v", deviceUUID, err)
+		writeError(w, r, http.StatusInternalServerError, errorCodeInternal, "Errore interno del server durante la verifica dello stato.", true)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if response.Status == certificateStatusUnknown {
+		w.WriteHeader(http.StatusNotFound)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// deviceStatus cerca prima la registrazione del dispositivo e poi, se è stata cancellata, le revoche pubblicate.
+func (h *gatewayHandler) deviceStatus(ctx context.Context, deviceUUID string) (*DeviceStatusResponse, error) {
+	response := &DeviceStatusResponse{DeviceUUID: deviceUUID, Status: certificateStatusUnknown}
+
+	registration, err := h.findDeviceRegistration(ctx, deviceUUID)
+	if err != nil {
+		return nil, err
+	}
+	if registration != nil {
+		status, _, _ := unstructured.NestedMap(registration.Object, "status")
+		response.Phase, _ = status["phase"].(string)
+		response.SerialNumber, _ = status["certificateSerialNumber"].(string)
+		response.NotAfter, _ = status["certificateNotAfter"].(string)
+
+		switch response.Phase {
+		case "Deactivated", "Suspended", "Quarantined", "Retired":
+			// Il motivo di revoca coincide con la fase, come in revoked.json.
+			response.Status = certificateStatusRevoked
+			response.RevokedAt, _ = status["certificateRevokedAt"].(string)
+			response.RevocationReason = response.Phase
+		case "Expired":
+			response.Status = certificateStatusExpired
+		case "Approved":
+			response.Status = certificateStatusGood
+			if notAfter, err := time.Parse(time.RFC3339, response.NotAfter); err == nil && !time.Now().Before(notAfter) {
+				response.Status = certificateStatusExpired
+			}
+		}
+		return response, nil
+	}
+
+	// La registrazione non esiste più: se è stata cancellata, il suo certificato è in revoked.json.
+	data, err := h.readCRLConfigMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var revoked []revokedCertificate
+	if raw := data[crlRevokedKey]; raw != "" {
+		if err := json.Unmarshal([]byte(raw), &revoked); err != nil {
+			return nil, err
+		}
+	}
+	for _, rc := range revoked {
+		// I certificati sostituiti da un rinnovo non descrivono lo stato del dispositivo.
+		if rc.DeviceUUID == deviceUUID && rc.Reason != revocationReasonSuperseded {
+			response.Status = certificateStatusRevoked
+			response.SerialNumber = rc.SerialNumber
+			response.NotAfter = rc.NotAfter.Format(time.RFC3339)
+			response.RevokedAt = rc.RevokedAt.Format(time.RFC3339)
+			response.RevocationReason = rc.Reason
+			break
+		}
+	}
+	return response, nil
+}
+
+// readCRLConfigMap legge i dati del ConfigMap della CRL. Un ConfigMap assente equivale a una CRL non ancora pubblicata.
+func (h *gatewayHandler) readCRLConfigMap(ctx context.Context) (map[string]string, error) {
+	cm, err := h.kubeClient.Resource(configMapGVR).Namespace(h.namespace).Get(ctx, h.crlConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := unstructured.NestedStringMap(cm.Object, "data")
+	return data, err
+}
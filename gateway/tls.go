@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// clientCertSubjectAnnotation e clientCertFingerprintAnnotation registrano sulla DeviceRegistration
+	// l'identità del certificato client verificato con cui è stata chiesta la registrazione.
+	clientCertSubjectAnnotation     = "devices.example.com/client-certificate-subject"
+	clientCertFingerprintAnnotation = "devices.example.com/client-certificate-sha256"
+
+	// tlsReloadInterval è ogni quanto il gateway rilegge certificato, chiave e CA dal Secret montato.
+	// Kubelet aggiorna i file del Secret in modo atomico, ma con un ritardo di circa un minuto.
+	tlsReloadInterval = 30 * time.Second
+)
+
+// tlsSettings descrive i file del Secret montato. Se CertFile è vuoto il gateway serve in chiaro.
+type tlsSettings struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ClientCAFile è il bundle delle CA con cui verificare i certificati client; se vuoto non ne chiediamo.
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	// RequireClientCert rifiuta le connessioni senza un certificato client valido.
+	RequireClientCert bool `json:"requireClientCert,omitempty"`
+}
+
+func (s *tlsSettings) validate() error {
+	if (s.CertFile == "") != (s.KeyFile == "") {
+		return fmt.Errorf("tls.certFile e tls.keyFile vanno impostati insieme")
+	}
+	if s.CertFile == "" && s.ClientCAFile != "" {
+		return fmt.Errorf("tls.clientCAFile richiede tls.certFile e tls.keyFile")
+	}
+	if s.RequireClientCert && s.ClientCAFile == "" {
+		return fmt.Errorf("tls.requireClientCert richiede tls.clientCAFile")
+	}
+	return nil
+}
+
+// tlsReloader conserva il certificato del server e le CA dei client, e li ricarica quando
+// i file del Secret montato cambiano, senza riavviare il gateway.
+type tlsReloader struct {
+	settings tlsSettings
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	// digest identifica il contenuto dei file caricati, per ricaricarli solo quando cambiano.
+	digest string
+}
+
+func newTLSReloader(settings tlsSettings) (*tlsReloader, error) {
+	r := &tlsReloader{settings: settings}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload rilegge i file e, se sono cambiati, sostituisce certificato e CA. Restituisce true se li ha sostituiti.
+// In caso di errore, ad esempio durante una rotazione non ancora completa, resta in uso la configurazione precedente.
+func (r *tlsReloader) reload() (bool, error) {
+	certPEM, err := os.ReadFile(r.settings.CertFile)
+	if err != nil {
+		return false, fmt.Errorf("impossibile leggere il certificato TLS: %w", err)
+	}
+	keyPEM, err := os.ReadFile(r.settings.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("impossibile leggere la chiave TLS: %w", err)
+	}
+	var caPEM []byte
+	if r.settings.ClientCAFile != "" {
+		if caPEM, err = os.ReadFile(r.settings.ClientCAFile); err != nil {
+			return false, fmt.Errorf("impossibile leggere il bundle delle CA dei client: %w", err)
+		}
+	}
+	sum := sha256.Sum256(bytes.Join([][]byte{certPEM, keyPEM, caPEM}, []byte{0}))
+	digest := hex.EncodeToString(sum[:])
+
+	r.mu.RLock()
+	unchanged := digest == r.digest
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return false, fmt.Errorf("certificato o chiave TLS non validi: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if caPEM != nil {
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return false, fmt.Errorf("nessun certificato valido nel bundle delle CA dei client %s", r.settings.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	r.cert, r.clientCAs, r.digest = &cert, clientCAs, digest
+	r.mu.Unlock()
+	return true, nil
+}
+
+// watch ricarica periodicamente i file finché ctx non viene cancellato.
+func (r *tlsReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(tlsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := r.reload()
+			if err != nil {
+				log.Printf("ERRORE: Ricaricamento della configurazione TLS fallito, resta in uso la precedente: %v", err)
+			} else if changed {
+				log.Println("Certificato TLS del gateway ricaricato.")
+			}
+		}
+	}
+}
+
+// tlsConfig restituisce la configurazione del server: ogni nuova connessione usa il certificato
+// e le CA caricati per ultimi.
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	clientAuth := tls.NoClientCert
+	switch {
+	case r.settings.RequireClientCert:
+		clientAuth = tls.RequireAndVerifyClientCert
+	case r.settings.ClientCAFile != "":
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// clientCertificateAnnotations restituisce le annotazioni con l'identità del certificato client,
+// solo se il certificato è stato verificato con il bundle delle CA configurato.
+func clientCertificateAnnotations(r *http.Request) map[string]string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(leaf.Raw)
+	return map[string]string{
+		clientCertSubjectAnnotation:     leaf.Subject.String(),
+		clientCertFingerprintAnnotation: hex.EncodeToString(sum[:]),
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSignedCertificate scrive in dir un certificato autofirmato e la sua chiave.
+func writeSelfSignedCertificate(t *testing.T, dir, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tls.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "tls.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReloaderPicksUpRotation(t *testing.T) {
+	dir := t.TempDir()
+	writeSelfSignedCertificate(t, dir, "gateway-1")
+	reloader, err := newTLSReloader(tlsSettings{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	servedCommonName := func() string {
+		config, err := reloader.tlsConfig().GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	if changed, err := reloader.reload(); err != nil || changed {
+		t.Fatalf("reload() without changes = %v, %v", changed, err)
+	}
+	writeSelfSignedCertificate(t, dir, "gateway-2")
+	if changed, err := reloader.reload(); err != nil || !changed {
+		t.Fatalf("reload() after rotation = %v, %v", changed, err)
+	}
+	if cn := servedCommonName(); cn != "gateway-2" {
+		t.Fatalf("served certificate %q, want the rotated one", cn)
+	}
+
+	// Una rotazione a metà (chiave non corrispondente) non sostituisce il certificato in uso.
+	if err := os.WriteFile(filepath.Join(dir, "tls.key"), []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reloader.reload(); err == nil {
+		t.Fatal("an invalid key must be reported")
+	}
+	if cn := servedCommonName(); cn != "gateway-2" {
+		t.Fatalf("served certificate %q after a failed reload", cn)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// registrationWatcher mantiene una cache delle DeviceRegistration del namespace alimentata da un unico informer
+// e sveglia le richieste in attesa quando la risorsa che attendono cambia.
+// Così il carico sull'API server è costante, qualunque sia il numero di enrollment in corso.
+type registrationWatcher struct {
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	informer cache.SharedIndexInformer
+
+	mu sync.Mutex
+	// subscribers contiene, per nome della risorsa, i canali delle richieste in attesa.
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+func newRegistrationWatcher(client dynamic.Interface, namespace string, gvr schema.GroupVersionResource) *registrationWatcher {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespace, nil)
+	w := &registrationWatcher{
+		factory:     factory,
+		informer:    factory.ForResource(gvr).Informer(),
+		subscribers: map[string]map[chan struct{}]struct{}{},
+	}
+	w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    w.notify,
+		UpdateFunc: func(_, obj interface{}) { w.notify(obj) },
+		DeleteFunc: w.notify,
+	})
+	return w
+}
+
+// start avvia l'informer e attende che la cache sia sincronizzata.
+func (w *registrationWatcher) start(ctx context.Context) error {
+	w.factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), w.informer.HasSynced) {
+		return fmt.Errorf("impossibile sincronizzare la cache delle DeviceRegistration")
+	}
+	log.Println("Cache delle DeviceRegistration sincronizzata.")
+	return nil
+}
+
+// subscribe restituisce un canale che riceve un segnale a ogni modifica della risorsa name.
+// I segnali non letti vengono accorpati: chi li riceve deve rileggere lo stato con get.
+// La funzione restituita annulla la sottoscrizione.
+func (w *registrationWatcher) subscribe(name string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	w.mu.Lock()
+	if w.subscribers[name] == nil {
+		w.subscribers[name] = map[chan struct{}]struct{}{}
+	}
+	w.subscribers[name][ch] = struct{}{}
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.subscribers[name], ch)
+		if len(w.subscribers[name]) == 0 {
+			delete(w.subscribers, name)
+		}
+	}
+}
+
+// notify sveglia le richieste in attesa della risorsa modificata.
+func (w *registrationWatcher) notify(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.subscribers[u.GetName()] {
+		select {
+		case ch <- struct{}{}:
+		default:
+			// Un segnale è già in attesa di essere letto.
+		}
+	}
+}
+
+// get legge una DeviceRegistration dalla cache.
+func (w *registrationWatcher) get(namespace, name string) (*unstructured.Unstructured, bool, error) {
+	obj, found, err := w.informer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil || !found {
+		return nil, false, err
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, false, fmt.Errorf("oggetto inatteso in cache: %T", obj)
+	}
+	return u, true, nil
+}
+
+// list restituisce dalla cache le DeviceRegistration che corrispondono al selettore.
+func (w *registrationWatcher) list(namespace string, selector labels.Selector) ([]*unstructured.Unstructured, error) {
+	var items []*unstructured.Unstructured
+	err := cache.ListAllByNamespace(w.informer.GetIndexer(), namespace, selector, func(obj interface{}) {
+		if u, ok := obj.(*unstructured.Unstructured); ok {
+			items = append(items, u)
+		}
+	})
+	return items, err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestWaitForRegistrationWakesOnStatusUpdate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deviceRegistrationGVR: "DeviceRegistrationList"})
+	h := &gatewayHandler{
+		kubeClient:    client,
+		namespace:     "devices",
+		registrations: newRegistrationWatcher(client, "devices", deviceRegistrationGVR),
+		gvr:           deviceRegistrationGVR,
+		namePrefix:    "dev-reg-",
+	}
+	if err := h.registrations.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	name, err := h.createDeviceRegistrationResource(ctx, "key", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// L'operatore approva la registrazione dopo che il gateway ha iniziato ad attendere.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		res, err := client.Resource(deviceRegistrationGVR).Namespace("devices").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_ = unstructured.SetNestedField(res.Object, "Approved", "status", "phase")
+		_ = unstructured.SetNestedField(res.Object, "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a", "status", "deviceUUID")
+		if _, err := client.Resource(deviceRegistrationGVR).Namespace("devices").Update(ctx, res, metav1.UpdateOptions{}); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	res, err := h.waitForEnrollment(ctx, name, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, code := enrollmentOutcome(res, time.Now())
+	if code != http.StatusOK || response.DeviceUUID != "5f0c7c1e-8f3a-4a51-9a53-0d0d4f1f2b6a" {
+		t.Fatalf("unexpected outcome %d %+v", code, response)
+	}
+
+	h.registrations.mu.Lock()
+	defer h.registrations.mu.Unlock()
+	if len(h.registrations.subscribers) != 0 {
+		t.Fatalf("subscriptions leaked: %v", h.registrations.subscribers)
+	}
+}
+
+func TestWaitForEnrollmentErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{deviceRegistrationGVR: "DeviceRegistrationList"})
+	h := &gatewayHandler{
+		kubeClient:    client,
+		namespace:     "devices",
+		registrations: newRegistrationWatcher(client, "devices", deviceRegistrationGVR),
+		gvr:           deviceRegistrationGVR,
+		namePrefix:    "dev-reg-",
+		lifecycle:     newLifecycle(),
+	}
+	if err := h.registrations.start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	name, err := h.createDeviceRegistrationResource(ctx, "key", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Il client chiude la connessione: nessuna risposta.
+	requestCtx, closeRequest := context.WithCancel(ctx)
+	closeRequest()
+	_, err = h.waitForEnrollment(requestCtx, name, 5*time.Second)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("closed client: err = %v, want context.Canceled", err)
+	}
+	rec := httptest.NewRecorder()
+	writeWaitError(rec, httptest.NewRequest(http.MethodPost, "/enroll", nil), name, err)
+	if rec.Body.Len() != 0 {
+		t.Fatalf("closed client: got a response %q, want none", rec.Body.String())
+	}
+
+	// La registrazione viene cancellata durante l'attesa: 410 NOT_FOUND.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		if err := client.Resource(deviceRegistrationGVR).Namespace("devices").Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			t.Error(err)
+		}
+	}()
+	_, err = h.waitForEnrollment(ctx, name, 5*time.Second)
+	if !errors.Is(err, errRegistrationDeleted) {
+		t.Fatalf("deleted registration: err = %v, want errRegistrationDeleted", err)
+	}
+	tests := []struct {
+		name string
+		err  error
+		code int
+		want string
+	}{
+		{name: "deleted registration", err: err, code: http.StatusGone, want: errorCodeNotFound},
+		{name: "other error", err: errors.New("cache not synced"), code: http.StatusInternalServerError, want: errorCodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeWaitError(rec, httptest.NewRequest(http.MethodPost, "/enroll", nil), name, tt.err)
+			var body ErrorResponse
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.code || body.Error.Code != tt.want {
+				t.Fatalf("status = %d, code = %q, want %d %s", rec.Code, body.Error.Code, tt.code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Package lifecycle descrive il ciclo di vita di una DeviceRegistration come macchina a stati:
+// le fasi, gli eventi che le fanno cambiare, le condizioni (guard) che una transizione deve
+// rispettare e gli effetti che il reconciler deve eseguire quando la applica.
+//
+// Il pacchetto non dipende da Kubernetes: il reconciler traduce la spec e lo status della risorsa
+// in un evento e nei Facts, chiede a Fire la transizione ed esegue gli effetti restituiti.
+package lifecycle
+
+import (
+	"fmt"
+	"time"
+)
+
+// State è una fase del ciclo di vita, riportata in status.phase.
+type State string
+
+const (
+	Pending     State = "Pending"
+	Approved    State = "Approved"
+	Rejected    State = "Rejected"
+	Deactivated State = "Deactivated"
+	Suspended   State = "Suspended"
+	Expired     State = "Expired"
+	Quarantined State = "Quarantined"
+	Retired     State = "Retired"
+)
+
+// Event è ciò che chiede un cambio di fase: l'esito della valutazione di una richiesta,
+// una modifica della spec da parte di un amministratore o la scadenza del certificato.
+type Event string
+
+const (
+	// Approve approva la richiesta ed emette un nuovo certificato.
+	Approve Event = "Approve"
+	// Adopt approva la richiesta riusando l'identità di un dispositivo già registrato con la stessa chiave.
+	Adopt Event = "Adopt"
+	// Reject rifiuta la richiesta.
+	Reject Event = "Reject"
+	// AwaitApproval lascia la richiesta in attesa della decisione di un amministratore.
+	AwaitApproval Event = "AwaitApproval"
+	// Deactivate e Reactivate corrispondono a spec.deactivate.
+	Deactivate Event = "Deactivate"
+	Reactivate Event = "Reactivate"
+	// Suspend e Resume corrispondono a spec.suspendUntil: la sospensione termina da sola.
+	Suspend Event = "Suspend"
+	Resume  Event = "Resume"
+	// Quarantine e Release corrispondono a spec.quarantine.
+	Quarantine Event = "Quarantine"
+	Release    Event = "Release"
+	// Retire corrisponde a spec.retire: il dispositivo viene dismesso in modo definitivo.
+	Retire Event = "Retire"
+	// Expire segnala che il certificato del dispositivo è scaduto senza essere rinnovato.
+	Expire Event = "Expire"
+)
+
+// Effect è un'operazione che il reconciler deve eseguire, prima di salvare la nuova fase,
+// quando applica una transizione.
+type Effect string
+
+const (
+	// IssueCertificate emette un nuovo certificato per la chiave del dispositivo.
+	IssueCertificate Effect = "IssueCertificate"
+	// HoldCertificate sospende il certificato (certificateHold nella CRL): la sospensione è reversibile.
+	HoldCertificate Effect = "HoldCertificate"
+	// ReleaseCertificate toglie la sospensione del certificato.
+	ReleaseCertificate Effect = "ReleaseCertificate"
+	// RevokeCertificate revoca il certificato in modo definitivo.
+	RevokeCertificate Effect = "RevokeCertificate"
+)
+
+// Facts sono le informazioni sulla registrazione su cui si basano le guard.
+type Facts struct {
+	Now time.Time
+	// HasIdentity indica se alla registrazione è già stato assegnato un DeviceUUID.
+	HasIdentity bool
+	// CertificateNotAfter è la scadenza del certificato corrente; nil se non ne è stato emesso uno.
+	CertificateNotAfter *time.Time
+	// SuspendUntil è la fine della sospensione chiesta in spec.suspendUntil; nil se non richiesta.
+	SuspendUntil *time.Time
+}
+
+// Guard verifica che una transizione sia possibile con i Facts correnti.
+// Se non lo è restituisce il motivo (un codice CamelCase) e una spiegazione.
+type Guard func(Facts) (ok bool, reason, message string)
+
+// Transition è una transizione ammessa dalla macchina a stati.
+type Transition struct {
+	From    State
+	Event   Event
+	To      State
+	Guard   Guard
+	Effects []Effect
+}
+
+// IllegalTransitionError indica che l'evento non è previsto nella fase corrente.
+type IllegalTransitionError struct {
+	From  State
+	Event Event
+}
+
+func (e *IllegalTransitionError) Error() string {
+	return fmt.Sprintf("event %s is not allowed in phase %s", e.Event, e.From)
+}
+
+// GuardError indica che la transizione è prevista ma la sua guard non è soddisfatta.
+type GuardError struct {
+	From    State
+	Event   Event
+	Reason  string
+	Message string
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("event %s in phase %s: %s", e.Event, e.From, e.Message)
+}
+
+// transitions è la tabella della macchina a stati. Un evento non elencato per una fase è illegale.
+var transitions = []Transition{
+	// Valutazione di una nuova richiesta.
+	{From: Pending, Event: Approve, To: Approved, Guard: hasIdentity, Effects: []Effect{IssueCertificate}},
+	{From: Pending, Event: Adopt, To: Approved, Guard: hasIdentity},
+	{From: Pending, Event: Reject, To: Rejected},
+	{From: Pending, Event: AwaitApproval, To: Pending},
+	{From: Pending, Event: Retire, To: Retired},
+
+	// Una richiesta rifiutata a pairing chiuso può essere rivalutata.
+	{From: Rejected, Event: Approve, To: Approved, Guard: hasIdentity, Effects: []Effect{IssueCertificate}},
+	{From: Rejected, Event: Adopt, To: Approved, Guard: hasIdentity},
+	{From: Rejected, Event: Reject, To: Rejected},
+	{From: Rejected, Event: AwaitApproval, To: Pending},
+	{From: Rejected, Event: Retire, To: Retired},
+
+	{From: Approved, Event: Deactivate, To: Deactivated, Effects: []Effect{HoldCertificate}},
+	{From: Approved, Event: Suspend, To: Suspended, Guard: suspensionRequested, Effects: []Effect{HoldCertificate}},
+	{From: Approved, Event: Quarantine, To: Quarantined, Effects: []Effect{RevokeCertificate}},
+	{From: Approved, Event: Retire, To: Retired, Effects: []Effect{RevokeCertificate}},
+	{From: Approved, Event: Expire, To: Expired, Guard: certificateExpired},
+
+	{From: Deactivated, Event: Reactivate, To: Approved, Effects: []Effect{ReleaseCertificate}},
+	{From: Deactivated, Event: Quarantine, To: Quarantined, Effects: []Effect{RevokeCertificate}},
+	{From: Deactivated, Event: Retire, To: Retired, Effects: []Effect{RevokeCertificate}},
+
+	{From: Suspended, Event: Resume, To: Approved, Guard: suspensionOver, Effects: []Effect{ReleaseCertificate}},
+	{From: Suspended, Event: Deactivate, To: Deactivated, Effects: []Effect{HoldCertificate}},
+	{From: Suspended, Event: Quarantine, To: Quarantined, Effects: []Effect{RevokeCertificate}},
+	{From: Suspended, Event: Retire, To: Retired, Effects: []Effect{RevokeCertificate}},
+
+	// Un certificato scaduto non ha bisogno di essere revocato.
+	{From: Expired, Event: Retire, To: Retired},
+
+	// Il certificato revocato durante la quarantena non torna valido: al rilascio se ne emette uno nuovo.
+	{From: Quarantined, Event: Release, To: Approved, Effects: []Effect{ReleaseCertificate, IssueCertificate}},
+	{From: Quarantined, Event: Retire, To: Retired},
+
+	// Retired è una fase terminale.
+}
+
+// table indicizza le transizioni per fase ed evento.
+var table = func() map[State]map[Event]Transition {
+	t := map[State]map[Event]Transition{}
+	for _, tr := range transitions {
+		if t[tr.From] == nil {
+			t[tr.From] = map[Event]Transition{}
+		}
+		t[tr.From][tr.Event] = tr
+	}
+	return t
+}()
+
+// States restituisce tutte le fasi del ciclo di vita.
+func States() []State {
+	return []State{Pending, Approved, Rejected, Deactivated, Suspended, Expired, Quarantined, Retired}
+}
+
+// Events restituisce tutti gli eventi del ciclo di vita.
+func Events() []Event {
+	return []Event{Approve, Adopt, Reject, AwaitApproval, Deactivate, Reactivate, Suspend, Resume, Quarantine, Release, Retire, Expire}
+}
+
+// ParseState converte il valore di status.phase in una fase. Una fase vuota equivale a Pending.
+func ParseState(phase string) (State, error) {
+	if phase == "" {
+		return Pending, nil
+	}
+	for _, s := range States() {
+		if string(s) == phase {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("unknown phase %q", phase)
+}
+
+// Allowed indica se l'evento è previsto nella fase, senza valutarne la guard.
+func Allowed(from State, event Event) bool {
+	_, ok := table[from][event]
+	return ok
+}
+
+// Fire restituisce la transizione che l'evento provoca nella fase from.
+// Restituisce un *IllegalTransitionError se l'evento non è previsto nella fase
+// e un *GuardError se la guard della transizione non è soddisfatta.
+func Fire(from State, event Event, facts Facts) (Transition, error) {
+	tr, ok := table[from][event]
+	if !ok {
+		return Transition{}, &IllegalTransitionError{From: from, Event: event}
+	}
+	if tr.Guard != nil {
+		if ok, reason, message := tr.Guard(facts); !ok {
+			return Transition{}, &GuardError{From: from, Event: event, Reason: reason, Message: message}
+		}
+	}
+	return tr, nil
+}
+
+func hasIdentity(f Facts) (bool, string, string) {
+	if !f.HasIdentity {
+		return false, "MissingDeviceUUID", "a DeviceUUID must be assigned before approval"
+	}
+	return true, "", ""
+}
+
+func certificateExpired(f Facts) (bool, string, string) {
+	if f.CertificateNotAfter == nil || f.Now.Before(*f.CertificateNotAfter) {
+		return false, "CertificateNotExpired", "the device certificate has not expired"
+	}
+	return true, "", ""
+}
+
+func suspensionRequested(f Facts) (bool, string, string) {
+	if f.SuspendUntil == nil || !f.Now.Before(*f.SuspendUntil) {
+		return false, "SuspensionOver", "spec.suspendUntil must be in the future"
+	}
+	return true, "", ""
+}
+
+func suspensionOver(f Facts) (bool, string, string) {
+	if f.SuspendUntil != nil && f.Now.Before(*f.SuspendUntil) {
+		return false, "SuspensionNotOver", fmt.Sprintf("the device is suspended until %s", f.SuspendUntil.Format(time.RFC3339))
+	}
+	return true, "", ""
+}
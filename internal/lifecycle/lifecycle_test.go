@@ -0,0 +1,187 @@
+package lifecycle
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// expected è la macchina a stati attesa, scritta indipendentemente dalla tabella del pacchetto:
+// per ogni fase, gli eventi ammessi e la fase di arrivo. Ogni coppia non elencata è illegale.
+var expected = map[State]map[Event]State{
+	Pending: {
+		Approve: Approved, Adopt: Approved, Reject: Rejected, AwaitApproval: Pending, Retire: Retired,
+	},
+	Rejected: {
+		Approve: Approved, Adopt: Approved, Reject: Rejected, AwaitApproval: Pending, Retire: Retired,
+	},
+	Approved: {
+		Deactivate: Deactivated, Suspend: Suspended, Quarantine: Quarantined, Retire: Retired, Expire: Expired,
+	},
+	Deactivated: {
+		Reactivate: Approved, Quarantine: Quarantined, Retire: Retired,
+	},
+	Suspended: {
+		Resume: Approved, Deactivate: Deactivated, Quarantine: Quarantined, Retire: Retired,
+	},
+	Expired: {
+		Retire: Retired,
+	},
+	Quarantined: {
+		Release: Approved, Retire: Retired,
+	},
+	Retired: {},
+}
+
+// permissiveFacts restituisce dei Facts che soddisfano la guard dell'evento, se ne ha una.
+func permissiveFacts(event Event) Facts {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	facts := Facts{Now: now, HasIdentity: true}
+	switch event {
+	case Expire:
+		notAfter := now.Add(-time.Hour)
+		facts.CertificateNotAfter = &notAfter
+	case Suspend:
+		until := now.Add(time.Hour)
+		facts.SuspendUntil = &until
+	}
+	return facts
+}
+
+func TestFireCoversEveryStateAndEvent(t *testing.T) {
+	for _, from := range States() {
+		for _, event := range Events() {
+			tr, err := Fire(from, event, permissiveFacts(event))
+			to, legal := expected[from][event]
+			if !legal {
+				var illegal *IllegalTransitionError
+				if !errors.As(err, &illegal) {
+					t.Errorf("%s --%s--> got (%+v, %v), want an IllegalTransitionError", from, event, tr, err)
+				} else if illegal.From != from || illegal.Event != event {
+					t.Errorf("%s --%s--> error = %+v", from, event, illegal)
+				}
+				if Allowed(from, event) {
+					t.Errorf("Allowed(%s, %s) = true, want false", from, event)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%s --%s--> unexpected error: %v", from, event, err)
+				continue
+			}
+			if tr.From != from || tr.Event != event || tr.To != to {
+				t.Errorf("%s --%s--> got %s --%s--> %s, want %s", from, event, tr.From, tr.Event, tr.To, to)
+			}
+			if !Allowed(from, event) {
+				t.Errorf("Allowed(%s, %s) = false, want true", from, event)
+			}
+		}
+	}
+}
+
+func TestRetiredIsTerminal(t *testing.T) {
+	for _, event := range Events() {
+		if Allowed(Retired, event) {
+			t.Errorf("event %s is allowed in phase Retired", event)
+		}
+	}
+	// Ogni altra fase deve poter arrivare a Retired.
+	for _, from := range States() {
+		if from != Retired && !Allowed(from, Retire) {
+			t.Errorf("phase %s cannot be retired", from)
+		}
+	}
+}
+
+func TestEffects(t *testing.T) {
+	tests := []struct {
+		from    State
+		event   Event
+		effects []Effect
+	}{
+		{Pending, Approve, []Effect{IssueCertificate}},
+		{Rejected, Approve, []Effect{IssueCertificate}},
+		{Pending, Adopt, nil},
+		{Pending, Retire, nil},
+		{Approved, Deactivate, []Effect{HoldCertificate}},
+		{Approved, Suspend, []Effect{HoldCertificate}},
+		{Approved, Quarantine, []Effect{RevokeCertificate}},
+		{Approved, Retire, []Effect{RevokeCertificate}},
+		{Approved, Expire, nil},
+		{Deactivated, Reactivate, []Effect{ReleaseCertificate}},
+		{Suspended, Resume, []Effect{ReleaseCertificate}},
+		{Suspended, Deactivate, []Effect{HoldCertificate}},
+		{Quarantined, Release, []Effect{ReleaseCertificate, IssueCertificate}},
+		{Quarantined, Retire, nil},
+		{Expired, Retire, nil},
+	}
+	for _, tt := range tests {
+		tr, err := Fire(tt.from, tt.event, permissiveFacts(tt.event))
+		if err != nil {
+			t.Fatalf("%s --%s-->: %v", tt.from, tt.event, err)
+		}
+		if !reflect.DeepEqual(tr.Effects, tt.effects) {
+			t.Errorf("%s --%s--> effects = %v, want %v", tt.from, tt.event, tr.Effects, tt.effects)
+		}
+	}
+}
+
+func TestGuards(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	tests := []struct {
+		name   string
+		from   State
+		event  Event
+		facts  Facts
+		reason string
+	}{
+		{"approval without identity", Pending, Approve, Facts{Now: now}, "MissingDeviceUUID"},
+		{"adoption without identity", Rejected, Adopt, Facts{Now: now}, "MissingDeviceUUID"},
+		{"approval with identity", Pending, Approve, Facts{Now: now, HasIdentity: true}, ""},
+		{"expiry without certificate", Approved, Expire, Facts{Now: now}, "CertificateNotExpired"},
+		{"expiry of a valid certificate", Approved, Expire, Facts{Now: now, CertificateNotAfter: &future}, "CertificateNotExpired"},
+		{"expiry of an expired certificate", Approved, Expire, Facts{Now: now, CertificateNotAfter: &past}, ""},
+		{"expiry at NotAfter", Approved, Expire, Facts{Now: now, CertificateNotAfter: &now}, ""},
+		{"suspension without end", Approved, Suspend, Facts{Now: now}, "SuspensionOver"},
+		{"suspension in the past", Approved, Suspend, Facts{Now: now, SuspendUntil: &past}, "SuspensionOver"},
+		{"suspension in the future", Approved, Suspend, Facts{Now: now, SuspendUntil: &future}, ""},
+		{"resume before the end", Suspended, Resume, Facts{Now: now, SuspendUntil: &future}, "SuspensionNotOver"},
+		{"resume after the end", Suspended, Resume, Facts{Now: now, SuspendUntil: &past}, ""},
+		{"resume after removing suspendUntil", Suspended, Resume, Facts{Now: now}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Fire(tt.from, tt.event, tt.facts)
+			if tt.reason == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			var guard *GuardError
+			if !errors.As(err, &guard) {
+				t.Fatalf("error = %v, want a GuardError", err)
+			}
+			if guard.Reason != tt.reason {
+				t.Fatalf("reason = %q, want %q", guard.Reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestParseState(t *testing.T) {
+	if s, err := ParseState(""); err != nil || s != Pending {
+		t.Fatalf(`ParseState("") = %q, %v, want Pending`, s, err)
+	}
+	for _, want := range States() {
+		if s, err := ParseState(string(want)); err != nil || s != want {
+			t.Fatalf("ParseState(%q) = %q, %v", want, s, err)
+		}
+	}
+	if _, err := ParseState("Unknown"); err == nil {
+		t.Fatal("ParseState must reject unknown phases")
+	}
+}
@@ -1,25 +1,90 @@
 // mcu_client/src/main.rs
 
+use base64::{engine::general_purpose::STANDARD as BASE64, Engine as _};
+use ed25519_dalek::{Signer, SigningKey};
+use rand_core::OsRng;
 use serde::{Deserialize, Serialize};
 use reqwest::StatusCode;
 
 // Definiamo una struct per il corpo della nostra richiesta POST.
 // `Serialize` permette di convertirla in JSON.
+// Oltre alla chiave pubblica inviamo il nonce ricevuto dal Gateway e la sua firma,
+// che dimostrano il possesso della chiave privata.
+// I metadati descrivono il dispositivo: il Gateway li copia nella DeviceRegistration.
 #[derive(Serialize)]
 struct EnrollmentRequest {
     #[serde(rename = "publicKey")]
     public_key: String,
+    nonce: String,
+    signature: String,
+    metadata: DeviceMetadata,
 }
 
-// Definiamo una struct per la risposta JSON che ci aspettiamo in caso di successo.
+// Metadati del dispositivo simulato; il numero di serie viene inviato solo se è impostata MCU_SERIAL_NUMBER.
+#[derive(Serialize)]
+struct DeviceMetadata {
+    model: String,
+    #[serde(rename = "firmwareVersion")]
+    firmware_version: String,
+    #[serde(rename = "serialNumber", skip_serializing_if = "Option::is_none")]
+    serial_number: Option<String>,
+}
+
+// La challenge restituita da POST /enroll/challenge.
+#[derive(Deserialize, Debug)]
+struct ChallengeResponse {
+    nonce: String,
+}
+
+// Definiamo una struct per la risposta JSON del Gateway, sia a POST /enroll sia a GET /enroll/{ticket}.
 // `Deserialize` permette di convertire il JSON in questa struct.
+// L'UUID è presente solo se la registrazione è approvata; il ticket serve a interrogare l'esito in seguito.
 #[derive(Deserialize, Debug)]
 struct EnrollmentResponse {
+    status: String,
+    ticket: Option<String>,
     #[serde(rename = "deviceUUID")]
-    device_uuid: String,
+    device_uuid: Option<String>,
+    // Catena PEM: certificato del dispositivo seguito da quello della CA dell'operatore.
+    certificate: Option<String>,
     message: String,
 }
 
+// Ogni risposta di errore del Gateway contiene un oggetto `error` con un codice stabile
+// (es. PAIRING_CLOSED, INVALID_KEY, RATE_LIMITED), l'identificativo della richiesta
+// e l'indicazione se ha senso riprovare.
+#[derive(Deserialize, Debug)]
+struct ErrorBody {
+    error: ErrorDetail,
+}
+
+#[derive(Deserialize, Debug)]
+struct ErrorDetail {
+    code: String,
+    message: String,
+    // Il motivo del rifiuto scritto dall'operatore in status.reason, se presente.
+    reason: Option<String>,
+    #[serde(rename = "requestId")]
+    request_id: Option<String>,
+    retryable: bool,
+}
+
+// Suggerimento da mostrare all'utente per i codici di errore che il dispositivo sa interpretare.
+fn error_hint(code: &str) -> &'static str {
+    match code {
+        "PAIRING_CLOSED" => "La modalità di pairing è chiusa: riprovare quando un amministratore la riapre.",
+        "INVALID_KEY" => "La chiave del dispositivo non è accettata: generare una nuova chiave.",
+        "DUPLICATE" => "La chiave appartiene già a un altro dispositivo registrato.",
+        "RATE_LIMITED" => "Troppe richieste: attendere prima di riprovare.",
+        "SUSPENDED" => "Il dispositivo è sospeso: riprovare al termine della sospensione.",
+        "QUARANTINED" => "Il dispositivo è in quarantena: contattare un amministratore.",
+        "RETIRED" => "Il dispositivo è stato dismesso e non può più registrarsi.",
+        "TIMEOUT" | "EXPIRED" => "Ripetere l'enrollment dall'inizio.",
+        "UNAVAILABLE" | "INTERNAL" => "Errore temporaneo del Gateway: riprovare più tardi.",
+        _ => "Contattare un amministratore.",
+    }
+}
+
 // Usiamo il runtime asincrono Tokio.
 #[tokio::main]
 async fn main() -> Result<(), reqwest::Error> {
@@ -27,20 +92,44 @@ async fn main() -> Result<(), reqwest::Error> {
 
     // 1. Definiamo l'indirizzo del nostro Gateway (MPU).
     let gateway_url = "http://localhost:30007/enroll";
+    // In attesa di una decisione, interroghiamo l'esito con long-poll da 30 secondi.
+    let status_wait_seconds = 30;
+    let challenge_url = "http://localhost:30007/enroll/challenge";
 
-    // 2. Generiamo una chiave pubblica a runtime.
-    // In un'applicazione reale, useremmo una libreria crittografica (es. `rsa`, `ring`).
-    // Per questa simulazione, una stringa unica è sufficiente.
-    let public_key = format!("ssh-rsa FAKE-KEY-{}", uuid::Uuid::new_v4().to_string());
+    // 2. Generiamo una coppia di chiavi Ed25519 a runtime.
+    // La chiave pubblica viene inviata come Ed25519 grezza codificata in base64.
+    let signing_key = SigningKey::generate(&mut OsRng);
+    let public_key = BASE64.encode(signing_key.verifying_key().as_bytes());
     println!("[MCU] Chiave pubblica generata: {:.30}...", public_key);
 
-    // 3. Prepariamo il payload della richiesta.
+    // 3. Creiamo un client HTTP e chiediamo una challenge al Gateway.
+    let client = reqwest::Client::new();
+    println!("[MCU] Richiesta della challenge a {}", challenge_url);
+    let challenge = match client.post(challenge_url).send().await {
+        Ok(res) if res.status() == StatusCode::OK => res.json::<ChallengeResponse>().await?,
+        Ok(res) => {
+            println!("\n❌ ERRORE: Il Gateway ha rifiutato la richiesta di challenge ({}).", res.status());
+            return Ok(());
+        }
+        Err(e) => {
+            println!("\n❌ ERRORE CRITICO: Impossibile connettersi al Gateway.");
+            println!("   - Dettagli: {}", e);
+            return Ok(());
+        }
+    };
+
+    // 4. Firmiamo il nonce con la chiave privata e prepariamo il payload della richiesta.
+    let signature = signing_key.sign(challenge.nonce.as_bytes());
     let request_payload = EnrollmentRequest {
         public_key: public_key.clone(),
+        nonce: challenge.nonce,
+        signature: BASE64.encode(signature.to_bytes()),
+        metadata: DeviceMetadata {
+            model: "mcu-simulator".to_string(),
+            firmware_version: env!("CARGO_PKG_VERSION").to_string(),
+            serial_number: std::env::var("MCU_SERIAL_NUMBER").ok(),
+        },
     };
-
-    // 4. Creiamo un client HTTP.
-    let client = reqwest::Client::new();
     println!("[MCU] Invio della richiesta di enrollment a {}", gateway_url);
 
     // 5. Inviamo la richiesta POST asincrona.
@@ -54,40 +143,85 @@ async fn main() -> Result<(), reqwest::Error> {
         .send()
         .await;
 
-    // 6. Gestiamo la risposta del Gateway.
-    match response {
-        Ok(res) => {
-            // La richiesta è andata a buon fine, ora controlliamo lo status code.
-            match res.status() {
-                StatusCode::OK => {
-                    // Successo (200 OK)! Proviamo a deserializzare il corpo della risposta.
-                    match res.json::<EnrollmentResponse>().await {
-                        Ok(enrollment_data) => {
-                            println!("\n✅ REGISTRAZIONE COMPLETATA CON SUCCESSO!");
-                            println!("   - Messaggio dal Gateway: {}", enrollment_data.message);
-                            println!("   - UUID del dispositivo assegnato: {}", enrollment_data.device_uuid);
-                            println!("[MCU] Salvataggio dell'UUID e conclusione del processo.");
-                        }
-                        Err(_) => {
-                            println!("\n❌ ERRORE: Risposta di successo ricevuta, ma il corpo JSON non è valido.");
+    // 6. Gestiamo la risposta del Gateway. Finché la registrazione resta in attesa (202 Accepted)
+    //    interroghiamo l'esito con il ticket, senza tenere aperta una connessione per minuti.
+    let mut response = response;
+    loop {
+        let res = match response {
+            Ok(res) => res,
+            Err(e) => {
+                // Errore a livello di rete (es. il Gateway non è raggiungibile).
+                println!("\n❌ ERRORE CRITICO: Impossibile connettersi al Gateway.");
+                println!("   - Dettagli: {}", e);
+                println!("   - Assicurati che il cluster k3d e il Gateway siano in esecuzione e che la porta 30007 sia mappata.");
+                break;
+            }
+        };
+
+        // La richiesta è andata a buon fine, ora controlliamo lo status code.
+        match res.status() {
+            StatusCode::OK => {
+                // Successo (200 OK)! Proviamo a deserializzare il corpo della risposta.
+                match res.json::<EnrollmentResponse>().await {
+                    Ok(enrollment_data) => {
+                        println!("\n✅ REGISTRAZIONE COMPLETATA CON SUCCESSO!");
+                        println!("   - Messaggio dal Gateway: {}", enrollment_data.message);
+                        println!("   - UUID del dispositivo assegnato: {}", enrollment_data.device_uuid.unwrap_or_default());
+                        if let Some(certificate) = &enrollment_data.certificate {
+                            println!("   - Certificato ricevuto:\n{}", certificate.trim());
                         }
+                        println!("[MCU] Salvataggio dell'UUID e conclusione del processo.");
+                    }
+                    Err(_) => {
+                        println!("\n❌ ERRORE: Risposta di successo ricevuta, ma il corpo JSON non è valido.");
                     }
                 }
-                status => {
-                    // Abbiamo ricevuto uno status code di errore (es. 403 Forbidden).
-                    let error_body = res.text().await.unwrap_or_else(|_| "Nessun corpo del messaggio.".to_string());
-                    println!("\n❌ REGISTRAZIONE FALLITA!");
-                    println!("   - Status Code: {}", status);
-                    println!("   - Messaggio di errore dal Gateway: {}", error_body.trim());
+                break;
+            }
+            StatusCode::ACCEPTED => {
+                // 202 Accepted: la richiesta è valida ma l'operatore non ha ancora deciso
+                // (ad esempio attende l'approvazione manuale di un amministratore).
+                let pending = match res.json::<EnrollmentResponse>().await {
+                    Ok(pending) => pending,
+                    Err(_) => {
+                        println!("\n❌ ERRORE: Risposta 202 ricevuta, ma il corpo JSON non è valido.");
+                        break;
+                    }
+                };
+                let Some(ticket) = pending.ticket else {
+                    println!("\n❌ ERRORE: Il Gateway non ha restituito un ticket.");
+                    break;
+                };
+                println!("\n⏳ REGISTRAZIONE IN ATTESA ({}).", pending.status);
+                println!("   - Messaggio dal Gateway: {}", pending.message);
+                let status_url = format!("{}/{}?wait={}", gateway_url, ticket, status_wait_seconds);
+                response = client.get(&status_url).send().await;
+            }
+            status => {
+                // Abbiamo ricevuto uno status code di errore (es. 403 Rejected o 410 Expired):
+                // il codice nell'oggetto `error` ci dice come reagire.
+                let error_body = res.text().await.unwrap_or_else(|_| "Nessun corpo del messaggio.".to_string());
+                println!("\n❌ REGISTRAZIONE FALLITA!");
+                println!("   - Status Code: {}", status);
+                match serde_json::from_str::<ErrorBody>(&error_body) {
+                    Ok(body) => {
+                        let error = body.error;
+                        println!("   - Codice di errore: {}", error.code);
+                        if let Some(reason) = &error.reason {
+                            println!("   - Motivo indicato dall'operatore: {}", reason);
+                        }
+                        println!("   - Messaggio dal Gateway: {}", error.message);
+                        println!("   - ID della richiesta: {}", error.request_id.unwrap_or_default());
+                        println!("   - Si può riprovare: {}", if error.retryable { "sì" } else { "no" });
+                        println!("   - {}", error_hint(&error.code));
+                    }
+                    Err(_) => {
+                        println!("   - Messaggio di errore dal Gateway: {}", error_body.trim());
+                    }
                 }
+                break;
             }
         }
-        Err(e) => {
-            // Errore a livello di rete (es. il Gateway non è raggiungibile).
-            println!("\n❌ ERRORE CRITICO: Impossibile connettersi al Gateway.");
-            println!("   - Dettagli: {}", e);
-            println!("   - Assicurati che il cluster k3d e il Gateway siano in esecuzione e che la porta 30007 sia mappata.");
-        }
     }
 
     Ok(())